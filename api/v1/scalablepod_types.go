@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,16 +31,76 @@ const (
 	SPInactive SPStatus = "Inactive"
 )
 
+// Labels identifying the ScalablePod a pod is bound to. Pods can run in a different namespace to their ScalablePod,
+// so an owner reference can't be used.
+const (
+	ScalablePodNameLabel      = "scalable.scalablepod.tutorial.io/scalablepod"
+	ScalablePodNamespaceLabel = "scalable.scalablepod.tutorial.io/scalablepod-namespace"
+)
+
+// TraceParentAnnotation holds the W3C traceparent of the request that last claimed a ScalablePod, so the reconciles it
+// causes can be linked back to that request's trace.
+const TraceParentAnnotation = "scalable.scalablepod.tutorial.io/traceparent"
+
 // ScalablePodSpec defines the desired state of ScalablePod
 type ScalablePodSpec struct {
+	// ScalablePodClass whose defaults and policy the ScalablePod uses. New ScalablePods that don't name one are
+	// given the default class, if there is one. It can't be changed.
+	// +optional
+	ClassName string `json:"className,omitempty"`
+
 	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Maximum time to wait between after transitioning to Active before shutting down. Defaulted when the ScalablePod is
+	// created if it is unset.
+	MaxActiveTimeSec int32 `json:"maxActiveTimeSec,omitempty"`
+
+	// Required unless the ScalablePod's class gives one
+	// +optional
+	PodImageName string `json:"podImageName,omitempty"`
+
+	// Defaulted when the ScalablePod is created if it is unset
+	// +optional
+	PodImageTag string `json:"podImageTag,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
 
-	// Maximum time to wait between after transitioning to Active before shutting down.
-	MaxActiveTimeSec int32 `json:"maxActiveTimeSec"`
+	// Port the workload serves HTTP on. When set, the pod runs the image's own command, is Ready once the port accepts
+	// connections, and the user-facing server proxies requests to it. Otherwise the pod just sleeps.
+	Port *int32 `json:"port,omitempty"`
 
-	PodImageName string `json:"podImageName"`
+	// Compute resources the pod's container requests and is limited to. They are recorded with the ScalablePod's usage.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
 
-	PodImageTag string `json:"podImageTag"`
+	// Security context of the pod's container
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+}
+
+// ScalablePodDefaults are filled in on ScalablePods that don't set them when they are created.
+type ScalablePodDefaults struct {
+	// +optional
+	PodImageTag string `json:"podImageTag,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxActiveTimeSec int32 `json:"maxActiveTimeSec,omitempty"`
+
+	// Requests and limits for each resource the ScalablePod doesn't give one for
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Used if the ScalablePod doesn't have a security context
+	// +optional
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// Labels the ScalablePod doesn't already have
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // ScalablePodStatus defines the observed state of ScalablePod
@@ -55,7 +116,71 @@ type ScalablePodStatus struct {
 	BoundPod *NamespacedName `json:"boundPod,omitempty"`
 
 	// Whether or not this ScalablePod is requested to activate.
+	// Clearing it on an Active ScalablePod releases it early.
 	Requested bool `json:"requested"`
+
+	// When this ScalablePod was last requested or claimed
+	RequestedAt *metav1.Time `json:"requestedAt,omitempty"`
+
+	// When the bound pod became Ready
+	ReadyAt *metav1.Time `json:"readyAt,omitempty"`
+
+	// Whether this ScalablePod was activated ahead of demand by its pool and is waiting to be claimed.
+	// Warm ScalablePods do not expire until they are claimed.
+	Warm bool `json:"warm,omitempty"`
+
+	// Identifies the request that claimed this ScalablePod, so the user-facing server can find the pod serving it
+	ClaimID string `json:"claimID,omitempty"`
+
+	// When the claimant last renewed its lease on this ScalablePod. A claimed ScalablePod expires maxActiveTimeSec after
+	// the later of this and startedAt.
+	LeaseRenewedAt *metav1.Time `json:"leaseRenewedAt,omitempty"`
+
+	// Who claimed this ScalablePod, as authenticated by the operator's request server. It is empty if the request server
+	// doesn't authenticate callers.
+	ClaimedBy string `json:"claimedBy,omitempty"`
+
+	// Idempotency-Key of the request that claimed this ScalablePod, so that a retry of the request by the same caller is
+	// given this claim rather than another ScalablePod
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Whether the ScalablePod's class was found to be missing during this activation, so that it is only reported once.
+	// Such a ScalablePod runs with its own settings and the built-in defaults.
+	ClassMissing bool `json:"classMissing,omitempty"`
+
+	// The ScalablePod's most recent activations, oldest first, up to ActivationHistoryLimit of them
+	// +optional
+	History []ActivationRecord `json:"history,omitempty"`
+}
+
+// ActivationHistoryLimit is the most activations kept in a ScalablePod's history.
+const ActivationHistoryLimit = 10
+
+// ActivationRecord is what happened to one of a ScalablePod's activations, kept once it is deactivated.
+type ActivationRecord struct {
+	// The claim the ScalablePod was activated for, or empty if it was warm and never claimed
+	// +optional
+	ClaimID string `json:"claimID,omitempty"`
+
+	// +optional
+	ClaimedBy string `json:"claimedBy,omitempty"`
+
+	// Name of the bound pod
+	// +optional
+	Pod string `json:"pod,omitempty"`
+
+	// When the pod was started
+	StartedAt metav1.Time `json:"startedAt"`
+
+	// When the ScalablePod was deactivated
+	EndedAt metav1.Time `json:"endedAt"`
+
+	// Why the ScalablePod was deactivated: expired, released, preempted or idle
+	Reason string `json:"reason"`
+
+	// Exit code of the pod's container, if it had terminated
+	// +optional
+	ExitCode *int32 `json:"exitCode,omitempty"`
 }
 
 type NamespacedName struct {
@@ -71,6 +196,7 @@ type NamespacedName struct {
 // +kubebuilder:printcolumn:name="Started At",type=string,JSONPath=`.status.startedAt`
 // +kubebuilder:printcolumn:name="Max Active Sec",type=string,JSONPath=`.spec.maxActiveTimeSec`
 // +kubebuilder:printcolumn:name="Bound Pod",type=string,JSONPath=`.status.boundPod.name`
+// +kubebuilder:printcolumn:name="Claimed By",type=string,JSONPath=`.status.claimedBy`,priority=1
 type ScalablePod struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
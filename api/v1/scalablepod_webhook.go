@@ -0,0 +1,404 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var scalablepodlog = logf.Log.WithName("scalablepod-resource")
+
+var (
+	// An image name without its tag or digest, optionally starting with a registry host and port
+	imageNamePattern = regexp.MustCompile(`^([a-zA-Z0-9][a-zA-Z0-9.-]*(:[0-9]+)?/)?[a-z0-9]+([._-]+[a-z0-9]+)*(/[a-z0-9]+([._-]+[a-z0-9]+)*)*$`)
+	imageTagPattern  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// Images ScalablePods may run, set by SetAllowedImages. Any image is allowed if it is empty.
+var allowedImages []string
+
+// SetAllowedImages limits the images ScalablePods may be created with to those matching one of the patterns: an image
+// name, such as `busybox`, or a prefix ending in `*`, such as `registry.example.com/team-a/*`. Any image is allowed if
+// there are no patterns. It must be called before the webhook serves requests.
+func SetAllowedImages(patterns []string) {
+	allowedImages = patterns
+}
+
+// Defaults the operator is configured with, set by SetDefaults
+var defaults ScalablePodDefaults
+
+// DefaultMaxActiveTimeSec is how long a ScalablePod stays Active when neither it, its class nor the operator's
+// defaults say.
+const DefaultMaxActiveTimeSec = 3600
+
+// Defaults used when neither the ScalablePod nor the operator's defaults give one
+var builtinDefaults = ScalablePodDefaults{PodImageTag: "latest", MaxActiveTimeSec: DefaultMaxActiveTimeSec}
+
+// SetDefaults sets the defaults filled in on new ScalablePods, ahead of the built-in ones. It must be called before the
+// webhook serves requests.
+func SetDefaults(d ScalablePodDefaults) {
+	defaults = d
+}
+
+// Reads the ScalablePodClasses of ScalablePods, set up with the webhooks
+var classReader client.Reader
+
+// How long the webhooks wait to read ScalablePodClasses, well within the 10s the API server waits for a webhook by
+// default, so that a slow read fails the lookup rather than the whole admission request
+const classLookupTimeout = 3 * time.Second
+
+func (r *ScalablePod) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	classReader = mgr.GetClient()
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-scalable-scalablepod-tutorial-io-v1-scalablepod,mutating=true,failurePolicy=fail,sideEffects=None,groups=scalable.scalablepod.tutorial.io,resources=scalablepods,verbs=create,versions=v1,name=mscalablepod.kb.io,admissionReviewVersions={v1,v1beta1}
+
+var _ webhook.Defaulter = &ScalablePod{}
+
+/* Default implements webhook.Defaulter so a webhook will be registered for the type. A ScalablePod that doesn't name a
+ * class is given the default one, and what it doesn't set is filled in from its class's defaults, then the operator's
+ * defaults. Only new ScalablePods are defaulted, so that changing the defaults doesn't change the pods of ScalablePods
+ * that are already running. A class that can't be read is left to ValidateCreate to reject.
+ */
+func (r *ScalablePod) Default() {
+	scalablepodlog.V(1).Info("default", "name", r.Name, "namespace", r.Namespace)
+	ctx, cancel := context.WithTimeout(context.Background(), classLookupTimeout)
+	defer cancel()
+	if r.Spec.ClassName == "" {
+		class, err := defaultClass(ctx)
+		if err != nil {
+			scalablepodlog.Error(err, "Unable to find the default ScalablePodClass", "name", r.Name, "namespace", r.Namespace)
+		} else if class != nil {
+			r.Spec.ClassName = class.Name
+		}
+	}
+	if class, err := r.class(ctx); err == nil && class != nil {
+		r.ApplyClass(class)
+	}
+	r.applyDefaults(&defaults)
+	r.ApplyBuiltinDefaults()
+}
+
+// ApplyBuiltinDefaults fills in what the ScalablePod doesn't set from the built-in defaults, which leave no setting
+// the controller needs unset.
+func (r *ScalablePod) ApplyBuiltinDefaults() {
+	r.applyDefaults(&builtinDefaults)
+}
+
+// ApplyClass fills in what the ScalablePod doesn't set from its class's defaults. The class's image tag is only used
+// with the class's image.
+func (r *ScalablePod) ApplyClass(class *ScalablePodClass) {
+	classSpec := &class.Spec.Defaults
+	classDefaults := classSpec.ScalablePodDefaults
+	if r.Spec.PodImageName == "" {
+		r.Spec.PodImageName = classSpec.PodImageName
+	} else if r.Spec.PodImageName != classSpec.PodImageName {
+		classDefaults.PodImageTag = ""
+	}
+	if r.Spec.Port == nil && classSpec.Port != nil {
+		port := *classSpec.Port
+		r.Spec.Port = &port
+	}
+	r.applyDefaults(&classDefaults)
+}
+
+/* ActiveTime returns how long the ScalablePod stays Active once claimed, from when its lease starts: its own
+ * maxActiveTimeSec, or else its class's, or else the built-in default, held within its class's limits. The class is
+ * nil if the ScalablePod doesn't name one, or it has been deleted. A ScalablePod created while the defaulting webhook
+ * was off may not set one.
+ */
+func (r *ScalablePod) ActiveTime(class *ScalablePodClass) time.Duration {
+	ttl := r.Spec.MaxActiveTimeSec
+	if ttl == 0 && class != nil {
+		ttl = class.Spec.Defaults.MaxActiveTimeSec
+	}
+	if ttl == 0 {
+		ttl = DefaultMaxActiveTimeSec
+	}
+	if class != nil {
+		ttl = class.ActiveTimeSec(ttl)
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// class returns the ScalablePod's class, or nil if it doesn't name one.
+func (r *ScalablePod) class(ctx context.Context) (*ScalablePodClass, error) {
+	if r.Spec.ClassName == "" || classReader == nil {
+		return nil, nil
+	}
+	var class ScalablePodClass
+	if err := classReader.Get(ctx, types.NamespacedName{Name: r.Spec.ClassName}, &class); err != nil {
+		return nil, err
+	}
+	return &class, nil
+}
+
+// defaultClass returns the ScalablePodClass marked as the default, or nil if there is none. If several are marked,
+// the first by name is used.
+func defaultClass(ctx context.Context) (*ScalablePodClass, error) {
+	if classReader == nil {
+		return nil, nil
+	}
+	var classes ScalablePodClassList
+	if err := classReader.List(ctx, &classes); err != nil {
+		return nil, err
+	}
+	sort.Slice(classes.Items, func(i, j int) bool { return classes.Items[i].Name < classes.Items[j].Name })
+	for i := range classes.Items {
+		if classes.Items[i].Annotations[DefaultClassAnnotation] == "true" {
+			return &classes.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// applyDefaults fills in what the ScalablePod doesn't set from d.
+func (r *ScalablePod) applyDefaults(d *ScalablePodDefaults) {
+	if r.Spec.PodImageTag == "" {
+		r.Spec.PodImageTag = d.PodImageTag
+	}
+	if r.Spec.MaxActiveTimeSec == 0 {
+		r.Spec.MaxActiveTimeSec = d.MaxActiveTimeSec
+	}
+	if d.Resources != nil {
+		if r.Spec.Resources == nil {
+			r.Spec.Resources = &corev1.ResourceRequirements{}
+		}
+		resources := r.Spec.Resources
+		for name, request := range d.Resources.Requests {
+			// A limit without a request is also the request, as in a pod
+			_, requested := resources.Requests[name]
+			_, limited := resources.Limits[name]
+			if !requested && !limited {
+				if resources.Requests == nil {
+					resources.Requests = corev1.ResourceList{}
+				}
+				resources.Requests[name] = request.DeepCopy()
+			}
+		}
+		for name, limit := range d.Resources.Limits {
+			if _, ok := resources.Limits[name]; !ok {
+				if resources.Limits == nil {
+					resources.Limits = corev1.ResourceList{}
+				}
+				resources.Limits[name] = limit.DeepCopy()
+			}
+		}
+	}
+	if r.Spec.SecurityContext == nil && d.SecurityContext != nil {
+		r.Spec.SecurityContext = d.SecurityContext.DeepCopy()
+	}
+	for key, value := range d.Labels {
+		if _, ok := r.Labels[key]; !ok {
+			if r.Labels == nil {
+				r.Labels = map[string]string{}
+			}
+			r.Labels[key] = value
+		}
+	}
+}
+
+//+kubebuilder:webhook:path=/validate-scalable-scalablepod-tutorial-io-v1-scalablepod,mutating=false,failurePolicy=fail,sideEffects=None,groups=scalable.scalablepod.tutorial.io,resources=scalablepods;scalablepods/status,verbs=create;update,versions=v1,name=vscalablepod.kb.io,admissionReviewVersions={v1,v1beta1}
+
+var _ webhook.Validator = &ScalablePod{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ScalablePod) ValidateCreate() error {
+	scalablepodlog.V(1).Info("validate create", "name", r.Name, "namespace", r.Namespace)
+	allErrs := r.validateSpec()
+	allErrs = append(allErrs, r.validateImageAllowed()...)
+	allErrs = append(allErrs, r.validateClass()...)
+	allErrs = append(allErrs, r.validateStatus()...)
+	return r.invalid(allErrs)
+}
+
+/* ValidateUpdate implements webhook.Validator so a webhook will be registered for the type. The spec is only checked
+ * if it changed, and the allowlist only if the image did, so that ScalablePods created before a rule was added can
+ * still have their status updated. The pod's image, port, resources and security context can't change while it is
+ * running, and a claim can't be taken over by another one without the ScalablePod being released first. The class
+ * can't change.
+ */
+func (r *ScalablePod) ValidateUpdate(old runtime.Object) error {
+	scalablepodlog.V(1).Info("validate update", "name", r.Name, "namespace", r.Namespace)
+	oldSP, ok := old.(*ScalablePod)
+	if !ok {
+		return fmt.Errorf("expected a ScalablePod, got %T", old)
+	}
+	var allErrs field.ErrorList
+	if !equality.Semantic.DeepEqual(r.Spec, oldSP.Spec) {
+		allErrs = append(allErrs, r.validateSpec()...)
+		if r.Spec.ClassName != oldSP.Spec.ClassName {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "className"), "the class can't be changed"))
+		} else {
+			allErrs = append(allErrs, r.validateClass()...)
+		}
+	}
+	if r.Spec.PodImageName != oldSP.Spec.PodImageName || r.Spec.PodImageTag != oldSP.Spec.PodImageTag {
+		allErrs = append(allErrs, r.validateImageAllowed()...)
+	}
+	active := oldSP.Status.Status != nil && *oldSP.Status.Status == SPActive
+	if active && podSpecChanged(&r.Spec, &oldSP.Spec) {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("spec"), "the pod's image, port, resources and security context can't change while the ScalablePod is Active"))
+	}
+	allErrs = append(allErrs, r.validateStatus()...)
+
+	statusPath := field.NewPath("status")
+	if oldSP.Status.Requested && oldSP.Status.ClaimID != "" && r.Status.Requested && r.Status.ClaimID != "" {
+		if r.Status.ClaimID != oldSP.Status.ClaimID {
+			allErrs = append(allErrs, field.Forbidden(statusPath.Child("claimID"), "the ScalablePod must be released before it is claimed again"))
+		} else if r.Status.ClaimedBy != oldSP.Status.ClaimedBy {
+			allErrs = append(allErrs, field.Forbidden(statusPath.Child("claimedBy"), "the claimant can't change while the claim is held"))
+		}
+	}
+	if active && r.Status.BoundPod != nil && oldSP.Status.BoundPod != nil && *r.Status.BoundPod != *oldSP.Status.BoundPod {
+		allErrs = append(allErrs, field.Forbidden(statusPath.Child("boundPod"), "an Active ScalablePod can't be bound to another pod"))
+	}
+	return r.invalid(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ScalablePod) ValidateDelete() error {
+	return nil
+}
+
+// validateSpec checks what the schema can't: that the ScalablePod can expire and that its pod can be created.
+func (r *ScalablePod) validateSpec() field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	if r.Spec.MaxActiveTimeSec <= 0 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("maxActiveTimeSec"), r.Spec.MaxActiveTimeSec, "must be greater than 0"))
+	}
+	if r.Spec.PodImageName == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("podImageName"), ""))
+	} else if !imageNamePattern.MatchString(r.Spec.PodImageName) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("podImageName"), r.Spec.PodImageName, "must be an image name, without a tag or digest"))
+	}
+	if r.Spec.PodImageTag == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("podImageTag"), ""))
+	} else if !imageTagPattern.MatchString(r.Spec.PodImageTag) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("podImageTag"), r.Spec.PodImageTag, "must be an image tag"))
+	}
+	if resources := r.Spec.Resources; resources != nil {
+		for name, request := range resources.Requests {
+			if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+				allErrs = append(allErrs, field.Invalid(specPath.Child("resources", "requests").Key(string(name)), request.String(),
+					fmt.Sprintf("must be less than or equal to the %s limit", name)))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateImageAllowed checks the image against the allowlist.
+func (r *ScalablePod) validateImageAllowed() field.ErrorList {
+	if len(allowedImages) == 0 || r.Spec.PodImageName == "" {
+		return nil
+	}
+	for _, pattern := range allowedImages {
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(r.Spec.PodImageName, prefix) {
+				return nil
+			}
+		} else if r.Spec.PodImageName == pattern {
+			return nil
+		}
+	}
+	return field.ErrorList{field.Forbidden(field.NewPath("spec", "podImageName"),
+		fmt.Sprintf("%s isn't one of the allowed images: %s", r.Spec.PodImageName, strings.Join(allowedImages, ", ")))}
+}
+
+// validateClass checks that the ScalablePod's class exists, is available in its namespace, and allows its
+// maxActiveTimeSec.
+func (r *ScalablePod) validateClass() field.ErrorList {
+	classPath := field.NewPath("spec", "className")
+	ctx, cancel := context.WithTimeout(context.Background(), classLookupTimeout)
+	defer cancel()
+	class, err := r.class(ctx)
+	if apierrors.IsNotFound(err) {
+		return field.ErrorList{field.NotFound(classPath, r.Spec.ClassName)}
+	}
+	if err != nil {
+		return field.ErrorList{field.InternalError(classPath, err)}
+	}
+	if class == nil {
+		return nil
+	}
+	var allErrs field.ErrorList
+	if !class.AllowsNamespace(r.Namespace) {
+		allErrs = append(allErrs, field.Forbidden(classPath, fmt.Sprintf("ScalablePodClass %s isn't available in namespace %s", class.Name, r.Namespace)))
+	}
+	if ttl := r.Spec.MaxActiveTimeSec; ttl > 0 {
+		ttlPath := field.NewPath("spec", "maxActiveTimeSec")
+		if limited := class.ActiveTimeSec(ttl); limited > ttl {
+			allErrs = append(allErrs, field.Invalid(ttlPath, ttl, fmt.Sprintf("must be at least %d for ScalablePodClass %s", limited, class.Name)))
+		} else if limited < ttl {
+			allErrs = append(allErrs, field.Invalid(ttlPath, ttl, fmt.Sprintf("must be at most %d for ScalablePodClass %s", limited, class.Name)))
+		}
+	}
+	return allErrs
+}
+
+// validateStatus checks the status is one the operator understands.
+func (r *ScalablePod) validateStatus() field.ErrorList {
+	if status := r.Status.Status; status != nil && *status != SPActive && *status != SPInactive {
+		return field.ErrorList{field.NotSupported(field.NewPath("status", "status"), *status, []string{string(SPActive), string(SPInactive)})}
+	}
+	return nil
+}
+
+// podSpecChanged reports whether the spec of the pod the ScalablePod starts changed.
+func podSpecChanged(spec, old *ScalablePodSpec) bool {
+	return spec.PodImageName != old.PodImageName || spec.PodImageTag != old.PodImageTag ||
+		!equality.Semantic.DeepEqual(spec.Port, old.Port) || !equality.Semantic.DeepEqual(spec.SecurityContext, old.SecurityContext) ||
+		!equality.Semantic.DeepEqual(resourcesOrEmpty(spec.Resources), resourcesOrEmpty(old.Resources))
+}
+
+func resourcesOrEmpty(resources *corev1.ResourceRequirements) corev1.ResourceRequirements {
+	if resources == nil {
+		return corev1.ResourceRequirements{}
+	}
+	return *resources
+}
+
+// invalid returns the errors as an Invalid error, or nil if there are none.
+func (r *ScalablePod) invalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "ScalablePod"}, r.Name, allErrs)
+}
@@ -0,0 +1,334 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func validScalablePod(name string) *ScalablePod {
+	return &ScalablePod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       ScalablePodSpec{MaxActiveTimeSec: 600, PodImageName: "busybox", PodImageTag: "latest"},
+	}
+}
+
+func statusOf(status SPStatus) *SPStatus {
+	return &status
+}
+
+var _ = Describe("ScalablePod webhook", func() {
+	It("rejects ScalablePods that can't expire or have no image", func() {
+		sp := validScalablePod("invalid")
+		sp.Spec.MaxActiveTimeSec = -1
+		sp.Spec.PodImageName = ""
+		err := k8sClient.Create(ctx, sp)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue(), "expected the ScalablePod to be invalid, got %v", err)
+		Expect(err.Error()).To(ContainSubstring("spec.maxActiveTimeSec"))
+		Expect(err.Error()).To(ContainSubstring("spec.podImageName"))
+	})
+
+	It("fills in defaults on new ScalablePods", func() {
+		sp := validScalablePod("defaulted")
+		sp.Spec.MaxActiveTimeSec = 0
+		sp.Spec.PodImageTag = ""
+		Expect(k8sClient.Create(ctx, sp)).To(Succeed())
+		Expect(sp.Spec.PodImageTag).To(Equal("latest"))
+		Expect(sp.Spec.MaxActiveTimeSec).To(Equal(int32(3600)))
+	})
+
+	It("keeps a ScalablePod's pod from changing while it is Active", func() {
+		sp := validScalablePod("active")
+		Expect(k8sClient.Create(ctx, sp)).To(Succeed())
+		sp.Status.Status = statusOf(SPActive)
+		sp.Status.Requested = true
+		sp.Status.ClaimID = "claim-1"
+		Expect(k8sClient.Status().Update(ctx, sp)).To(Succeed())
+
+		sp.Spec.PodImageTag = "1.34"
+		Expect(apierrors.IsInvalid(k8sClient.Update(ctx, sp))).To(BeTrue())
+
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(sp), sp)).To(Succeed())
+		sp.Spec.MaxActiveTimeSec = 1200
+		Expect(k8sClient.Update(ctx, sp)).To(Succeed())
+	})
+
+	It("keeps a claim from being taken over through the status", func() {
+		sp := validScalablePod("claimed")
+		Expect(k8sClient.Create(ctx, sp)).To(Succeed())
+		sp.Status.Status = statusOf(SPInactive)
+		sp.Status.Requested = true
+		sp.Status.ClaimID = "claim-1"
+		sp.Status.ClaimedBy = "alice"
+		Expect(k8sClient.Status().Update(ctx, sp)).To(Succeed())
+
+		sp.Status.ClaimID = "claim-2"
+		sp.Status.ClaimedBy = "bob"
+		Expect(apierrors.IsInvalid(k8sClient.Status().Update(ctx, sp))).To(BeTrue())
+	})
+})
+
+func TestDefault(t *testing.T) {
+	defer SetDefaults(ScalablePodDefaults{})
+	runAsNonRoot := true
+	SetDefaults(ScalablePodDefaults{
+		MaxActiveTimeSec: 600,
+		Resources: &corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m"), corev1.ResourceMemory: resource.MustParse("64Mi")},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")},
+		},
+		SecurityContext: &corev1.SecurityContext{RunAsNonRoot: &runAsNonRoot},
+		Labels:          map[string]string{"team": "platform", "tier": "batch"},
+	})
+
+	sp := &ScalablePod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sp1", Labels: map[string]string{"tier": "web"}},
+		Spec: ScalablePodSpec{PodImageName: "busybox", Resources: &corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+		}},
+	}
+	sp.Default()
+	if sp.Spec.PodImageTag != "latest" || sp.Spec.MaxActiveTimeSec != 600 {
+		t.Errorf("expected the built-in tag and the operator's TTL, got %+v", sp.Spec)
+	}
+	resources := sp.Spec.Resources
+	if _, ok := resources.Requests[corev1.ResourceCPU]; ok {
+		t.Errorf("expected the CPU limit to stand for the request, got %v", resources.Requests)
+	}
+	if memory := resources.Requests[corev1.ResourceMemory]; memory.String() != "64Mi" {
+		t.Errorf("expected the default memory request, got %v", resources.Requests)
+	}
+	if cpu, memory := resources.Limits[corev1.ResourceCPU], resources.Limits[corev1.ResourceMemory]; cpu.String() != "100m" || memory.String() != "128Mi" {
+		t.Errorf("expected the ScalablePod's CPU limit and the default memory limit, got %v", resources.Limits)
+	}
+	if sp.Spec.SecurityContext == nil || !*sp.Spec.SecurityContext.RunAsNonRoot {
+		t.Errorf("expected the default security context, got %+v", sp.Spec.SecurityContext)
+	}
+	if sp.Labels["team"] != "platform" || sp.Labels["tier"] != "web" {
+		t.Errorf("expected the default labels the ScalablePod doesn't have, got %v", sp.Labels)
+	}
+	if err := sp.ValidateCreate(); err != nil {
+		t.Errorf("expected the defaulted ScalablePod to be valid, got %v", err)
+	}
+
+	// What the ScalablePod sets is kept
+	sp = validScalablePod("sp2")
+	sp.Spec.SecurityContext = &corev1.SecurityContext{}
+	sp.Default()
+	if sp.Spec.PodImageTag != "latest" || sp.Spec.MaxActiveTimeSec != 600 || sp.Spec.SecurityContext.RunAsNonRoot != nil {
+		t.Errorf("expected the ScalablePod's own values to be kept, got %+v", sp.Spec)
+	}
+}
+
+// useClasses has the webhooks read ScalablePodClasses from a fake client holding the classes, until the returned
+// function is called.
+func useClasses(t *testing.T, classes ...*ScalablePodClass) func() {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	objs := make([]runtime.Object, 0, len(classes))
+	for _, class := range classes {
+		objs = append(objs, class)
+	}
+	classReader = fake.NewFakeClientWithScheme(scheme, objs...)
+	return func() { classReader = nil }
+}
+
+func TestDefaultClass(t *testing.T) {
+	port := int32(80)
+	web := &ScalablePodClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Annotations: map[string]string{DefaultClassAnnotation: "true"}},
+		Spec: ScalablePodClassSpec{Defaults: ScalablePodClassDefaults{
+			PodImageName: "nginx",
+			Port:         &port,
+			ScalablePodDefaults: ScalablePodDefaults{
+				PodImageTag:      "1.21",
+				MaxActiveTimeSec: 300,
+				Labels:           map[string]string{"team": "web"},
+			},
+		}},
+	}
+	batch := &ScalablePodClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "batch"},
+		Spec: ScalablePodClassSpec{Defaults: ScalablePodClassDefaults{
+			PodImageName:        "busybox",
+			ScalablePodDefaults: ScalablePodDefaults{PodImageTag: "1.34"},
+		}},
+	}
+	defer useClasses(t, web, batch)()
+
+	sp := &ScalablePod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sp1"}}
+	sp.Default()
+	if sp.Spec.ClassName != "web" || sp.Spec.PodImageName != "nginx" || sp.Spec.PodImageTag != "1.21" || sp.Spec.Port == nil ||
+		sp.Spec.MaxActiveTimeSec != 300 || sp.Labels["team"] != "web" {
+		t.Errorf("expected the default class's defaults, got %+v, %v", sp.Spec, sp.Labels)
+	}
+
+	// A class's tag isn't used with another image, which gets the built-in default instead
+	sp = &ScalablePod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sp2"}, Spec: ScalablePodSpec{ClassName: "batch", PodImageName: "alpine"}}
+	sp.Default()
+	if sp.Spec.PodImageName != "alpine" || sp.Spec.PodImageTag != "latest" || sp.Spec.MaxActiveTimeSec != 3600 {
+		t.Errorf("expected the ScalablePod's own image with the built-in tag, got %+v", sp.Spec)
+	}
+
+	// Without a default class, nothing is filled in from one
+	defer useClasses(t, batch)()
+	sp = validScalablePod("sp3")
+	sp.Default()
+	if sp.Spec.ClassName != "" {
+		t.Errorf("expected no class, got %s", sp.Spec.ClassName)
+	}
+}
+
+func TestValidateClass(t *testing.T) {
+	defer useClasses(t, &ScalablePodClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: ScalablePodClassSpec{
+			ActiveTimeLimits:  &ActiveTimeLimits{MinSec: 60, MaxSec: 3600},
+			AllowedNamespaces: []string{"default"},
+		},
+	})()
+	for _, test := range []struct {
+		name    string
+		change  func(*ScalablePod)
+		invalid []string
+	}{
+		{"allowed", func(sp *ScalablePod) {}, nil},
+		{"missing class", func(sp *ScalablePod) { sp.Spec.ClassName = "batch" }, []string{"spec.className"}},
+		{"namespace not allowed", func(sp *ScalablePod) { sp.Namespace = "team-b" }, []string{"spec.className"}},
+		{"TTL too short", func(sp *ScalablePod) { sp.Spec.MaxActiveTimeSec = 30 }, []string{"spec.maxActiveTimeSec"}},
+		{"TTL too long", func(sp *ScalablePod) { sp.Spec.MaxActiveTimeSec = 7200 }, []string{"spec.maxActiveTimeSec"}},
+	} {
+		sp := validScalablePod("sp1")
+		sp.Spec.ClassName = "web"
+		test.change(sp)
+		expectInvalid(t, test.name, sp.ValidateCreate(), test.invalid)
+	}
+
+	old := validScalablePod("sp1")
+	old.Spec.ClassName = "web"
+	sp := old.DeepCopy()
+	sp.Spec.ClassName = ""
+	expectInvalid(t, "class changed", sp.ValidateUpdate(old), []string{"spec.className"})
+	sp = old.DeepCopy()
+	sp.Spec.MaxActiveTimeSec = 7200
+	expectInvalid(t, "TTL over the class's limit", sp.ValidateUpdate(old), []string{"spec.maxActiveTimeSec"})
+}
+
+func TestValidateCreate(t *testing.T) {
+	defer SetAllowedImages(nil)
+	for _, test := range []struct {
+		name    string
+		change  func(*ScalablePod)
+		allowed []string
+		invalid []string
+	}{
+		{"valid", func(sp *ScalablePod) {}, nil, nil},
+		{"no TTL", func(sp *ScalablePod) { sp.Spec.MaxActiveTimeSec = 0 }, nil, []string{"spec.maxActiveTimeSec"}},
+		{"no image", func(sp *ScalablePod) { sp.Spec.PodImageName, sp.Spec.PodImageTag = "", "" }, nil, []string{"spec.podImageName", "spec.podImageTag"}},
+		{"tag in the name", func(sp *ScalablePod) { sp.Spec.PodImageName = "busybox:latest" }, nil, []string{"spec.podImageName"}},
+		{"registry", func(sp *ScalablePod) { sp.Spec.PodImageName = "registry.example.com:5000/team-a/web" }, nil, nil},
+		{"bad tag", func(sp *ScalablePod) { sp.Spec.PodImageTag = "-latest" }, nil, []string{"spec.podImageTag"}},
+		{"request over limit", func(sp *ScalablePod) {
+			sp.Spec.Resources = &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("2")},
+				Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+			}
+		}, nil, []string{"spec.resources.requests[cpu]"}},
+		{"unknown status", func(sp *ScalablePod) { sp.Status.Status = statusOf("Pending") }, nil, []string{"status.status"}},
+		{"allowed image", func(sp *ScalablePod) {}, []string{"nginx", "busybox"}, nil},
+		{"allowed prefix", func(sp *ScalablePod) { sp.Spec.PodImageName = "registry.example.com/team-a/web" }, []string{"registry.example.com/team-a/*"}, nil},
+		{"image not allowed", func(sp *ScalablePod) { sp.Spec.PodImageName = "registry.example.com/team-b/web" }, []string{"busybox", "registry.example.com/team-a/*"}, []string{"spec.podImageName"}},
+	} {
+		SetAllowedImages(test.allowed)
+		sp := validScalablePod("sp1")
+		test.change(sp)
+		expectInvalid(t, test.name, sp.ValidateCreate(), test.invalid)
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	defer SetAllowedImages(nil)
+	active := validScalablePod("sp1")
+	active.Status = ScalablePodStatus{Status: statusOf(SPActive), Requested: true, ClaimID: "claim-1", ClaimedBy: "alice",
+		BoundPod: &NamespacedName{Namespace: "default", Name: "pod-1"}}
+
+	for _, test := range []struct {
+		name    string
+		old     *ScalablePod
+		change  func(*ScalablePod)
+		invalid []string
+	}{
+		{"renewal", active, func(sp *ScalablePod) { sp.Status.LeaseRenewedAt = &metav1.Time{} }, nil},
+		{"TTL while active", active, func(sp *ScalablePod) { sp.Spec.MaxActiveTimeSec = 1200 }, nil},
+		{"image while active", active, func(sp *ScalablePod) { sp.Spec.PodImageTag = "1.34" }, []string{"spec"}},
+		{"resources while active", active, func(sp *ScalablePod) {
+			sp.Spec.Resources = &corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}}
+		}, []string{"spec"}},
+		{"image while inactive", validScalablePod("sp1"), func(sp *ScalablePod) { sp.Spec.PodImageTag = "1.34" }, nil},
+		{"release", active, func(sp *ScalablePod) {
+			sp.Status = ScalablePodStatus{Status: statusOf(SPInactive)}
+		}, nil},
+		{"claim taken over", active, func(sp *ScalablePod) { sp.Status.ClaimID, sp.Status.ClaimedBy = "claim-2", "bob" }, []string{"status.claimID"}},
+		{"claimant changed", active, func(sp *ScalablePod) { sp.Status.ClaimedBy = "bob" }, []string{"status.claimedBy"}},
+		{"rebound", active, func(sp *ScalablePod) { sp.Status.BoundPod = &NamespacedName{Namespace: "default", Name: "pod-2"} }, []string{"status.boundPod"}},
+	} {
+		sp := test.old.DeepCopy()
+		test.change(sp)
+		expectInvalid(t, test.name, sp.ValidateUpdate(test.old), test.invalid)
+	}
+
+	// ScalablePods from before a rule was added can still have their status updated
+	SetAllowedImages([]string{"nginx"})
+	old := active.DeepCopy()
+	old.Spec.MaxActiveTimeSec = 0
+	updated := old.DeepCopy()
+	updated.Status.LeaseRenewedAt = &metav1.Time{}
+	expectInvalid(t, "status of an old ScalablePod", updated.ValidateUpdate(old), nil)
+}
+
+// expectInvalid checks that err is an Invalid error naming each of the fields, or nil if there are none.
+func expectInvalid(t *testing.T, name string, err error, fields []string) {
+	t.Helper()
+	if len(fields) == 0 {
+		if err != nil {
+			t.Errorf("%s: expected the ScalablePod to be valid, got %v", name, err)
+		}
+		return
+	}
+	if !apierrors.IsInvalid(err) {
+		t.Errorf("%s: expected the ScalablePod to be invalid, got %v", name, err)
+		return
+	}
+	for _, field := range fields {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("%s: expected %s to be invalid, got %v", name, field, err)
+		}
+	}
+}
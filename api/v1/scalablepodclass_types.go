@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DefaultClassAnnotation marks, with "true", the ScalablePodClass given to new ScalablePods that don't name one, as
+// with StorageClasses.
+const DefaultClassAnnotation = "scalable.scalablepod.tutorial.io/is-default-class"
+
+// ScalablePodClassSpec defines the defaults and policy shared by the ScalablePods of a class
+type ScalablePodClassSpec struct {
+	// Spec fields filled in on the class's ScalablePods that don't set them
+	// +optional
+	Defaults ScalablePodClassDefaults `json:"defaults,omitempty"`
+
+	// Bounds on the maxActiveTimeSec of the class's ScalablePods
+	// +optional
+	ActiveTimeLimits *ActiveTimeLimits `json:"activeTimeLimits,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+
+	// How long a warm ScalablePod of the class may wait to be claimed before it is deactivated, so that its pool
+	// replaces it with a fresh pod. Warm ScalablePods wait indefinitely if unset.
+	IdleTimeoutSec *int32 `json:"idleTimeoutSec,omitempty"`
+
+	// Warm pool settings of ScalablePodPools that use the class, for what they don't set themselves
+	// +optional
+	WarmPool *ClassWarmPool `json:"warmPool,omitempty"`
+
+	// Namespaces whose ScalablePods may use the class. Any namespace may if it is empty.
+	// +optional
+	AllowedNamespaces []string `json:"allowedNamespaces,omitempty"`
+}
+
+/* ScalablePodClassDefaults are the ScalablePod spec fields a class fills in. They aren't a pod template: the operator
+ * still builds each pod itself, with a single container running the image, which runs `sleep 3600` unless a port is
+ * given.
+ */
+type ScalablePodClassDefaults struct {
+	// +optional
+	PodImageName string `json:"podImageName,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +optional
+	Port *int32 `json:"port,omitempty"`
+
+	ScalablePodDefaults `json:",inline"`
+}
+
+// ActiveTimeLimits bound the maxActiveTimeSec of a class's ScalablePods. The controller holds ScalablePods created
+// before a limit was set to it.
+type ActiveTimeLimits struct {
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinSec int32 `json:"minSec,omitempty"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxSec int32 `json:"maxSec,omitempty"`
+}
+
+// ClassWarmPool is the capacity of the pools using a class.
+type ClassWarmPool struct {
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Number of ScalablePods to keep warm when no schedule is open
+	MinWarm int32 `json:"minWarm,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Maximum number of ScalablePods that may be active when no schedule is open
+	MaxActive *int32 `json:"maxActive,omitempty"`
+}
+
+// ScalablePodClass is the Schema for the scalablepodclasses API
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster,shortName=spc
+// +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.spec.defaults.podImageName`
+// +kubebuilder:printcolumn:name="Idle Timeout Sec",type=integer,JSONPath=`.spec.idleTimeoutSec`
+// +kubebuilder:printcolumn:name="Default",type=string,JSONPath=`.metadata.annotations.scalable\.scalablepod\.tutorial\.io/is-default-class`
+type ScalablePodClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ScalablePodClassSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ScalablePodClassList contains a list of ScalablePodClass
+type ScalablePodClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ScalablePodClass `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ScalablePodClass{}, &ScalablePodClassList{})
+}
+
+// AllowsNamespace reports whether ScalablePods in the namespace may use the class.
+func (c *ScalablePodClass) AllowsNamespace(namespace string) bool {
+	if len(c.Spec.AllowedNamespaces) == 0 {
+		return true
+	}
+	for _, allowed := range c.Spec.AllowedNamespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveTimeSec returns the maxActiveTimeSec the class's ScalablePods run for when they ask for maxActiveTimeSec,
+// held within the class's limits.
+func (c *ScalablePodClass) ActiveTimeSec(maxActiveTimeSec int32) int32 {
+	limits := c.Spec.ActiveTimeLimits
+	if limits == nil {
+		return maxActiveTimeSec
+	}
+	if limits.MinSec > 0 && maxActiveTimeSec < limits.MinSec {
+		return limits.MinSec
+	}
+	if limits.MaxSec > 0 && maxActiveTimeSec > limits.MaxSec {
+		return limits.MaxSec
+	}
+	return maxActiveTimeSec
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PoolLabel places a ScalablePod in the ScalablePodPool of the same name in its namespace.
+const PoolLabel = "scalable.scalablepod.tutorial.io/pool"
+
+// CapacitySchedule is a recurring window during which a ScalablePodPool's capacity is overridden.
+// The window opens on each firing of Start and closes on the next firing of End.
+type CapacitySchedule struct {
+	// Name of the schedule, reported in status while the window is open
+	Name string `json:"name"`
+
+	// Cron expression (5 fields) marking the start of the window
+	Start string `json:"start"`
+
+	// Cron expression (5 fields) marking the end of the window
+	End string `json:"end"`
+
+	// IANA time zone the cron expressions are evaluated in, e.g. `Europe/London`. Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Number of ScalablePods to keep warm while the window is open
+	MinWarm *int32 `json:"minWarm,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Maximum number of ScalablePods that may be active while the window is open
+	MaxActive *int32 `json:"maxActive,omitempty"`
+}
+
+// ScalablePodPoolSpec defines the desired state of ScalablePodPool
+type ScalablePodPoolSpec struct {
+	// ScalablePodClass whose warm pool settings the pool uses for minWarm and maxActive when it doesn't set them
+	// +optional
+	ClassName string `json:"className,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Number of ScalablePods to keep warm when no schedule is open. Taken from the class if unset, or else 0.
+	MinWarm *int32 `json:"minWarm,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Maximum number of ScalablePods that may be active when no schedule is open. Unlimited if unset.
+	MaxActive *int32 `json:"maxActive,omitempty"`
+
+	// Windows overriding MinWarm and MaxActive. When several are open at once, the first one listed wins.
+	// +optional
+	Schedules []CapacitySchedule `json:"schedules,omitempty"`
+
+	// Pre-warm ScalablePods ahead of the demand predicted from the pool's request history.
+	// The warm minimum is raised to the prediction, but never above the cap.
+	// +optional
+	Prediction *PredictionSpec `json:"prediction,omitempty"`
+
+	// Limit how often each caller may claim a ScalablePod from the pool, on top of the request server's own limit.
+	// Requests are counted against the pool of the ScalablePod they would claim, however they picked it.
+	// +optional
+	RateLimit *RateLimitSpec `json:"rateLimit,omitempty"`
+}
+
+// RateLimitSpec is a token bucket each caller of the request server gets.
+type RateLimitSpec struct {
+	// +kubebuilder:validation:Minimum=1
+
+	// Requests each caller may make a minute, on average
+	RequestsPerMinute int32 `json:"requestsPerMinute"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+
+	// Requests each caller may make at once after being idle. Defaults to RequestsPerMinute.
+	Burst *int32 `json:"burst,omitempty"`
+}
+
+// PredictionSpec configures predictive pre-warming for a ScalablePodPool.
+type PredictionSpec struct {
+	// +kubebuilder:validation:Minimum=1
+
+	// How far ahead to pre-warm for. Enough ScalablePods are kept warm to serve the requests expected over this long.
+	LookaheadSec int32 `json:"lookaheadSec"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Upper bound on the number of ScalablePods kept warm because of the prediction
+	MaxWarm *int32 `json:"maxWarm,omitempty"`
+}
+
+// ScalablePodPoolStatus defines the observed state of ScalablePodPool
+type ScalablePodPoolStatus struct {
+	// Name of the schedule currently in effect, empty if none is open
+	ActiveSchedule string `json:"activeSchedule,omitempty"`
+
+	// Number of ScalablePods currently kept warm
+	MinWarm int32 `json:"minWarm"`
+
+	// Number of ScalablePods the request history says should be warm, if prediction is enabled
+	PredictedWarm *int32 `json:"predictedWarm,omitempty"`
+
+	// Maximum number of ScalablePods currently allowed to be active, unset if unlimited
+	MaxActive *int32 `json:"maxActive,omitempty"`
+
+	// Number of ScalablePods in the pool that are active or starting, including warm ones
+	Active int32 `json:"active"`
+
+	// Number of ScalablePods in the pool that are warm and waiting to be claimed
+	Warm int32 `json:"warm"`
+
+	// When the active schedule is next re-evaluated
+	NextTransition *metav1.Time `json:"nextTransition,omitempty"`
+
+	// Why the schedules could not be evaluated, if they could not
+	ScheduleError string `json:"scheduleError,omitempty"`
+}
+
+// ScalablePodPool is the Schema for the scalablepodpools API
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=spp
+// +kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.status.activeSchedule`
+// +kubebuilder:printcolumn:name="Min Warm",type=integer,JSONPath=`.status.minWarm`
+// +kubebuilder:printcolumn:name="Max Active",type=integer,JSONPath=`.status.maxActive`
+// +kubebuilder:printcolumn:name="Active",type=integer,JSONPath=`.status.active`
+// +kubebuilder:printcolumn:name="Warm",type=integer,JSONPath=`.status.warm`
+type ScalablePodPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ScalablePodPoolSpec   `json:"spec,omitempty"`
+	Status ScalablePodPoolStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ScalablePodPoolList contains a list of ScalablePodPool
+type ScalablePodPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ScalablePodPool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ScalablePodPool{}, &ScalablePodPoolList{})
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ScalablePodQuotaSpec defines the desired state of ScalablePodQuota
+type ScalablePodQuotaSpec struct {
+	// Callers the quota applies to, by the name the operator's request server authenticated them as, e.g.
+	// system:serviceaccount:<namespace>:<name>. The callers listed share the quota. It applies to all claims in the
+	// namespace if empty.
+	// +optional
+	Callers []string `json:"callers,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Maximum number of ScalablePods in the namespace the callers may have claimed at once. Unlimited if unset.
+	MaxActive *int32 `json:"maxActive,omitempty"`
+
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+
+	// Maximum total time, in seconds, the callers' claims in the namespace may be active each day. Unlimited if unset.
+	MaxActiveSecondsPerDay *int64 `json:"maxActiveSecondsPerDay,omitempty"`
+
+	// IANA time zone days start in, e.g. `Europe/London`. Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// ScalablePodQuotaStatus defines the observed state of ScalablePodQuota
+type ScalablePodQuotaStatus struct {
+	// Number of ScalablePods the callers have claimed
+	Active int32 `json:"active"`
+
+	// Seconds the callers' claims have been active today, including those still active
+	ActiveSecondsToday int64 `json:"activeSecondsToday"`
+
+	// Seconds the callers' claims that have since been released were active today
+	ReleasedSecondsToday int64 `json:"releasedSecondsToday"`
+
+	// Day the seconds are counted for, as YYYY-MM-DD in the quota's time zone
+	Day string `json:"day,omitempty"`
+
+	// Why new claims are refused, empty while the quota has room
+	Exceeded string `json:"exceeded,omitempty"`
+
+	// When the usage was last worked out
+	UpdatedAt *metav1.Time `json:"updatedAt,omitempty"`
+
+	// Why the time zone could not be loaded, if it could not. Days start in UTC until it is fixed.
+	TimeZoneError string `json:"timeZoneError,omitempty"`
+}
+
+// ScalablePodQuota is the Schema for the scalablepodquotas API
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:resource:shortName=spq
+// +kubebuilder:printcolumn:name="Active",type=integer,JSONPath=`.status.active`
+// +kubebuilder:printcolumn:name="Max Active",type=integer,JSONPath=`.spec.maxActive`
+// +kubebuilder:printcolumn:name="Seconds Today",type=integer,JSONPath=`.status.activeSecondsToday`
+// +kubebuilder:printcolumn:name="Max Seconds",type=integer,JSONPath=`.spec.maxActiveSecondsPerDay`
+// +kubebuilder:printcolumn:name="Exceeded",type=string,JSONPath=`.status.exceeded`
+type ScalablePodQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ScalablePodQuotaSpec   `json:"spec,omitempty"`
+	Status ScalablePodQuotaStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ScalablePodQuotaList contains a list of ScalablePodQuota
+type ScalablePodQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ScalablePodQuota `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ScalablePodQuota{}, &ScalablePodQuotaList{})
+}
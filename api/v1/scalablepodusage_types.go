@@ -0,0 +1,94 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// QuotaChargedAnnotation marks a ScalablePodUsage whose claim has been charged to the ScalablePodQuotas covering its
+// claimant.
+const QuotaChargedAnnotation = "scalable.scalablepod.tutorial.io/quota-charged"
+
+// ScalablePodUsageSpec records a ScalablePod's time Active, from when it was claimed, or started warm, until it was
+// deactivated. The time a warm ScalablePod waited before it was claimed isn't recorded.
+type ScalablePodUsageSpec struct {
+	// Name of the ScalablePod, in the record's namespace
+	ScalablePod string `json:"scalablePod"`
+
+	// ScalablePodPool the ScalablePod was in, if any
+	// +optional
+	Pool string `json:"pool,omitempty"`
+
+	// Who claimed the ScalablePod, as authenticated by the operator's request server. It is empty if the ScalablePod
+	// was warm and never claimed, or the request server doesn't authenticate callers.
+	// +optional
+	Claimant string `json:"claimant,omitempty"`
+
+	// +optional
+	ClaimID string `json:"claimID,omitempty"`
+
+	// The pod that was bound to the ScalablePod
+	// +optional
+	Pod *NamespacedName `json:"pod,omitempty"`
+
+	// Resources the pod's containers requested
+	// +optional
+	Requests corev1.ResourceList `json:"requests,omitempty"`
+
+	// When the usage started: when the ScalablePod was claimed, or when its pod started if it never was
+	StartedAt metav1.Time `json:"startedAt"`
+
+	// When the ScalablePod was deactivated
+	EndedAt metav1.Time `json:"endedAt"`
+
+	// Whole seconds from startedAt to endedAt
+	ActiveSeconds int64 `json:"activeSeconds"`
+
+	// Why the ScalablePod was deactivated: expired, released, preempted or idle
+	Reason string `json:"reason"`
+}
+
+// ScalablePodUsage is the Schema for the scalablepodusages API. Records are written by the operator and their spec
+// isn't changed after.
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:shortName=spu
+// +kubebuilder:printcolumn:name="ScalablePod",type=string,JSONPath=`.spec.scalablePod`
+// +kubebuilder:printcolumn:name="Claimant",type=string,JSONPath=`.spec.claimant`
+// +kubebuilder:printcolumn:name="Active Seconds",type=integer,JSONPath=`.spec.activeSeconds`
+// +kubebuilder:printcolumn:name="Reason",type=string,JSONPath=`.spec.reason`
+// +kubebuilder:printcolumn:name="Ended At",type=string,JSONPath=`.spec.endedAt`
+type ScalablePodUsage struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ScalablePodUsageSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ScalablePodUsageList contains a list of ScalablePodUsage
+type ScalablePodUsageList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ScalablePodUsage `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ScalablePodUsage{}, &ScalablePodUsageList{})
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/auth"
+)
+
+// Types of audit event
+const (
+	// A request for a ScalablePod arrived
+	TypeRequest = "request"
+	// A request was given a claim on a ScalablePod
+	TypeGrant = "grant"
+	// A request, or a renewal, was refused
+	TypeRejection = "rejection"
+	// A claim's lease was renewed
+	TypeRenewal = "renewal"
+	// A ScalablePod started a pod, for a claim or to be warm
+	TypeActivation = "activation"
+	// A ScalablePod was released before its TTL ran out, e.g. a surplus warm ScalablePod
+	TypeRelease = "release"
+	// A claimed ScalablePod's TTL ran out
+	TypeExpiry = "expiry"
+	// A ScalablePod's pod was deleted or evicted by someone else
+	TypePreemption = "preemption"
+)
+
+// Header carrying the request's ID, as set by the user-facing server
+const requestIDHeader = "X-Request-ID"
+
+// Most of a rejection's response body kept as its reason
+const maxReasonLength = 256
+
+// Event is an entry in the audit log.
+type Event struct {
+	Time time.Time `json:"time"`
+	// One of the Type constants
+	Type string `json:"type"`
+	// ID tying the events of a request together, and to its logs
+	RequestID string `json:"requestID,omitempty"`
+	// Who made the request, or holds the claim, as authenticated by the request server
+	Caller     string `json:"caller,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// The namespace, pool and selector a request asked for, or the namespace and pool of the ScalablePod
+	Namespace string `json:"namespace,omitempty"`
+	Pool      string `json:"pool,omitempty"`
+	Selector  string `json:"selector,omitempty"`
+	// Name of the ScalablePod, and namespace/name of its bound pod
+	ScalablePod string `json:"scalablePod,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	ClaimID     string `json:"claimID,omitempty"`
+	// When the claim was made, and when its pod became Ready
+	ClaimedAt *time.Time `json:"claimedAt,omitempty"`
+	ReadyAt   *time.Time `json:"readyAt,omitempty"`
+	// HTTP status code a rejection was answered with
+	Code   int    `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ForScalablePod returns an event of the type about the ScalablePod and its claim, as its status stands.
+func ForScalablePod(eventType string, sp *scalablev1.ScalablePod) Event {
+	event := Event{
+		Type:        eventType,
+		Caller:      sp.Status.ClaimedBy,
+		Namespace:   sp.Namespace,
+		Pool:        sp.Labels[scalablev1.PoolLabel],
+		ScalablePod: sp.Name,
+		ClaimID:     sp.Status.ClaimID,
+	}
+	if pod := sp.Status.BoundPod; pod != nil {
+		event.Pod = pod.Namespace + "/" + pod.Name
+	}
+	if at := sp.Status.RequestedAt; at != nil && sp.Status.ClaimID != "" {
+		claimedAt := at.Time
+		event.ClaimedAt = &claimedAt
+	}
+	if at := sp.Status.ReadyAt; at != nil {
+		readyAt := at.Time
+		event.ReadyAt = &readyAt
+	}
+	return event
+}
+
+// Sink is where audit events are written. Writes must be safe to make concurrently.
+type Sink interface {
+	Write(event *Event) error
+}
+
+// JSONLinesSink writes each event as a line of JSON.
+type JSONLinesSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{w: w}
+}
+
+func (s *JSONLinesSink) Write(event *Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+var (
+	writeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scalablepod_audit_write_failures_total",
+		Help: "Audit events that couldn't be written to the audit log",
+	})
+
+	sinkMu sync.RWMutex
+	sink   Sink
+)
+
+func init() {
+	metrics.Registry.MustRegister(writeFailures)
+}
+
+// SetSink sets where events are recorded. Events are dropped while it is nil.
+func SetSink(s Sink) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	sink = s
+}
+
+func currentSink() Sink {
+	sinkMu.RLock()
+	defer sinkMu.RUnlock()
+	return sink
+}
+
+// Record writes an event to the sink, timestamped now unless it has a time. An event that can't be written is logged
+// and counted, rather than failing what it records.
+func Record(event Event) {
+	s := currentSink()
+	if s == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if err := s.Write(&event); err != nil {
+		writeFailures.Inc()
+		ctrl.Log.WithName("audit").Error(err, "Unable to write audit event", "type", event.Type, "requestID", event.RequestID)
+	}
+}
+
+// responseRecorder keeps the status code and the start of the body of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	if room := maxReasonLength - r.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		r.body.Write(b[:room])
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+/* Handler records each request for a ScalablePod, with who made it and what it asked for, and records a rejection if
+ * it is answered with an error, with the start of the response as the reason. Grants are recorded by the handler that
+ * makes them, which knows the ScalablePod. A request without an X-Request-ID is given one, so that its events can be
+ * tied together.
+ */
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentSink() == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" {
+			requestID = uuid.New().String()
+			r.Header.Set(requestIDHeader, requestID)
+		}
+		query := r.URL.Query()
+		event := Event{
+			Type:       TypeRequest,
+			RequestID:  requestID,
+			Caller:     auth.Username(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+			Namespace:  query.Get("namespace"),
+			Pool:       query.Get("pool"),
+			Selector:   query.Get("selector"),
+		}
+		Record(event)
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.code >= http.StatusBadRequest {
+			event.Type = TypeRejection
+			event.Time = time.Time{}
+			event.Code = recorder.code
+			event.Reason = strings.TrimSpace(recorder.body.String())
+			if event.Reason == "" {
+				event.Reason = http.StatusText(recorder.code)
+			}
+			Record(event)
+		}
+	})
+}
+
+// Options configure the audit log.
+type Options struct {
+	// File to append events to, or - for stdout. Events aren't recorded if it is empty.
+	Path string
+}
+
+// BindFlags adds flags for the options to the flag set.
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Path, "audit-log", "", "Where to write the audit log of requests, claims and releases, as JSON lines: a file, which is appended to, or - for stdout. Nothing is audited if it is empty.")
+}
+
+// Sink opens the configured sink, returning it and a function that closes it, or nil if nothing is audited.
+func (o *Options) Sink() (Sink, func() error, error) {
+	switch o.Path {
+	case "":
+		return nil, func() error { return nil }, nil
+	case "-":
+		return NewJSONLinesSink(os.Stdout), func() error { return nil }, nil
+	}
+	file, err := os.OpenFile(o.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewJSONLinesSink(file), file.Close, nil
+}
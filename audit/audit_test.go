@@ -0,0 +1,150 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/auth"
+)
+
+// events reads back the JSON lines written to the buffer.
+func events(t *testing.T, buffer *bytes.Buffer) []Event {
+	var events []Event
+	scanner := bufio.NewScanner(buffer)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("expected a line of JSON, got %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+type failingSink struct{}
+
+func (failingSink) Write(event *Event) error { return errors.New("disk full") }
+
+func TestRecord(t *testing.T) {
+	defer SetSink(nil)
+	Record(Event{Type: TypeGrant})
+
+	var buffer bytes.Buffer
+	SetSink(NewJSONLinesSink(&buffer))
+	claimedAt := time.Date(2021, 9, 6, 14, 2, 0, 0, time.UTC)
+	sp := &scalablev1.ScalablePod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "scalablepod3", Labels: map[string]string{scalablev1.PoolLabel: "web"}},
+		Status: scalablev1.ScalablePodStatus{
+			ClaimID: "claim-1", ClaimedBy: "alice", RequestedAt: &metav1.Time{Time: claimedAt},
+			BoundPod: &scalablev1.NamespacedName{Namespace: "default", Name: "pod-1"},
+		},
+	}
+	Record(ForScalablePod(TypeExpiry, sp))
+
+	recorded := events(t, &buffer)
+	if len(recorded) != 1 {
+		t.Fatalf("expected only the event recorded with a sink, got %+v", recorded)
+	}
+	event := recorded[0]
+	if event.Type != TypeExpiry || event.Caller != "alice" || event.ScalablePod != "scalablepod3" || event.Pool != "web" ||
+		event.Pod != "default/pod-1" || event.ClaimID != "claim-1" || event.ClaimedAt == nil || !event.ClaimedAt.Equal(claimedAt) || event.Time.IsZero() {
+		t.Errorf("expected the claim's details, got %+v", event)
+	}
+
+	// A failing sink doesn't fail what it records
+	SetSink(failingSink{})
+	Record(Event{Type: TypeGrant})
+}
+
+func TestHandler(t *testing.T) {
+	defer SetSink(nil)
+	var buffer bytes.Buffer
+	SetSink(NewJSONLinesSink(&buffer))
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pool") == "full" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("All resources in use. Try again later.\n"))
+		}
+	}))
+	serve := func(target, requestID string) {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		req = req.WithContext(auth.NewContext(req.Context(), &auth.Identity{Username: "alice"}))
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("/request?namespace=default&pool=web", "req-1")
+	serve("/request?namespace=default&pool=full", "")
+
+	recorded := events(t, &buffer)
+	if len(recorded) != 3 {
+		t.Fatalf("expected two requests and a rejection, got %+v", recorded)
+	}
+	if event := recorded[0]; event.Type != TypeRequest || event.RequestID != "req-1" || event.Caller != "alice" || event.Pool != "web" {
+		t.Errorf("expected the request, got %+v", event)
+	}
+	request, rejection := recorded[1], recorded[2]
+	if request.RequestID == "" || rejection.RequestID != request.RequestID {
+		t.Errorf("expected the request to be given an ID shared by its events, got %q and %q", request.RequestID, rejection.RequestID)
+	}
+	if rejection.Type != TypeRejection || rejection.Code != http.StatusNotFound || rejection.Reason != "All resources in use. Try again later." || rejection.Caller != "alice" {
+		t.Errorf("expected the rejection, got %+v", rejection)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	if sink, _, err := (&Options{}).Sink(); err != nil || sink != nil {
+		t.Errorf("expected nothing to be audited by default, got %v, %v", sink, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte("{\"type\":\"grant\"}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sink, closeSink, err := (&Options{Path: path}).Sink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(&Event{Type: TypeRelease}); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeSink(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded := events(t, bytes.NewBuffer(content)); len(recorded) != 2 || recorded[1].Type != TypeRelease {
+		t.Errorf("expected the event to be appended to the log, got %q", content)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package auth authenticates callers of the operator's request server, by a Kubernetes service account token, a
+// request signed with a shared secret, or a TLS client certificate.
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Ways callers can authenticate
+const (
+	// A Kubernetes bearer token, such as a service account token, checked with a TokenReview
+	MethodTokenReview = "tokenreview"
+	// A request signed with a shared secret, in SignatureHeader
+	MethodHMAC = "hmac"
+	// A TLS client certificate signed by the client CA
+	MethodX509 = "mtls"
+)
+
+// Identity is who a caller authenticated as.
+type Identity struct {
+	// Name of the caller: system:serviceaccount:<namespace>:<name> for a service account, hmac:<key ID> for a signed
+	// request, and the common name of a client certificate
+	Username string
+	// Unique ID of the caller, if the authenticator knows one
+	UID string
+	// Groups the caller belongs to: those of the Kubernetes user, or the organizations of a client certificate
+	Groups []string
+	// Further information about a Kubernetes user, passed on to SubjectAccessReviews
+	Extra map[string][]string
+	// How the caller authenticated, one of the Method constants
+	Method string
+}
+
+/* Authenticator checks the credentials of a request. It returns nil and no error if the request carries none of the
+ * credentials it checks, so that the next authenticator can try, and an error if it carries credentials that are
+ * invalid.
+ */
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type identityKey struct{}
+
+// NewContext returns a context carrying the caller's identity.
+func NewContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity of the caller the context belongs to, if it was authenticated.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// Username returns the name of the caller the context belongs to, or "" if it wasn't authenticated.
+func Username(ctx context.Context) string {
+	if identity, ok := FromContext(ctx); ok {
+		return identity.Username
+	}
+	return ""
+}
+
+/* Handler authenticates each request with the first of the authenticators that finds credentials it checks, and
+ * passes it on with the caller's identity in its context. Requests without valid credentials get 401 Unauthorized.
+ * With no authenticators every request is passed on, unauthenticated.
+ */
+func Handler(authenticators []Authenticator, next http.Handler) http.Handler {
+	if len(authenticators) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := ctrl.Log.WithName("auth").WithValues("path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+		for _, authenticator := range authenticators {
+			identity, err := authenticator.Authenticate(r)
+			if err != nil {
+				log.Info("Authentication failed", "error", err.Error())
+				unauthorized(w, "Invalid credentials")
+				return
+			}
+			if identity != nil {
+				next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), identity)))
+				return
+			}
+		}
+		log.V(1).Info("Request has no credentials")
+		unauthorized(w, "Authentication required")
+	})
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="scalablepod-operator"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(message + "\n"))
+}
+
+// Options configure how the request server authenticates callers and serves TLS.
+type Options struct {
+	// Comma-separated Method constants, tried in order. Callers aren't authenticated if it is empty.
+	Methods string
+	// Comma-separated audiences service account tokens must be issued for. The API server's are used if it is empty.
+	TokenAudiences string
+	// Directory holding the shared secrets requests are signed with, one file for each, named by its key ID
+	HMACKeysDir string
+	// Certificate and key to serve HTTPS with
+	TLSCertFile string
+	TLSKeyFile  string
+	// CA certificates that sign client certificates
+	ClientCAFile string
+	// Check with a SubjectAccessReview that callers may request the ScalablePods they are given
+	Authorize bool
+}
+
+// BindFlags adds flags for the options to the flag set.
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Methods, "request-auth", "", "Comma-separated ways callers of the HTTP request server may authenticate, tried in order: tokenreview, hmac and mtls. Callers aren't authenticated if it is empty.")
+	fs.StringVar(&o.TokenAudiences, "request-token-audiences", "", "Comma-separated audiences service account tokens must be issued for. Defaults to the API server's.")
+	fs.StringVar(&o.HMACKeysDir, "request-hmac-keys-dir", "", "The directory holding the shared secrets requests are signed with, one file for each, named by its key ID.")
+	fs.StringVar(&o.TLSCertFile, "request-tls-cert-file", "", "The certificate the HTTP request server serves HTTPS with. It serves plain HTTP if empty.")
+	fs.StringVar(&o.TLSKeyFile, "request-tls-key-file", "", "The key of the HTTP request server's certificate.")
+	fs.StringVar(&o.ClientCAFile, "request-client-ca-file", "", "The CA certificates that sign the client certificates of callers authenticating with mtls.")
+	fs.BoolVar(&o.Authorize, "request-authorize", false, "Only give callers of the HTTP request server ScalablePods from pools they have the request verb on, checked with SubjectAccessReviews.")
+}
+
+// Authenticators returns the authenticators for the configured methods, in order. The client creates TokenReviews.
+func (o *Options) Authenticators(c client.Client) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	for _, method := range splitList(o.Methods) {
+		switch method {
+		case MethodTokenReview:
+			authenticators = append(authenticators, &TokenReviewAuthenticator{Client: c, Audiences: splitList(o.TokenAudiences), Clock: clock.RealClock{}})
+		case MethodHMAC:
+			if o.HMACKeysDir == "" {
+				return nil, errors.New("hmac authentication needs --request-hmac-keys-dir")
+			}
+			keys, err := LoadKeys(o.HMACKeysDir)
+			if err != nil {
+				return nil, err
+			}
+			authenticators = append(authenticators, &HMACAuthenticator{Keys: keys, Clock: clock.RealClock{}})
+		case MethodX509:
+			if o.TLSCertFile == "" || o.ClientCAFile == "" {
+				return nil, errors.New("mtls authentication needs --request-tls-cert-file and --request-client-ca-file")
+			}
+			authenticators = append(authenticators, &X509Authenticator{})
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	return authenticators, nil
+}
+
+// Authorizer returns the authorizer callers are checked with, or nil if they aren't. The client creates
+// SubjectAccessReviews.
+func (o *Options) Authorizer(c client.Client) (Authorizer, error) {
+	if !o.Authorize {
+		return nil, nil
+	}
+	if len(splitList(o.Methods)) == 0 {
+		return nil, errors.New("--request-authorize needs callers to be authenticated with --request-auth")
+	}
+	return &SubjectAccessReviewAuthorizer{Client: c, Clock: clock.RealClock{}}, nil
+}
+
+// TLSConfig returns the request server's TLS configuration, or nil if it serves plain HTTP. Client certificates are
+// verified if they are given, but not required, so that callers can authenticate in other ways.
+func (o *Options) TLSConfig() (*tls.Config, error) {
+	if o.TLSCertFile == "" {
+		if o.ClientCAFile != "" {
+			return nil, errors.New("--request-client-ca-file needs --request-tls-cert-file")
+		}
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if o.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", o.ClientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// tokenReviewer answers TokenReviews for the tokens it knows, and counts them.
+type tokenReviewer struct {
+	client.Client
+	users   map[string]authenticationv1.UserInfo
+	reviews int
+}
+
+func (c *tokenReviewer) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.reviews++
+	review := obj.(*authenticationv1.TokenReview)
+	user, ok := c.users[review.Spec.Token]
+	review.Status = authenticationv1.TokenReviewStatus{Authenticated: ok, User: user}
+	return nil
+}
+
+// serve sends the request through Handler, and returns the response code and the caller the handler saw.
+func serve(authenticators []Authenticator, req *http.Request) (int, *Identity) {
+	var caller *Identity
+	handler := Handler(authenticators, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ = FromContext(r.Context())
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code, caller
+}
+
+func TestHandler(t *testing.T) {
+	reviewer := &tokenReviewer{users: map[string]authenticationv1.UserInfo{
+		"sa-token": {Username: "system:serviceaccount:default:user-facing-server", Groups: []string{"system:serviceaccounts"}},
+	}}
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	authenticators := []Authenticator{
+		&TokenReviewAuthenticator{Client: reviewer, Clock: fakeClock},
+		&HMACAuthenticator{Keys: map[string][]byte{"k1": []byte("secret")}, Clock: fakeClock},
+		&X509Authenticator{},
+	}
+
+	if code, _ := serve(nil, httptest.NewRequest(http.MethodPost, "/request", nil)); code != http.StatusOK {
+		t.Errorf("expected requests to pass without authenticators, got %d", code)
+	}
+	if code, _ := serve(authenticators, httptest.NewRequest(http.MethodPost, "/request", nil)); code != http.StatusUnauthorized {
+		t.Errorf("expected a request without credentials to be refused, got %d", code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/request", nil)
+	req.Header.Set("Authorization", "Bearer sa-token")
+	code, caller := serve(authenticators, req)
+	if code != http.StatusOK || caller == nil || caller.Username != "system:serviceaccount:default:user-facing-server" || caller.Method != MethodTokenReview {
+		t.Errorf("expected the service account to be authenticated, got %d %+v", code, caller)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/request", nil)
+	req.Header.Set("Authorization", "Bearer stolen")
+	if code, _ := serve(authenticators, req); code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown token to be refused, got %d", code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/request?pool=web", strings.NewReader("Request"))
+	Sign(req, []byte("Request"), "k1", []byte("secret"), now.Add(-time.Minute))
+	code, caller = serve(authenticators, req)
+	if code != http.StatusOK || caller == nil || caller.Username != "hmac:k1" {
+		t.Errorf("expected the signed request to be authenticated, got %d %+v", code, caller)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/claims/abc", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "gateway", Organization: []string{"edge"}}}}}}
+	code, caller = serve(authenticators, req)
+	if code != http.StatusOK || caller == nil || caller.Username != "gateway" || caller.Groups[0] != "edge" || caller.Method != MethodX509 {
+		t.Errorf("expected the client certificate to be authenticated, got %d %+v", code, caller)
+	}
+}
+
+func TestTokenReviewCache(t *testing.T) {
+	reviewer := &tokenReviewer{users: map[string]authenticationv1.UserInfo{"sa-token": {Username: "sa"}}}
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	authenticator := &TokenReviewAuthenticator{Client: reviewer, CacheTTL: time.Minute, Clock: fakeClock}
+	authenticate := func(token string) (*Identity, error) {
+		req := httptest.NewRequest(http.MethodGet, "/claims/abc", nil)
+		req.Header.Set("Authorization", "bearer "+token)
+		return authenticator.Authenticate(req)
+	}
+
+	for i := 0; i < 3; i++ {
+		if identity, err := authenticate("sa-token"); err != nil || identity.Username != "sa" {
+			t.Fatalf("expected the token to be authenticated, got %+v, %v", identity, err)
+		}
+		if _, err := authenticate("stolen"); err == nil {
+			t.Fatal("expected an unknown token to be refused")
+		}
+	}
+	if reviewer.reviews != 2 {
+		t.Errorf("expected each token to be reviewed once, got %d reviews", reviewer.reviews)
+	}
+	now = now.Add(2 * time.Minute)
+	fakeClock.SetTime(now)
+	authenticate("sa-token")
+	if reviewer.reviews != 3 {
+		t.Errorf("expected the token to be reviewed again once its result expired, got %d reviews", reviewer.reviews)
+	}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	authenticator := &HMACAuthenticator{Keys: map[string][]byte{"k1": []byte("secret"), "k2": []byte("next")}, Clock: fakeClock}
+	signed := func(method, target, body, keyID, key string, at time.Time) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		Sign(req, []byte(body), keyID, []byte(key), at)
+		return req
+	}
+
+	req := signed(http.MethodPost, "/request?pool=web", "Request", "k2", "next", now)
+	if identity, err := authenticator.Authenticate(req); err != nil || identity.Username != "hmac:k2" {
+		t.Errorf("expected the request to be authenticated with the second key, got %+v, %v", identity, err)
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != "Request" {
+		t.Errorf("expected the body to be left for the handler, got %q", body)
+	}
+	if identity, err := authenticator.Authenticate(httptest.NewRequest(http.MethodPost, "/request", nil)); identity != nil || err != nil {
+		t.Errorf("expected an unsigned request to be left to other authenticators, got %+v, %v", identity, err)
+	}
+
+	for name, req := range map[string]*http.Request{
+		"unknown key":   signed(http.MethodPost, "/request", "Request", "k3", "secret", now),
+		"wrong secret":  signed(http.MethodPost, "/request", "Request", "k1", "guess", now),
+		"stale":         signed(http.MethodPost, "/request", "Request", "k1", "secret", now.Add(-10*time.Minute)),
+		"future":        signed(http.MethodPost, "/request", "Request", "k1", "secret", now.Add(10*time.Minute)),
+		"changed query": signed(http.MethodPost, "/request?pool=web", "Request", "k1", "secret", now),
+		"changed body":  signed(http.MethodPost, "/request", "Request", "k1", "secret", now),
+	} {
+		switch name {
+		case "changed query":
+			req.URL.RawQuery = "pool=admin"
+		case "changed body":
+			req.Body = ioutil.NopCloser(strings.NewReader("Other"))
+		}
+		if _, err := authenticator.Authenticate(req); err == nil {
+			t.Errorf("expected the request with a %s to be refused", name)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	dir := t.TempDir()
+	keysDir := filepath.Join(dir, "keys")
+	os.Mkdir(keysDir, 0700)
+	ioutil.WriteFile(filepath.Join(keysDir, "k1"), []byte("secret\n"), 0600)
+	ioutil.WriteFile(filepath.Join(keysDir, ".hidden"), []byte("ignored"), 0600)
+
+	authenticators, err := (&Options{Methods: "tokenreview, hmac", HMACKeysDir: keysDir}).Authenticators(&tokenReviewer{})
+	if err != nil || len(authenticators) != 2 {
+		t.Fatalf("expected two authenticators, got %d, %v", len(authenticators), err)
+	}
+	if keys := authenticators[1].(*HMACAuthenticator).Keys; len(keys) != 1 || string(keys["k1"]) != "secret" {
+		t.Errorf("expected the one visible key, trimmed, got %q", keys)
+	}
+	for _, o := range []Options{
+		{Methods: "password"},
+		{Methods: "hmac"},
+		{Methods: "hmac", HMACKeysDir: dir},
+		{Methods: "mtls"},
+	} {
+		if _, err := o.Authenticators(&tokenReviewer{}); err == nil {
+			t.Errorf("expected %+v to be refused", o)
+		}
+	}
+	if config, err := (&Options{}).TLSConfig(); config != nil || err != nil {
+		t.Errorf("expected plain HTTP without a certificate, got %v, %v", config, err)
+	}
+	if _, err := (&Options{ClientCAFile: "ca.crt"}).TLSConfig(); err == nil {
+		t.Error("expected a client CA without a certificate to be refused")
+	}
+}
+
+// accessReviewer allows the SubjectAccessReviews whose user and resource it knows, and counts them.
+type accessReviewer struct {
+	client.Client
+	allowed map[string]bool
+	reviews int
+}
+
+func (c *accessReviewer) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	c.reviews++
+	review := obj.(*authorizationv1.SubjectAccessReview)
+	attributes := review.Spec.ResourceAttributes
+	if (attributes.Verb != VerbRequest && attributes.Verb != "list") || attributes.Group != scalablev1.GroupVersion.Group {
+		return fmt.Errorf("unexpected review of %+v", attributes)
+	}
+	review.Status.Allowed = c.allowed[review.Spec.User+" "+attributes.Verb+" "+attributes.Namespace+"/"+attributes.Resource+"/"+attributes.Name]
+	return nil
+}
+
+func TestSubjectAccessReviewAuthorizer(t *testing.T) {
+	reviewer := &accessReviewer{allowed: map[string]bool{
+		"hmac:k1 request default/scalablepodpools/web": true,
+		"hmac:k1 request default/scalablepods/solo":    true,
+		"hmac:k1 list default/scalablepodusages/":      true,
+	}}
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	authorizer := &SubjectAccessReviewAuthorizer{Client: reviewer, CacheTTL: time.Minute, Clock: fakeClock}
+	caller := &Identity{Username: "hmac:k1"}
+	pooled := func(name, pool string) *scalablev1.ScalablePod {
+		return &scalablev1.ScalablePod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{scalablev1.PoolLabel: pool}}}
+	}
+
+	for _, test := range []struct {
+		caller  *Identity
+		sp      *scalablev1.ScalablePod
+		allowed bool
+	}{
+		{caller, pooled("sp1", "web"), true},
+		{caller, pooled("sp2", "web"), true},
+		{caller, pooled("sp3", "admin"), false},
+		{caller, &scalablev1.ScalablePod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "solo"}}, true},
+		{&Identity{Username: "hmac:k2"}, pooled("sp1", "web"), false},
+		{nil, pooled("sp1", "web"), false},
+	} {
+		allowed, reason, err := authorizer.Authorize(context.Background(), test.caller, RequestResource(test.sp))
+		if err != nil || allowed != test.allowed || (!allowed && reason == "") {
+			t.Errorf("expected %+v to be allowed %s: %v, got %v, %q, %v", test.caller, test.sp.Name, test.allowed, allowed, reason, err)
+		}
+	}
+	if reviewer.reviews != 4 {
+		t.Errorf("expected one review for each pool, or ScalablePod outside a pool, and caller, got %d", reviewer.reviews)
+	}
+	now = now.Add(2 * time.Minute)
+	fakeClock.SetTime(now)
+	authorizer.Authorize(context.Background(), caller, RequestResource(pooled("sp1", "web")))
+	if reviewer.reviews != 5 {
+		t.Errorf("expected the decision to be reviewed again once it expired, got %d reviews", reviewer.reviews)
+	}
+
+	// Other verbs are decided apart from the request verb
+	usages := Resource{Namespace: "default", Resource: "scalablepodusages", Verb: "list"}
+	if allowed, _, err := authorizer.Authorize(context.Background(), caller, usages); err != nil || !allowed {
+		t.Errorf("expected the caller to be allowed to list usages, got %v, %v", allowed, err)
+	}
+	if allowed, _, err := authorizer.Authorize(context.Background(), caller, Resource{Namespace: "default", Resource: "scalablepodusages"}); err != nil || allowed {
+		t.Errorf("expected the caller not to be allowed to request usages, got %v, %v", allowed, err)
+	}
+
+	if _, err := (&Options{Authorize: true}).Authorizer(reviewer); err == nil {
+		t.Error("expected authorization without authentication to be refused")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+/* SignatureHeader carries the signature of a request signed with a shared secret:
+ *
+ *   X-ScalablePod-Signature: keyId=<key ID>,timestamp=<Unix seconds>,signature=<signature>
+ *
+ * The signature is the unpadded base64url HMAC-SHA256, under the key, of the method, request URI, timestamp and hex
+ * SHA-256 of the body, each followed by a newline. See Sign.
+ */
+const SignatureHeader = "X-ScalablePod-Signature"
+
+// How far the timestamp of a signed request may be from the current time, unless HMACAuthenticator.MaxSkew is set
+const defaultMaxSkew = 5 * time.Minute
+
+// Largest body of a signed request
+const maxSignedBody = 1 << 20
+
+/* HMACAuthenticator authenticates requests signed with one of a set of shared secrets, as the caller ID "hmac:<key
+ * ID>". Signatures are only accepted within MaxSkew of their timestamp, which limits how long a captured request can be
+ * replayed. Several keys can be trusted at once, so that a key can be rotated without downtime.
+ */
+type HMACAuthenticator struct {
+	// Secrets by key ID
+	Keys map[string][]byte
+	// How far a request's timestamp may be from the current time
+	MaxSkew time.Duration
+	// Clock request timestamps are checked against
+	Clock clock.Clock
+}
+
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get(SignatureHeader)
+	if header == "" {
+		return nil, nil
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(header, ",") {
+		if i := strings.Index(field, "="); i > 0 {
+			fields[strings.TrimSpace(field[:i])] = strings.TrimSpace(field[i+1:])
+		}
+	}
+	keyID, signature := fields["keyId"], fields["signature"]
+	key, ok := a.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", keyID)
+	}
+	timestamp, err := strconv.ParseInt(fields["timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature timestamp %q", fields["timestamp"])
+	}
+	maxSkew := a.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = defaultMaxSkew
+	}
+	if skew := a.Clock.Now().Sub(time.Unix(timestamp, 0)); skew > maxSkew || skew < -maxSkew {
+		return nil, fmt.Errorf("signature timestamp is %s off", skew.Round(time.Second))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body: %v", err)
+	}
+	if len(body) > maxSignedBody {
+		return nil, errors.New("body too large to sign")
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	expected := sign(key, r.Method, r.URL.RequestURI(), timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, fmt.Errorf("invalid signature for key %q", keyID)
+	}
+	return &Identity{Username: "hmac:" + keyID, Method: MethodHMAC}, nil
+}
+
+// Sign sets the SignatureHeader of a request with the given body, signing it with the key at the time given.
+func Sign(req *http.Request, body []byte, keyID string, key []byte, at time.Time) {
+	timestamp := at.Unix()
+	req.Header.Set(SignatureHeader, fmt.Sprintf("keyId=%s,timestamp=%d,signature=%s",
+		keyID, timestamp, sign(key, req.Method, req.URL.RequestURI(), timestamp, body)))
+}
+
+func sign(key []byte, method, requestURI string, timestamp int64, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n", method, requestURI, timestamp, hex.EncodeToString(bodySum[:]))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// LoadKeys reads the secrets in a directory, such as a mounted Secret, by file name. Hidden files are skipped, along
+// with the links Kubernetes puts in Secret volumes.
+func LoadKeys(dir string) (map[string][]byte, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string][]byte{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if info, err := os.Stat(path); err != nil || info.IsDir() {
+			continue
+		}
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if key = bytes.TrimSpace(key); len(key) == 0 {
+			return nil, fmt.Errorf("signing key %s is empty", path)
+		}
+		keys[entry.Name()] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys in %s", dir)
+	}
+	return keys, nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/ttlcache"
+)
+
+// VerbRequest is the virtual verb RBAC rules grant to let callers claim ScalablePods from the request server.
+const VerbRequest = "request"
+
+// How long SubjectAccessReview decisions are kept, unless SubjectAccessReviewAuthorizer.CacheTTL is set
+const defaultDecisionCacheTTL = time.Minute
+
+// Most SubjectAccessReview decisions kept at once. The least recently used are dropped to make room for more.
+const maxCachedDecisions = 10000
+
+// Resource is what a caller asks to request: a ScalablePodPool, or a ScalablePod outside any pool. It can also be
+// another verb on another of the operator's resources, such as listing ScalablePodUsages.
+type Resource struct {
+	Namespace string
+	// scalablepodpools or scalablepods
+	Resource string
+	Name     string
+	// VerbRequest if empty
+	Verb string
+}
+
+// RequestResource returns the resource a caller needs the request verb on to claim the ScalablePod: its pool, if it
+// is in one, so that access is granted to whole pools.
+func RequestResource(sp *scalablev1.ScalablePod) Resource {
+	if pool := sp.Labels[scalablev1.PoolLabel]; pool != "" {
+		return Resource{Namespace: sp.Namespace, Resource: "scalablepodpools", Name: pool}
+	}
+	return Resource{Namespace: sp.Namespace, Resource: "scalablepods", Name: sp.Name}
+}
+
+func (r Resource) String() string {
+	return r.Namespace + "/" + r.Resource + "/" + r.Name
+}
+
+func (r Resource) verb() string {
+	if r.Verb == "" {
+		return VerbRequest
+	}
+	return r.Verb
+}
+
+// Authorizer decides whether callers may request ScalablePods.
+type Authorizer interface {
+	// Authorize reports whether the caller may request the resource, and if not, why.
+	Authorize(ctx context.Context, identity *Identity, resource Resource) (bool, string, error)
+}
+
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+/* SubjectAccessReviewAuthorizer asks the API server whether the caller has the request verb on the resource, so that
+ * ordinary RBAC decides who may claim which ScalablePods. For example, a Role with
+ *
+ *   rules:
+ *   - apiGroups: ["scalable.scalablepod.tutorial.io"]
+ *     resources: ["scalablepodpools"]
+ *     resourceNames: ["web"]
+ *     verbs: ["request"]
+ *
+ * lets its subjects claim ScalablePods from the web pool in the Role's namespace. Decisions are cached for a short
+ * while, as each request may need several.
+ */
+type SubjectAccessReviewAuthorizer struct {
+	// Client to create SubjectAccessReviews with
+	Client client.Client
+	// How long a decision is trusted before the caller's access is reviewed again
+	CacheTTL time.Duration
+
+	// Clock decisions expire by
+	Clock clock.Clock
+
+	once  sync.Once
+	cache *ttlcache.Cache
+}
+
+type cachedDecision struct {
+	allowed bool
+	reason  string
+}
+
+func (a *SubjectAccessReviewAuthorizer) Authorize(ctx context.Context, identity *Identity, resource Resource) (bool, string, error) {
+	if identity == nil {
+		return false, "caller isn't authenticated", nil
+	}
+	key := decisionKey(identity, resource)
+	if cached, ok := a.decisions().Get(key, a.Clock.Now()); ok {
+		decision := cached.(cachedDecision)
+		return decision.allowed, decision.reason, nil
+	}
+
+	review := &authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{
+		User:   identity.Username,
+		UID:    identity.UID,
+		Groups: identity.Groups,
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Namespace: resource.Namespace,
+			Verb:      resource.verb(),
+			Group:     scalablev1.GroupVersion.Group,
+			Version:   scalablev1.GroupVersion.Version,
+			Resource:  resource.Resource,
+			Name:      resource.Name,
+		},
+	}}
+	if len(identity.Extra) > 0 {
+		review.Spec.Extra = map[string]authorizationv1.ExtraValue{}
+		for name, values := range identity.Extra {
+			review.Spec.Extra[name] = values
+		}
+	}
+	if err := a.Client.Create(ctx, review); err != nil {
+		return false, "", fmt.Errorf("unable to review access: %v", err)
+	}
+	reason := review.Status.Reason
+	if !review.Status.Allowed && reason == "" {
+		reason = fmt.Sprintf("%s may not %s %s", identity.Username, resource.verb(), resource)
+	}
+	ttl := a.CacheTTL
+	if ttl == 0 {
+		ttl = defaultDecisionCacheTTL
+	}
+	a.decisions().Set(key, cachedDecision{allowed: review.Status.Allowed, reason: reason}, a.Clock.Now().Add(ttl))
+	return review.Status.Allowed, reason, nil
+}
+
+func (a *SubjectAccessReviewAuthorizer) decisions() *ttlcache.Cache {
+	a.once.Do(func() { a.cache = ttlcache.New(maxCachedDecisions) })
+	return a.cache
+}
+
+// decisionKey identifies a decision by everything the review was based on.
+func decisionKey(identity *Identity, resource Resource) string {
+	groups := append([]string(nil), identity.Groups...)
+	sort.Strings(groups)
+	var extra []string
+	for name, values := range identity.Extra {
+		extra = append(extra, name+"="+strings.Join(values, ","))
+	}
+	sort.Strings(extra)
+	return strings.Join([]string{identity.Username, identity.UID, strings.Join(groups, ","), strings.Join(extra, ";"), resource.verb(), resource.String()}, "\x00")
+}
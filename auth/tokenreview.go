@@ -0,0 +1,116 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/edwmorgan/k8s-operator-example/ttlcache"
+)
+
+// How long TokenReview results are kept, unless TokenReviewAuthenticator.CacheTTL is set
+const defaultTokenCacheTTL = time.Minute
+
+// Most TokenReview results kept at once. The least recently used are dropped to make room for more.
+const maxCachedTokens = 1000
+
+//+kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+
+/* TokenReviewAuthenticator authenticates requests carrying a Kubernetes bearer token, such as a pod's service account
+ * token, by asking the API server who the token belongs to with a TokenReview. Results are cached for a short while,
+ * as the user-facing server polls the request server while a ScalablePod starts.
+ */
+type TokenReviewAuthenticator struct {
+	// Client to create TokenReviews with
+	Client client.Client
+	// Audiences the token must be issued for, or none for the API server's
+	Audiences []string
+	// How long a result is trusted before the token is reviewed again
+	CacheTTL time.Duration
+
+	// Clock results expire by
+	Clock clock.Clock
+
+	once  sync.Once
+	cache *ttlcache.Cache
+}
+
+type cachedReview struct {
+	identity *Identity
+	err      error
+}
+
+func (a *TokenReviewAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return nil, nil
+	}
+	token := strings.TrimSpace(header[len("Bearer "):])
+	if token == "" {
+		return nil, errors.New("empty bearer token")
+	}
+	sum := sha256.Sum256([]byte(token))
+	key := string(sum[:])
+	if cached, ok := a.results().Get(key, a.Clock.Now()); ok {
+		review := cached.(cachedReview)
+		return review.identity, review.err
+	}
+
+	review := &authenticationv1.TokenReview{Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: a.Audiences}}
+	if err := a.Client.Create(r.Context(), review); err != nil {
+		// Not cached, as the API server may be back soon
+		return nil, fmt.Errorf("unable to review token: %v", err)
+	}
+	var identity *Identity
+	var err error
+	switch {
+	case review.Status.Error != "":
+		err = fmt.Errorf("token rejected: %s", review.Status.Error)
+	case !review.Status.Authenticated:
+		err = errors.New("token not authenticated")
+	default:
+		user := review.Status.User
+		identity = &Identity{Username: user.Username, UID: user.UID, Groups: user.Groups, Method: MethodTokenReview}
+		if len(user.Extra) > 0 {
+			identity.Extra = map[string][]string{}
+			for name, values := range user.Extra {
+				identity.Extra[name] = values
+			}
+		}
+	}
+	ttl := a.CacheTTL
+	if ttl == 0 {
+		ttl = defaultTokenCacheTTL
+	}
+	a.results().Set(key, cachedReview{identity: identity, err: err}, a.Clock.Now().Add(ttl))
+	return identity, err
+}
+
+func (a *TokenReviewAuthenticator) results() *ttlcache.Cache {
+	a.once.Do(func() { a.cache = ttlcache.New(maxCachedTokens) })
+	return a.cache
+}
@@ -1,14 +1,22 @@
 #!/bin/bash
 
-# Usage: bash add_scalablepod.sh sptest 5 | kubectl apply -f -
+# Usage: bash add_scalablepod.sh sptest 5 [pool] | kubectl apply -f -
 
 NAME=$1
 TTL=$2
+POOL=$3
+
+LABELS=''
+if [ -n "$POOL" ]; then
+LABELS='
+  labels:
+    scalable.scalablepod.tutorial.io/pool: "'"$POOL"'"'
+fi
 
 sp='apiVersion: "scalable.scalablepod.tutorial.io/v1"
 kind: ScalablePod
 metadata:
-  name: '"$NAME"'
+  name: '"$NAME"''"$LABELS"'
 spec:
   podImageName: "busybox"
   podImageTag: "latest"
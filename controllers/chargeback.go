@@ -0,0 +1,104 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// TenantUsage is how much a tenant, the claimant of ScalablePods, used them in a namespace on a day.
+type TenantUsage struct {
+	Namespace string `json:"namespace"`
+	// Who claimed the ScalablePods. Empty for warm ScalablePods that were never claimed, which is the cost of keeping
+	// the pools warm.
+	Tenant string `json:"tenant"`
+	// Number of usage records that overlap the day
+	Records int64 `json:"records"`
+	// Seconds of the day the tenant's ScalablePods were active, added up over them
+	ActiveSeconds int64 `json:"activeSeconds"`
+	// Each requested resource held for those seconds, e.g. CPU-seconds for cpu and byte-seconds for memory
+	ResourceSeconds map[string]float64 `json:"resourceSeconds,omitempty"`
+}
+
+// UsageRollup is the usage of each tenant on a day.
+type UsageRollup struct {
+	// Day as YYYY-MM-DD, and the time zone it starts in
+	Day      string `json:"day"`
+	TimeZone string `json:"timeZone"`
+	// Ordered by namespace, then tenant
+	Tenants []TenantUsage `json:"tenants"`
+}
+
+/* DailyUsage rolls up the ScalablePodUsage records in the namespace, or all namespaces if it is empty, for the day
+ * starting at dayStart. Only the part of each record that falls on the day is counted, so usage spanning midnight is
+ * split between the days. ScalablePods that are still active aren't counted until they are deactivated.
+ */
+func DailyUsage(ctx context.Context, c client.Reader, namespace string, dayStart time.Time) (*UsageRollup, error) {
+	var usages scalablev1.ScalablePodUsageList
+	if err := c.List(ctx, &usages, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	tenants := map[[2]string]*TenantUsage{}
+	for i := range usages.Items {
+		spec := &usages.Items[i].Spec
+		start, end := spec.StartedAt.Time, spec.EndedAt.Time
+		if !start.Before(dayEnd) || !end.After(dayStart) {
+			continue
+		}
+		if end.After(dayEnd) {
+			end = dayEnd
+		}
+		seconds := secondsSince(start, dayStart, end)
+		key := [2]string{usages.Items[i].Namespace, spec.Claimant}
+		tenant, ok := tenants[key]
+		if !ok {
+			tenant = &TenantUsage{Namespace: key[0], Tenant: key[1]}
+			tenants[key] = tenant
+		}
+		tenant.Records++
+		tenant.ActiveSeconds += seconds
+		for name, quantity := range spec.Requests {
+			if tenant.ResourceSeconds == nil {
+				tenant.ResourceSeconds = map[string]float64{}
+			}
+			tenant.ResourceSeconds[string(name)] += resourceSeconds(quantity, seconds)
+		}
+	}
+	rollup := &UsageRollup{
+		Day:      dayStart.Format("2006-01-02"),
+		TimeZone: dayStart.Location().String(),
+		Tenants:  make([]TenantUsage, 0, len(tenants)),
+	}
+	for _, tenant := range tenants {
+		rollup.Tenants = append(rollup.Tenants, *tenant)
+	}
+	sort.Slice(rollup.Tenants, func(i, j int) bool {
+		a, b := rollup.Tenants[i], rollup.Tenants[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Tenant < b.Tenant
+	})
+	return rollup, nil
+}
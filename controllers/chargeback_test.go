@@ -0,0 +1,174 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+func usageRecordOf(namespace, name, claimant string, startedAt, endedAt time.Time, cpu string) *scalablev1.ScalablePodUsage {
+	usage := &scalablev1.ScalablePodUsage{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: scalablev1.ScalablePodUsageSpec{
+			ScalablePod:   "sp1",
+			Claimant:      claimant,
+			StartedAt:     metav1.Time{Time: startedAt},
+			EndedAt:       metav1.Time{Time: endedAt},
+			ActiveSeconds: int64(endedAt.Sub(startedAt) / time.Second),
+			Reason:        DeactivationExpired,
+		},
+	}
+	if cpu != "" {
+		usage.Spec.Requests = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(cpu)}
+	}
+	return usage
+}
+
+func TestDailyUsage(t *testing.T) {
+	day := time.Date(2021, 9, 6, 0, 0, 0, 0, time.UTC)
+	c := newQuotaClient(t,
+		usageRecordOf("default", "u1", "alice", day.Add(9*time.Hour), day.Add(10*time.Hour), "500m"),
+		usageRecordOf("default", "u2", "alice", day.Add(11*time.Hour), day.Add(11*time.Hour+30*time.Minute), "2"),
+		// Spans midnight at each end, so only the part on the day counts
+		usageRecordOf("default", "u3", "bob", day.Add(-time.Hour), day.Add(time.Hour), ""),
+		usageRecordOf("default", "u4", "bob", day.Add(23*time.Hour), day.Add(26*time.Hour), ""),
+		// Never claimed
+		usageRecordOf("default", "u5", "", day.Add(time.Hour), day.Add(2*time.Hour), ""),
+		usageRecordOf("team-b", "u6", "alice", day.Add(time.Hour), day.Add(2*time.Hour), ""),
+		// Other days
+		usageRecordOf("default", "u7", "alice", day.Add(-3*time.Hour), day.Add(-2*time.Hour), ""),
+		usageRecordOf("default", "u8", "alice", day.Add(24*time.Hour), day.Add(25*time.Hour), ""),
+	)
+
+	rollup, err := DailyUsage(context.Background(), c, "default", day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollup.Day != "2021-09-06" || rollup.TimeZone != "UTC" || len(rollup.Tenants) != 3 {
+		t.Fatalf("expected a day's usage for the three tenants in the namespace, got %+v", rollup)
+	}
+	unclaimed, alice, bob := rollup.Tenants[0], rollup.Tenants[1], rollup.Tenants[2]
+	if unclaimed.Tenant != "" || unclaimed.ActiveSeconds != 3600 {
+		t.Errorf("expected the unclaimed usage first, got %+v", unclaimed)
+	}
+	if alice.Tenant != "alice" || alice.Records != 2 || alice.ActiveSeconds != 5400 || alice.ResourceSeconds["cpu"] != 0.5*3600+2*1800 {
+		t.Errorf("expected alice's usage and CPU-seconds, got %+v", alice)
+	}
+	if bob.Tenant != "bob" || bob.Records != 2 || bob.ActiveSeconds != 7200 || bob.ResourceSeconds != nil {
+		t.Errorf("expected the hour of each of bob's records on the day, got %+v", bob)
+	}
+
+	if rollup, err := DailyUsage(context.Background(), c, "", day); err != nil || len(rollup.Tenants) != 4 || rollup.Tenants[3].Namespace != "team-b" {
+		t.Errorf("expected every namespace's usage, got %+v, %v", rollup, err)
+	}
+	// A day starting in another time zone
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollup, err = DailyUsage(context.Background(), c, "default", time.Date(2021, 9, 7, 0, 0, 0, 0, london))
+	if err != nil || rollup.Day != "2021-09-07" || rollup.TimeZone != "Europe/London" || len(rollup.Tenants) != 2 ||
+		rollup.Tenants[0].ActiveSeconds != 3600 || rollup.Tenants[1].ActiveSeconds != 3*3600 {
+		t.Errorf("expected the usage from 23:00 UTC, when the day starts in London, got %+v, %v", rollup, err)
+	}
+}
+
+func TestUsageRetention(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	c := newQuotaClient(t,
+		usageRecordOf("default", "old", "alice", now.Add(-49*time.Hour), now.Add(-48*time.Hour-time.Second), ""),
+		usageRecordOf("default", "recent", "alice", now.Add(-2*time.Hour), now.Add(-time.Hour), ""),
+	)
+	r := &ScalablePodUsageReconciler{Client: c, Clock: clock.NewFakeClock(now), Retention: 48 * time.Hour}
+
+	for _, name := range []string{"old", "recent", "missing"} {
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var usages scalablev1.ScalablePodUsageList
+	if err := c.List(context.Background(), &usages); err != nil {
+		t.Fatal(err)
+	}
+	if len(usages.Items) != 1 || usages.Items[0].Name != "recent" {
+		t.Errorf("expected only the record older than the retention period to be deleted, got %+v", usages.Items)
+	}
+	result, _ := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "recent"}})
+	if result.RequeueAfter != 47*time.Hour {
+		t.Errorf("expected the record to be checked again when it expires, got %+v", result)
+	}
+
+	r.Retention = 0
+	r.Clock = clock.NewFakeClock(now.Add(time.Hour * 24 * 365))
+	if result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "recent"}}); err != nil || result.RequeueAfter != 0 {
+		t.Errorf("expected records to be kept without a retention period, got %+v, %v", result, err)
+	}
+}
+
+func TestUsageChargesQuotas(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	sp := claimedScalablePod("sp1", "alice", now.Add(-time.Hour))
+	usage := usageRecordOf("default", "u1", "alice", now.Add(-time.Hour), now, "")
+	usage.Spec.ClaimID = sp.Status.ClaimID
+	c := newQuotaClient(t, sp, usage, &scalablev1.ScalablePodQuota{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "everyone"},
+		Status:     scalablev1.ScalablePodQuotaStatus{Day: "2021-09-06"},
+	})
+	r := &ScalablePodUsageReconciler{Client: c, Clock: clock.NewFakeClock(now)}
+	reconcile := func() ctrl.Result {
+		result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "u1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	charged := func() int64 {
+		var quota scalablev1.ScalablePodQuota
+		if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "everyone"}, &quota); err != nil {
+			t.Fatal(err)
+		}
+		return quota.Status.ReleasedSecondsToday
+	}
+
+	// Quotas still count the claim from the ScalablePod's status
+	if result := reconcile(); result.RequeueAfter == 0 || charged() != 0 {
+		t.Errorf("expected the claim not to be charged while the ScalablePod shows it, got %+v, %d", result, charged())
+	}
+	sp.Status.ClaimID = ""
+	if err := c.Status().Update(context.Background(), sp); err != nil {
+		t.Fatal(err)
+	}
+	reconcile()
+	reconcile()
+	if charged() != 3600 {
+		t.Errorf("expected the released claim to be charged once, got %d", charged())
+	}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "u1"}, usage); err != nil || usage.Annotations[scalablev1.QuotaChargedAnnotation] == "" {
+		t.Errorf("expected the record to be marked charged, got %v, %v", usage.Annotations, err)
+	}
+}
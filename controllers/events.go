@@ -0,0 +1,43 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+// Reasons of the Events recorded on ScalablePods. They are part of the operator's interface, so don't change them.
+const (
+	// The ScalablePod was requested, or pre-warmed by its pool, and is starting a pod
+	ReasonRequested = "Requested"
+	// The ScalablePod's pod was created
+	ReasonPodCreated = "PodCreated"
+	// The ScalablePod's pod could not be created
+	ReasonPodCreateFailed = "PodCreateFailed"
+	// The ScalablePod's pod became Ready
+	ReasonPodReady = "PodReady"
+	// The ScalablePod's MaxActiveTimeSec ran out and its pod is being deleted
+	ReasonExpired = "Expired"
+	// The ScalablePod was warm for longer than its class's idle timeout and its pod is being deleted
+	ReasonIdle = "Idle"
+	// The ScalablePod was released before its TTL ran out and its pod is being deleted
+	ReasonReleased = "Released"
+	// The ScalablePod's pod was deleted or evicted by someone other than the operator
+	ReasonPreempted = "Preempted"
+	// The ScalablePod's pod could not be deleted
+	ReasonPodDeleteFailed = "PodDeleteFailed"
+	// The ScalablePod's status could not be updated
+	ReasonUpdateFailed = "UpdateFailed"
+	// The ScalablePodClass the Active ScalablePod names doesn't exist, so its own settings are used
+	ReasonClassMissing = "ClassMissing"
+)
@@ -0,0 +1,139 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+const hoursPerWeek = 7 * 24
+
+// DemandForecaster learns when requests for each ScalablePodPool arrive and predicts how many will arrive in a given
+// hour. For every hour of the week it keeps a moving average of the requests seen in that hour in previous weeks, so a
+// pool that is busy at 9am on Mondays is expected to be busy next Monday at 9am. That is blended with an exponentially
+// smoothed count of the last few hours, which covers hours with no history and demand the weekly pattern doesn't know
+// about. History is kept in memory and starts again when the operator restarts.
+type DemandForecaster struct {
+	Clock clock.Clock
+	// Weight of the latest week in each hour-of-week average
+	WeeklyAlpha float64
+	// Weight of the latest hour in the recent average
+	RecentAlpha float64
+	// Weight of the hour-of-week average over the recent average, once that hour has history
+	WeeklyWeight float64
+
+	mu    sync.Mutex
+	pools map[types.NamespacedName]*demandHistory
+}
+
+// demandHistory is the request history of one pool, in requests per hour.
+type demandHistory struct {
+	// The hour currently being counted, in hours since the Unix epoch, and the requests seen in it so far
+	hour  int64
+	count float64
+
+	weekly [hoursPerWeek]float64
+	seen   [hoursPerWeek]bool
+	recent float64
+}
+
+// NewDemandForecaster returns a DemandForecaster with sensible smoothing factors.
+func NewDemandForecaster(clock clock.Clock) *DemandForecaster {
+	return &DemandForecaster{
+		Clock:        clock,
+		WeeklyAlpha:  0.5,
+		RecentAlpha:  0.5,
+		WeeklyWeight: 0.8,
+		pools:        map[types.NamespacedName]*demandHistory{},
+	}
+}
+
+// Record notes that a request for the pool arrived now, and whether it found a warm ScalablePod waiting.
+func (f *DemandForecaster) Record(pool types.NamespacedName, hit bool) {
+	if hit {
+		prewarmHits.WithLabelValues(pool.Namespace, pool.Name).Inc()
+	} else {
+		prewarmMisses.WithLabelValues(pool.Namespace, pool.Name).Inc()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.history(pool).count++
+}
+
+// Forecast returns the number of requests expected for the pool in the hour containing `at`.
+func (f *DemandForecaster) Forecast(pool types.NamespacedName, at time.Time) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := f.history(pool)
+	slot := hourOfWeek(at)
+	if !h.seen[slot] {
+		return h.recent
+	}
+	return f.WeeklyWeight*h.weekly[slot] + (1-f.WeeklyWeight)*h.recent
+}
+
+// history returns the pool's history, first folding any hours that have finished into the averages.
+func (f *DemandForecaster) history(pool types.NamespacedName) *demandHistory {
+	now := f.Clock.Now().Unix() / 3600
+	h, ok := f.pools[pool]
+	if !ok {
+		h = &demandHistory{hour: now}
+		f.pools[pool] = h
+	}
+	// Hours with no requests count as zero, but after a week of silence there is nothing left to decay
+	for steps := 0; h.hour < now && steps < hoursPerWeek; steps++ {
+		slot := hourOfWeek(time.Unix(h.hour*3600, 0))
+		if h.seen[slot] {
+			h.weekly[slot] = f.WeeklyAlpha*h.count + (1-f.WeeklyAlpha)*h.weekly[slot]
+		} else {
+			h.weekly[slot] = h.count
+			h.seen[slot] = true
+		}
+		h.recent = f.RecentAlpha*h.count + (1-f.RecentAlpha)*h.recent
+		h.count = 0
+		h.hour++
+	}
+	h.hour = now
+	return h
+}
+
+// hourOfWeek numbers the hours of the week from midnight on Sunday, UTC.
+func hourOfWeek(t time.Time) int {
+	t = t.UTC()
+	return int(t.Weekday())*24 + t.Hour()
+}
+
+// predictedWarm is the number of ScalablePods the pool should keep warm to serve the requests expected over the
+// lookahead without a cold start. It looks at both ends of the lookahead so that ScalablePods are warmed before
+// a busy hour begins.
+func predictedWarm(f *DemandForecaster, pool types.NamespacedName, prediction *scalablev1.PredictionSpec, now time.Time) int32 {
+	lookahead := time.Duration(prediction.LookaheadSec) * time.Second
+	perHour := math.Max(f.Forecast(pool, now), f.Forecast(pool, now.Add(lookahead)))
+	forecastRequests.WithLabelValues(pool.Namespace, pool.Name).Set(perHour)
+	warm := int32(math.Ceil(perHour * lookahead.Hours()))
+	if prediction.MaxWarm != nil && warm > *prediction.MaxWarm {
+		warm = *prediction.MaxWarm
+	}
+	return warm
+}
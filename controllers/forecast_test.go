@@ -0,0 +1,113 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// syntheticArrivals is the number of requests arriving at a given minute: on weekdays, a burst of one every five
+// minutes from 9am to 10am and one every half hour from 1pm to 5pm.
+func syntheticArrivals(t time.Time) int {
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return 0
+	}
+	switch {
+	case t.Hour() == 9 && t.Minute()%5 == 0:
+		return 1
+	case t.Hour() >= 13 && t.Hour() < 17 && t.Minute()%30 == 0:
+		return 1
+	}
+	return 0
+}
+
+// simulateColdStarts runs three weeks of synthetic traffic against a pool, a minute at a time, and returns the number
+// of requests in the last week that found no warm ScalablePod. The pool is never full, and ScalablePods take a minute
+// to warm up.
+func simulateColdStarts(t *testing.T, prediction *scalablev1.PredictionSpec) int {
+	pool := types.NamespacedName{Namespace: "default", Name: "simulated"}
+	start := time.Date(2021, 9, 5, 0, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(start)
+	forecaster := NewDemandForecaster(fakeClock)
+	var warm, warming int32
+	coldStarts := 0
+	for now := start; now.Before(start.Add(21 * 24 * time.Hour)); now = now.Add(time.Minute) {
+		fakeClock.SetTime(now)
+		warm += warming
+		warming = 0
+
+		for i := 0; i < syntheticArrivals(now); i++ {
+			hit := warm > 0
+			if hit {
+				warm--
+			} else if now.Sub(start) >= 14*24*time.Hour {
+				coldStarts++
+			}
+			forecaster.Record(pool, hit)
+		}
+
+		// What the pool reconciler would do: warm up or release ScalablePods to meet the warm minimum
+		var target int32
+		if prediction != nil {
+			target = predictedWarm(forecaster, pool, prediction, now)
+		}
+		if warm > target {
+			warm = target
+		} else {
+			warming = target - warm
+		}
+	}
+	t.Logf("cold starts in the last week: %d", coldStarts)
+	return coldStarts
+}
+
+func TestPredictionReducesColdStarts(t *testing.T) {
+	withoutPrediction := simulateColdStarts(t, nil)
+	withPrediction := simulateColdStarts(t, &scalablev1.PredictionSpec{LookaheadSec: 1800})
+	// 5 weekdays of 12 burst requests and 8 afternoon requests
+	if withoutPrediction != 100 {
+		t.Errorf("expected every request to be a cold start without prediction, got %d", withoutPrediction)
+	}
+	if withPrediction*4 > withoutPrediction {
+		t.Errorf("expected prediction to avoid at least three quarters of cold starts, got %d of %d", withPrediction, withoutPrediction)
+	}
+}
+
+func TestForecastLearnsHourOfWeek(t *testing.T) {
+	pool := types.NamespacedName{Namespace: "default", Name: "weekly"}
+	monday9am := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(monday9am)
+	forecaster := NewDemandForecaster(fakeClock)
+	for i := 0; i < 10; i++ {
+		forecaster.Record(pool, false)
+	}
+
+	// A day later the burst has faded from the recent average but is still expected next Monday
+	fakeClock.SetTime(monday9am.Add(24 * time.Hour))
+	if recent := forecaster.Forecast(pool, fakeClock.Now()); recent > 0.1 {
+		t.Errorf("expected the recent average to have decayed, got %f", recent)
+	}
+	if weekly := forecaster.Forecast(pool, monday9am.Add(7*24*time.Hour)); weekly < 7.9 {
+		t.Errorf("expected about 8 requests next Monday at 9am, got %f", weekly)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/ttlcache"
+)
+
+// IdempotencyKeyField indexes ScalablePods by the Idempotency-Key of the request that claimed them, for
+// client.MatchingFields.
+const IdempotencyKeyField = "status.idempotencyKey"
+
+// How long a claim is remembered in memory, unless IdempotencyKeys.TTL is set. The claimed ScalablePod's status
+// remembers it after that, for as long as the claim lasts.
+const defaultIdempotencyTTL = 10 * time.Minute
+
+// Most claims remembered in memory at once. The least recently used are forgotten to make room for more.
+const maxIdempotencyKeys = 10000
+
+type idempotentClaim struct {
+	scalablePod types.NamespacedName
+	claimID     string
+}
+
+/* IdempotencyKeys remembers which claim each caller's Idempotency-Key was given, so that a retried request gets the
+ * same claim rather than another ScalablePod. Keys are kept in memory for a short while, which covers a retry that
+ * arrives before the claim reaches the cache, and in the claimed ScalablePod's status, which covers operator restarts.
+ * Only one request with a key is handled at a time, so that a retry sent while the first attempt is still running
+ * waits for its claim. Keys belong to the caller that sent them, so two callers can use the same key.
+ */
+type IdempotencyKeys struct {
+	// How long claims are remembered in memory
+	TTL time.Duration
+	// Clock claims are forgotten by
+	Clock clock.Clock
+
+	mu       sync.Mutex
+	claims   *ttlcache.Cache
+	inFlight map[string]chan struct{}
+}
+
+func idempotencyID(caller, key string) string {
+	return caller + "\n" + key
+}
+
+// Begin waits until no other request from the caller with the key is being handled, and returns a function to call
+// when this one has been. It returns an error if the context ends first.
+func (k *IdempotencyKeys) Begin(ctx context.Context, caller, key string) (func(), error) {
+	id := idempotencyID(caller, key)
+	for {
+		k.mu.Lock()
+		done, busy := k.inFlight[id]
+		if !busy {
+			if k.inFlight == nil {
+				k.inFlight = map[string]chan struct{}{}
+			}
+			done = make(chan struct{})
+			k.inFlight[id] = done
+			k.mu.Unlock()
+			return func() {
+				k.mu.Lock()
+				delete(k.inFlight, id)
+				k.mu.Unlock()
+				close(done)
+			}, nil
+		}
+		k.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Remember records the claim the caller's key was given.
+func (k *IdempotencyKeys) Remember(caller, key string, sp *scalablev1.ScalablePod) {
+	ttl := k.TTL
+	if ttl == 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	k.remembered().Set(idempotencyID(caller, key), idempotentClaim{
+		scalablePod: types.NamespacedName{Namespace: sp.Namespace, Name: sp.Name},
+		claimID:     sp.Status.ClaimID,
+	}, k.Clock.Now().Add(ttl))
+}
+
+/* Find returns the ScalablePod still claimed for the caller's key, or nil if there isn't one: the key is new, or its
+ * claim has been released, in which case the key can be used again. A claim remembered in memory is read from the API
+ * server with apiReader, as the cache may not have it yet; otherwise the cache is searched.
+ */
+func (k *IdempotencyKeys) Find(ctx context.Context, c client.Reader, apiReader client.Reader, caller, key string) (*scalablev1.ScalablePod, error) {
+	if remembered, ok := k.remembered().Get(idempotencyID(caller, key), k.Clock.Now()); ok {
+		claim := remembered.(idempotentClaim)
+		var sp scalablev1.ScalablePod
+		if err := apiReader.Get(ctx, claim.scalablePod, &sp); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		} else if err == nil && sp.Status.Requested && sp.Status.ClaimID == claim.claimID {
+			return &sp, nil
+		}
+	}
+	var scalablePods scalablev1.ScalablePodList
+	if err := c.List(ctx, &scalablePods, client.MatchingFields{IdempotencyKeyField: key}); err != nil {
+		return nil, err
+	}
+	for i := range scalablePods.Items {
+		if sp := &scalablePods.Items[i]; sp.Status.IdempotencyKey == key && sp.Status.Requested && sp.Status.ClaimID != "" && sp.Status.ClaimedBy == caller {
+			return sp, nil
+		}
+	}
+	return nil, nil
+}
+
+func (k *IdempotencyKeys) remembered() *ttlcache.Cache {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.claims == nil {
+		k.claims = ttlcache.New(maxIdempotencyKeys)
+	}
+	return k.claims
+}
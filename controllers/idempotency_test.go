@@ -0,0 +1,108 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestIdempotencyKeysFind(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	persisted := claimedScalablePod("sp1", "alice", now)
+	persisted.Status.IdempotencyKey = "key-1"
+	remembered := claimedScalablePod("sp2", "alice", now)
+	c := newQuotaClient(t, persisted, remembered)
+	keys := &IdempotencyKeys{Clock: fakeClock}
+	keys.Remember("alice", "key-2", remembered)
+
+	for _, test := range []struct {
+		caller, key, expected string
+	}{
+		{"alice", "key-1", "sp1"},
+		// Not in the status yet, as if the cache were behind, but remembered
+		{"alice", "key-2", "sp2"},
+		{"bob", "key-1", ""},
+		{"alice", "key-3", ""},
+	} {
+		sp, err := keys.Find(context.Background(), c, c, test.caller, test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var name string
+		if sp != nil {
+			name = sp.Name
+		}
+		if name != test.expected {
+			t.Errorf("expected %s's %s to find %q, got %q", test.caller, test.key, test.expected, name)
+		}
+	}
+
+	// A released claim frees its key
+	remembered.Status.Requested = false
+	remembered.Status.ClaimID = ""
+	remembered.Status.RequestedAt = &metav1.Time{Time: now}
+	if err := c.Status().Update(context.Background(), remembered); err != nil {
+		t.Fatal(err)
+	}
+	if sp, err := keys.Find(context.Background(), c, c, "alice", "key-2"); err != nil || sp != nil {
+		t.Errorf("expected the released claim not to be found, got %v, %v", sp, err)
+	}
+	now = now.Add(time.Hour)
+	fakeClock.SetTime(now)
+	if sp, err := keys.Find(context.Background(), c, c, "alice", "key-1"); err != nil || sp == nil {
+		t.Errorf("expected the claim to be found in its status once forgotten in memory, got %v, %v", sp, err)
+	}
+}
+
+func TestIdempotencyKeysBegin(t *testing.T) {
+	keys := &IdempotencyKeys{}
+	done, err := keys.Begin(context.Background(), "alice", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := keys.Begin(context.Background(), "bob", "key-1"); err != nil {
+		t.Fatal(err)
+	} else {
+		other()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := keys.Begin(ctx, "alice", "key-1"); err == nil {
+		t.Error("expected a second request with the key to wait for the first")
+	}
+
+	started := make(chan struct{})
+	go func() {
+		if retry, err := keys.Begin(context.Background(), "alice", "key-1"); err == nil {
+			retry()
+		}
+		close(started)
+	}()
+	done()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the waiting request to go ahead once the first was done")
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// Reasons a ScalablePod is deactivated
+const (
+	// Its MaxActiveTimeSec ran out
+	DeactivationExpired = "expired"
+	// It was released before its TTL ran out, e.g. a surplus warm ScalablePod
+	DeactivationReleased = "released"
+	// Its pod was deleted or evicted by someone else
+	DeactivationPreempted = "preempted"
+	// It was warm for longer than its class's idle timeout
+	DeactivationIdle = "idle"
+)
+
+var (
+	forecastRequests = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "scalablepod_forecast_requests_per_hour",
+		Help: "Requests per hour the demand forecast expects for a ScalablePodPool over its lookahead",
+	}, []string{"namespace", "pool"})
+	prewarmHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_prewarm_hits_total",
+		Help: "Requests for a ScalablePodPool that were served by a warm ScalablePod",
+	}, []string{"namespace", "pool"})
+	prewarmMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_prewarm_misses_total",
+		Help: "Requests for a ScalablePodPool that found no warm ScalablePod and needed a cold start",
+	}, []string{"namespace", "pool"})
+	requestsServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_requests_served_total",
+		Help: "Requests that claimed a ScalablePod",
+	}, []string{"namespace", "pool"})
+	requestsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_requests_rejected_total",
+		Help: "Requests turned away because no ScalablePod was free",
+	}, []string{"namespace", "pool"})
+	quotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_quota_rejections_total",
+		Help: "Requests turned away because a ScalablePodQuota was used up",
+	}, []string{"namespace", "quota"})
+	activations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_activations_total",
+		Help: "ScalablePods that started a pod",
+	}, []string{"namespace", "pool"})
+	deactivations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_deactivations_total",
+		Help: "ScalablePods that deleted their pod, by reason",
+	}, []string{"namespace", "pool", "reason"})
+	podCreateFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_pod_create_failures_total",
+		Help: "Failed attempts to create a ScalablePod's pod",
+	}, []string{"namespace", "pool"})
+	timeToReady = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "scalablepod_time_to_ready_seconds",
+		Help:    "Time from a ScalablePod being requested to its pod being Ready",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"namespace", "pool"})
+
+	activeDesc = prometheus.NewDesc("scalablepod_active", "ScalablePods claimed by a request",
+		[]string{"namespace", "pool"}, nil)
+	inactiveDesc = prometheus.NewDesc("scalablepod_inactive", "ScalablePods with no pod",
+		[]string{"namespace", "pool"}, nil)
+	warmDesc = prometheus.NewDesc("scalablepod_warm", "ScalablePods warmed up ahead of demand and not yet claimed",
+		[]string{"namespace", "pool"}, nil)
+	queueDepthDesc = prometheus.NewDesc("scalablepod_queue_depth", "Claimed ScalablePods whose pod isn't Ready yet",
+		[]string{"namespace", "pool"}, nil)
+)
+
+func init() {
+	metrics.Registry.MustRegister(forecastRequests, prewarmHits, prewarmMisses, requestsServed, requestsRejected,
+		quotaRejections, activations, deactivations, podCreateFailures, timeToReady)
+}
+
+// poolLabels returns the namespace and pool labels of the ScalablePod's metrics. The pool is empty outside a pool.
+func poolLabels(sp *scalablev1.ScalablePod) []string {
+	return []string{sp.Namespace, sp.Labels[scalablev1.PoolLabel]}
+}
+
+// RecordRequestServed counts a request that claimed the ScalablePod. A claimed warm ScalablePod that is already Ready
+// served the request without a wait.
+func RecordRequestServed(sp *scalablev1.ScalablePod) {
+	requestsServed.WithLabelValues(poolLabels(sp)...).Inc()
+	if wait, ok := TimeToReady(sp); ok {
+		timeToReady.WithLabelValues(poolLabels(sp)...).Observe(wait.Seconds())
+	}
+}
+
+// RecordRequestRejected counts a request no ScalablePod was free for. The namespace and pool are empty if the
+// request didn't ask for one.
+func RecordRequestRejected(namespace, pool string) {
+	requestsRejected.WithLabelValues(namespace, pool).Inc()
+}
+
+// RecordQuotaRejected counts a request turned away by a ScalablePodQuota.
+func RecordQuotaRejected(denial *QuotaDenial) {
+	quotaRejections.WithLabelValues(denial.Namespace, denial.Quota).Inc()
+}
+
+// usageCollector reports how many ScalablePods in each namespace and pool are in each state when it is scraped.
+type usageCollector struct {
+	client.Reader
+}
+
+func (c *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeDesc
+	ch <- inactiveDesc
+	ch <- warmDesc
+	ch <- queueDepthDesc
+}
+
+func (c *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	var scalablePods scalablev1.ScalablePodList
+	if err := c.List(context.Background(), &scalablePods); err != nil {
+		ctrl.Log.WithName("metrics").Error(err, "Unable to list ScalablePods")
+		return
+	}
+	byPool := map[[2]string][]scalablev1.ScalablePod{}
+	for _, sp := range scalablePods.Items {
+		key := [2]string{sp.Namespace, sp.Labels[scalablev1.PoolLabel]}
+		byPool[key] = append(byPool[key], sp)
+	}
+	for key, items := range byPool {
+		usage := UsageOf(items)
+		ch <- prometheus.MustNewConstMetric(activeDesc, prometheus.GaugeValue, float64(usage.Active), key[0], key[1])
+		ch <- prometheus.MustNewConstMetric(inactiveDesc, prometheus.GaugeValue, float64(usage.Inactive), key[0], key[1])
+		ch <- prometheus.MustNewConstMetric(warmDesc, prometheus.GaugeValue, float64(usage.Warm), key[0], key[1])
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(usage.Waiting), key[0], key[1])
+	}
+}
+
+// registerUsageMetrics adds the ScalablePod state gauges to the metrics registry, reading ScalablePods from r.
+func registerUsageMetrics(r client.Reader) error {
+	err := metrics.Registry.Register(&usageCollector{r})
+	if _, ok := err.(prometheus.AlreadyRegisteredError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+func TestUsageMetrics(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	active, inactive := scalablev1.SPActive, scalablev1.SPInactive
+	inPool := map[string]string{scalablev1.PoolLabel: "web"}
+	c := fake.NewFakeClientWithScheme(scheme,
+		&scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "starting", Labels: inPool},
+			Status:     scalablev1.ScalablePodStatus{Status: &active, Requested: true},
+		},
+		&scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "warm", Labels: inPool},
+			Status:     scalablev1.ScalablePodStatus{Status: &active, Requested: true, Warm: true},
+		},
+		&scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "idle"},
+			Status:     scalablev1.ScalablePodStatus{Status: &inactive},
+		},
+	)
+
+	expected := `
+# HELP scalablepod_active ScalablePods claimed by a request
+# TYPE scalablepod_active gauge
+scalablepod_active{namespace="default",pool=""} 0
+scalablepod_active{namespace="default",pool="web"} 1
+# HELP scalablepod_inactive ScalablePods with no pod
+# TYPE scalablepod_inactive gauge
+scalablepod_inactive{namespace="default",pool=""} 1
+scalablepod_inactive{namespace="default",pool="web"} 0
+# HELP scalablepod_queue_depth Claimed ScalablePods whose pod isn't Ready yet
+# TYPE scalablepod_queue_depth gauge
+scalablepod_queue_depth{namespace="default",pool=""} 0
+scalablepod_queue_depth{namespace="default",pool="web"} 1
+# HELP scalablepod_warm ScalablePods warmed up ahead of demand and not yet claimed
+# TYPE scalablepod_warm gauge
+scalablepod_warm{namespace="default",pool=""} 0
+scalablepod_warm{namespace="default",pool="web"} 1
+`
+	if err := testutil.CollectAndCompare(&usageCollector{c}, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordRequestServed(t *testing.T) {
+	requestedAt := metav1.NewTime(time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC))
+	readyAt := metav1.NewTime(requestedAt.Add(-time.Minute))
+	sp := &scalablev1.ScalablePod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "metrics-test", Name: "claimed"},
+		Status:     scalablev1.ScalablePodStatus{Requested: true, RequestedAt: &requestedAt},
+	}
+
+	RecordRequestServed(sp)
+	if served := testutil.ToFloat64(requestsServed.WithLabelValues("metrics-test", "")); served != 1 {
+		t.Errorf("expected 1 served request, got %v", served)
+	}
+	if n := testutil.CollectAndCount(timeToReady, "scalablepod_time_to_ready_seconds"); n != 0 {
+		t.Errorf("expected no time to ready before the pod is Ready, got %d series", n)
+	}
+
+	// A warm ScalablePod that was Ready before it was claimed served the request at once
+	sp.Status.ReadyAt = &readyAt
+	RecordRequestServed(sp)
+	expected := `
+# HELP scalablepod_time_to_ready_seconds Time from a ScalablePod being requested to its pod being Ready
+# TYPE scalablepod_time_to_ready_seconds histogram
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="0.5"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="1"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="2"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="4"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="8"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="16"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="32"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="64"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="128"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="256"} 1
+scalablepod_time_to_ready_seconds_bucket{namespace="metrics-test",pool="",le="+Inf"} 1
+scalablepod_time_to_ready_seconds_sum{namespace="metrics-test",pool=""} 0
+scalablepod_time_to_ready_seconds_count{namespace="metrics-test",pool=""} 1
+`
+	if err := testutil.CollectAndCompare(timeToReady, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
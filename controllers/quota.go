@@ -0,0 +1,271 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// Shortest Retry-After given for a quota that is used up
+const minQuotaRetryAfter = time.Second
+
+// quotaUsage is what a ScalablePodQuota's callers are using at a point in time.
+type quotaUsage struct {
+	// Day the seconds are counted for, and when it started and ends
+	day      string
+	dayStart time.Time
+	dayEnd   time.Time
+	active   int32
+	// Seconds active today, of released claims and those still active
+	activeSeconds int64
+	// When the first of the active claims is due to expire, if it doesn't renew its lease; zero if none are active
+	nextExpiry time.Time
+}
+
+// QuotaDenial says why a ScalablePodQuota refuses a claim.
+type QuotaDenial struct {
+	// Namespace and name of the quota
+	Namespace string
+	Quota     string
+	Reason    string
+	// How long until the quota may have room again
+	RetryAfter time.Duration
+}
+
+// quotaDay returns the day it is at `now` in the quota's time zone, and when it started and ends. Days are counted in
+// UTC if the time zone can't be loaded.
+func quotaDay(quota *scalablev1.ScalablePodQuota, now time.Time) (string, time.Time, time.Time, error) {
+	location := time.UTC
+	var err error
+	if quota.Spec.TimeZone != "" {
+		if location, err = time.LoadLocation(quota.Spec.TimeZone); err != nil {
+			location = time.UTC
+		}
+	}
+	local := now.In(location)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+	return local.Format("2006-01-02"), start, start.AddDate(0, 0, 1), err
+}
+
+// quotaCovers reports whether the quota applies to claims by the caller.
+func quotaCovers(quota *scalablev1.ScalablePodQuota, caller string) bool {
+	if len(quota.Spec.Callers) == 0 {
+		return true
+	}
+	for _, c := range quota.Spec.Callers {
+		if c == caller {
+			return true
+		}
+	}
+	return false
+}
+
+// claimed reports whether the ScalablePod is held by a claim, rather than being warm or idle.
+func claimed(sp *scalablev1.ScalablePod) bool {
+	return sp.Status.Requested && sp.Status.ClaimID != "" && sp.Status.RequestedAt != nil
+}
+
+// usageOf works out a quota's usage from the ScalablePods in its namespace. Claims are counted from when they were made,
+// or the start of the day if they were made before it, and expire as their classes, given by name, allow.
+func usageOf(quota *scalablev1.ScalablePodQuota, scalablePods []scalablev1.ScalablePod, classes map[string]*scalablev1.ScalablePodClass, now time.Time) (quotaUsage, error) {
+	day, dayStart, dayEnd, err := quotaDay(quota, now)
+	usage := quotaUsage{day: day, dayStart: dayStart, dayEnd: dayEnd}
+	if quota.Status.Day == day {
+		usage.activeSeconds = quota.Status.ReleasedSecondsToday
+	}
+	for i := range scalablePods {
+		sp := &scalablePods[i]
+		if sp.Namespace != quota.Namespace || !claimed(sp) || !quotaCovers(quota, sp.Status.ClaimedBy) {
+			continue
+		}
+		usage.active++
+		usage.activeSeconds += secondsSince(sp.Status.RequestedAt.Time, dayStart, now)
+		leaseStart := sp.Status.RequestedAt.Time
+		if sp.Status.StartedAt.After(leaseStart) {
+			leaseStart = sp.Status.StartedAt.Time
+		}
+		if renewedAt := sp.Status.LeaseRenewedAt; renewedAt != nil && renewedAt.After(leaseStart) {
+			leaseStart = renewedAt.Time
+		}
+		expiry := leaseStart.Add(sp.ActiveTime(classes[sp.Spec.ClassName]))
+		if usage.nextExpiry.IsZero() || expiry.Before(usage.nextExpiry) {
+			usage.nextExpiry = expiry
+		}
+	}
+	return usage, err
+}
+
+// exceeded returns why the quota refuses new claims, and how long until it may have room, or "" if it has room.
+func (u quotaUsage) exceeded(quota *scalablev1.ScalablePodQuota, now time.Time) (string, time.Duration) {
+	var reason string
+	var retryAfter time.Duration
+	if limit := quota.Spec.MaxActiveSecondsPerDay; limit != nil && u.activeSeconds >= *limit {
+		reason = fmt.Sprintf("%d of %d active seconds used on %s", u.activeSeconds, *limit, u.day)
+		retryAfter = u.dayEnd.Sub(now)
+	} else if limit := quota.Spec.MaxActive; limit != nil && u.active >= *limit {
+		reason = fmt.Sprintf("%d of %d ScalablePods claimed", u.active, *limit)
+		retryAfter = u.nextExpiry.Sub(now)
+	} else {
+		return "", 0
+	}
+	if retryAfter < minQuotaRetryAfter {
+		retryAfter = minQuotaRetryAfter
+	}
+	return reason, retryAfter
+}
+
+// CheckQuotas returns why the caller may not claim another ScalablePod in the namespace, or nil if it may. When several
+// quotas refuse, the one that will take longest to have room is returned.
+func CheckQuotas(ctx context.Context, c client.Reader, namespace, caller string, now time.Time) (*QuotaDenial, error) {
+	var quotas scalablev1.ScalablePodQuotaList
+	if err := c.List(ctx, &quotas, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	if len(quotas.Items) == 0 {
+		return nil, nil
+	}
+	var scalablePods scalablev1.ScalablePodList
+	if err := c.List(ctx, &scalablePods, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	classes, err := classesByName(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	var denial *QuotaDenial
+	for i := range quotas.Items {
+		quota := &quotas.Items[i]
+		if !quotaCovers(quota, caller) {
+			continue
+		}
+		usage, _ := usageOf(quota, scalablePods.Items, classes, now)
+		reason, retryAfter := usage.exceeded(quota, now)
+		if reason != "" && (denial == nil || retryAfter > denial.RetryAfter) {
+			denial = &QuotaDenial{Namespace: quota.Namespace, Quota: quota.Name, Reason: reason, RetryAfter: retryAfter}
+		}
+	}
+	return denial, nil
+}
+
+// classesByName returns the ScalablePodClasses by name.
+func classesByName(ctx context.Context, c client.Reader) (map[string]*scalablev1.ScalablePodClass, error) {
+	var classes scalablev1.ScalablePodClassList
+	if err := c.List(ctx, &classes); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*scalablev1.ScalablePodClass, len(classes.Items))
+	for i := range classes.Items {
+		byName[classes.Items[i].Name] = &classes.Items[i]
+	}
+	return byName, nil
+}
+
+/* QuotaLocks serializes claims in each namespace, so that a claim is checked against the namespace's ScalablePodQuotas
+ * with every earlier claim counted. Without it, concurrent requests could each see room for one more claim and all
+ * make theirs. The usage has to be read from the API server while the lock is held, as the cache may not have the
+ * claim the previous holder made yet.
+ */
+type QuotaLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// Lock waits until no other request holds any of the namespaces, and returns a function that releases them. The
+// namespaces are locked in order, so that requests that need several of them can't deadlock.
+func (l *QuotaLocks) Lock(namespaces []string) func() {
+	sorted := append([]string(nil), namespaces...)
+	sort.Strings(sorted)
+	var locks []*sync.Mutex
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*sync.Mutex{}
+	}
+	for i, namespace := range sorted {
+		if i > 0 && namespace == sorted[i-1] {
+			continue
+		}
+		lock, ok := l.locks[namespace]
+		if !ok {
+			lock = &sync.Mutex{}
+			l.locks[namespace] = lock
+		}
+		locks = append(locks, lock)
+	}
+	l.mu.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}
+}
+
+// chargeQuotas adds the time a claim released at `now` was active that day to the quotas covering its caller, so that
+// it still counts once the ScalablePod no longer shows the claim. Quotas that have moved on to a later day aren't charged.
+func chargeQuotas(ctx context.Context, c client.Client, namespace, caller string, claimedAt, now time.Time) error {
+	var quotas scalablev1.ScalablePodQuotaList
+	if err := c.List(ctx, &quotas, client.InNamespace(namespace)); err != nil {
+		return err
+	}
+	for i := range quotas.Items {
+		quota := &quotas.Items[i]
+		if !quotaCovers(quota, caller) {
+			continue
+		}
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if err := c.Get(ctx, client.ObjectKeyFromObject(quota), quota); err != nil {
+				return err
+			}
+			day, dayStart, _, _ := quotaDay(quota, now)
+			if quota.Status.Day > day {
+				return nil
+			}
+			if quota.Status.Day != day {
+				quota.Status.Day = day
+				quota.Status.ReleasedSecondsToday = 0
+			}
+			quota.Status.ReleasedSecondsToday += secondsSince(claimedAt, dayStart, now)
+			return c.Status().Update(ctx, quota)
+		})
+		if client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("quota %s: %w", quota.Name, err)
+		}
+	}
+	return nil
+}
+
+// secondsSince returns the whole seconds from `since`, or the start of the day if that was later, until `now`.
+func secondsSince(since, dayStart, now time.Time) int64 {
+	if since.Before(dayStart) {
+		since = dayStart
+	}
+	if seconds := int64(now.Sub(since) / time.Second); seconds > 0 {
+		return seconds
+	}
+	return 0
+}
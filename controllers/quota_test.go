@@ -0,0 +1,215 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+func int64Ptr(i int64) *int64 { return &i }
+
+// claimedScalablePod returns a ScalablePod the caller claimed at the given time.
+func claimedScalablePod(name, caller string, claimedAt time.Time) *scalablev1.ScalablePod {
+	active := scalablev1.SPActive
+	return &scalablev1.ScalablePod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       scalablev1.ScalablePodSpec{MaxActiveTimeSec: 3600},
+		Status: scalablev1.ScalablePodStatus{
+			Status: &active, Requested: true, ClaimID: name + "-claim", ClaimedBy: caller,
+			RequestedAt: &metav1.Time{Time: claimedAt}, StartedAt: metav1.NewTime(claimedAt),
+		},
+	}
+}
+
+func newQuotaClient(t *testing.T, objs ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+func TestQuotaUsage(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	quota := &scalablev1.ScalablePodQuota{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "team-a"},
+		Spec:       scalablev1.ScalablePodQuotaSpec{Callers: []string{"team-a"}, MaxActive: int32Ptr(2), MaxActiveSecondsPerDay: int64Ptr(4 * 3600)},
+		Status:     scalablev1.ScalablePodQuotaStatus{Day: "2021-09-06", ReleasedSecondsToday: 600},
+	}
+	// Claimed yesterday, so only counted since midnight, and kept by renewing its lease
+	renewed := claimedScalablePod("sp2", "team-a", now.Add(-12*time.Hour))
+	renewed.Status.LeaseRenewedAt = &metav1.Time{Time: now.Add(-10 * time.Minute)}
+	scalablePods := []scalablev1.ScalablePod{
+		*claimedScalablePod("sp1", "team-a", now.Add(-30*time.Minute)),
+		*renewed,
+		*claimedScalablePod("sp3", "team-b", now.Add(-time.Hour)),
+	}
+
+	usage, err := usageOf(quota, scalablePods, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.active != 2 || usage.activeSeconds != 600+1800+9*3600 {
+		t.Errorf("expected 2 active claims and %d seconds, got %d and %d", 600+1800+9*3600, usage.active, usage.activeSeconds)
+	}
+	reason, retryAfter := usage.exceeded(quota, now)
+	if reason == "" || retryAfter != 15*time.Hour {
+		t.Errorf("expected the daily limit to be reached until midnight, got %q, %s", reason, retryAfter)
+	}
+
+	quota.Spec.MaxActiveSecondsPerDay = nil
+	reason, retryAfter = usage.exceeded(quota, now)
+	if reason == "" || retryAfter != 30*time.Minute {
+		t.Errorf("expected the active limit to be reached until the first claim expires, got %q, %s", reason, retryAfter)
+	}
+
+	// Yesterday's released time no longer counts
+	quota.Status.Day = "2021-09-05"
+	if usage, _ := usageOf(quota, scalablePods[:1], nil, now); usage.activeSeconds != 1800 {
+		t.Errorf("expected only today's seconds, got %d", usage.activeSeconds)
+	}
+	if reason, _ := usage.exceeded(&scalablev1.ScalablePodQuota{}, now); reason != "" {
+		t.Errorf("expected a quota without limits to have room, got %q", reason)
+	}
+}
+
+func TestQuotaUsageExpiresByClass(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	quota := &scalablev1.ScalablePodQuota{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "everyone"},
+		Spec:       scalablev1.ScalablePodQuotaSpec{MaxActive: int32Ptr(2)},
+	}
+	// Held to 20 minutes by its class
+	limited := claimedScalablePod("sp1", "team-a", now.Add(-15*time.Minute))
+	limited.Spec.ClassName = "short"
+	// Sets no maxActiveTimeSec and its class is gone, so it has the built-in default
+	unset := claimedScalablePod("sp2", "team-a", now.Add(-50*time.Minute))
+	unset.Spec.ClassName = "deleted"
+	unset.Spec.MaxActiveTimeSec = 0
+	classes := map[string]*scalablev1.ScalablePodClass{"short": {
+		ObjectMeta: metav1.ObjectMeta{Name: "short"},
+		Spec:       scalablev1.ScalablePodClassSpec{ActiveTimeLimits: &scalablev1.ActiveTimeLimits{MaxSec: 1200}},
+	}}
+
+	usage, _ := usageOf(quota, []scalablev1.ScalablePod{*unset}, classes, now)
+	if _, retryAfter := usage.exceeded(&scalablev1.ScalablePodQuota{Spec: scalablev1.ScalablePodQuotaSpec{MaxActive: int32Ptr(1)}}, now); retryAfter != 10*time.Minute {
+		t.Errorf("expected the built-in maxActiveTimeSec, got a retry after %s", retryAfter)
+	}
+	usage, _ = usageOf(quota, []scalablev1.ScalablePod{*limited, *unset}, classes, now)
+	if _, retryAfter := usage.exceeded(quota, now); retryAfter != 5*time.Minute {
+		t.Errorf("expected the class's limit to end the first claim, got a retry after %s", retryAfter)
+	}
+}
+
+func TestQuotaDayInTimeZone(t *testing.T) {
+	quota := &scalablev1.ScalablePodQuota{Spec: scalablev1.ScalablePodQuotaSpec{TimeZone: "America/New_York"}}
+	day, start, end, err := quotaDay(quota, time.Date(2021, 9, 7, 2, 0, 0, 0, time.UTC))
+	if err != nil || day != "2021-09-06" || end.Sub(start) != 24*time.Hour || start.UTC() != time.Date(2021, 9, 6, 4, 0, 0, 0, time.UTC) {
+		t.Errorf("expected the 6th in New York, got %s from %s to %s, %v", day, start, end, err)
+	}
+	quota.Spec.TimeZone = "Nowhere/Special"
+	if day, _, _, err := quotaDay(quota, time.Date(2021, 9, 7, 2, 0, 0, 0, time.UTC)); err == nil || day != "2021-09-07" {
+		t.Errorf("expected an unknown time zone to fall back to UTC with an error, got %s, %v", day, err)
+	}
+}
+
+func TestQuotaChecksAndCharges(t *testing.T) {
+	now := time.Date(2021, 9, 6, 12, 0, 0, 0, time.UTC)
+	c := newQuotaClient(t,
+		&scalablev1.ScalablePodQuota{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "everyone"},
+			Spec:       scalablev1.ScalablePodQuotaSpec{MaxActive: int32Ptr(3)},
+		},
+		&scalablev1.ScalablePodQuota{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "team-a"},
+			Spec:       scalablev1.ScalablePodQuotaSpec{Callers: []string{"team-a"}, MaxActive: int32Ptr(1)},
+		},
+		claimedScalablePod("sp1", "team-a", now.Add(-time.Minute)),
+	)
+
+	denial, err := CheckQuotas(context.Background(), c, "default", "team-a", now)
+	if err != nil || denial == nil || denial.Quota != "team-a" || denial.RetryAfter != 59*time.Minute {
+		t.Errorf("expected team-a's own quota to refuse it, got %+v, %v", denial, err)
+	}
+	if denial, err := CheckQuotas(context.Background(), c, "default", "team-b", now); err != nil || denial != nil {
+		t.Errorf("expected room for team-b, got %+v, %v", denial, err)
+	}
+	if denial, err := CheckQuotas(context.Background(), c, "other", "team-a", now); err != nil || denial != nil {
+		t.Errorf("expected no quota in another namespace, got %+v, %v", denial, err)
+	}
+
+	if err := chargeQuotas(context.Background(), c, "default", "team-a", now.Add(-90*time.Second), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := chargeQuotas(context.Background(), c, "default", "team-b", now.Add(-30*time.Second), now); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]int64{"everyone": 120, "team-a": 90} {
+		var quota scalablev1.ScalablePodQuota
+		if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: name}, &quota); err != nil {
+			t.Fatal(err)
+		}
+		if quota.Status.ReleasedSecondsToday != expected {
+			t.Errorf("expected %s to be charged %d seconds, got %d", name, expected, quota.Status.ReleasedSecondsToday)
+		}
+	}
+}
+
+func TestQuotaReconcile(t *testing.T) {
+	now := time.Date(2021, 9, 6, 23, 0, 0, 0, time.UTC)
+	key := types.NamespacedName{Namespace: "default", Name: "team-a"}
+	c := newQuotaClient(t,
+		&scalablev1.ScalablePodQuota{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+			Spec:       scalablev1.ScalablePodQuotaSpec{MaxActive: int32Ptr(1)},
+			Status:     scalablev1.ScalablePodQuotaStatus{Day: "2021-09-05", ReleasedSecondsToday: 3600},
+		},
+		claimedScalablePod("sp1", "team-a", now.Add(-10*time.Minute)),
+	)
+	r := &ScalablePodQuotaReconciler{Client: c, Clock: clock.NewFakeClock(now)}
+
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != quotaResync {
+		t.Errorf("expected usage to be kept current while claims are active, got %s", result.RequeueAfter)
+	}
+	var quota scalablev1.ScalablePodQuota
+	if err := c.Get(context.Background(), key, &quota); err != nil {
+		t.Fatal(err)
+	}
+	status := quota.Status
+	if status.Day != "2021-09-06" || status.ReleasedSecondsToday != 0 || status.Active != 1 || status.ActiveSecondsToday != 600 || status.Exceeded == "" {
+		t.Errorf("expected a fresh day with one claim filling the quota, got %+v", status)
+	}
+	if requests := r.quotasOf(claimedScalablePod("sp2", "team-b", now)); len(requests) != 1 || requests[0].NamespacedName != key {
+		t.Errorf("expected ScalablePod changes to reach the quota, got %v", requests)
+	}
+}
@@ -19,16 +19,25 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/audit"
+	"github.com/edwmorgan/k8s-operator-example/tracing"
 	"github.com/google/uuid"
 	corev1 "k8s.io/api/core/v1"
 )
@@ -36,68 +45,162 @@ import (
 // ScalablePodReconciler reconciles a ScalablePod object
 type ScalablePodReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepods,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepods/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepods/finalizers,verbs=update
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodclasses,verbs=get;list;watch
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods/status,verbs=get
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 func (r *ScalablePodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("scalablepod", req.Name)
+	ctx = ctrl.LoggerInto(ctx, log)
 	var scalablePod scalablev1.ScalablePod
 	if err := r.Get(ctx, req.NamespacedName, &scalablePod); err != nil {
-		log.Println("Unable to find ScalablePod")
+		if client.IgnoreNotFound(err) != nil {
+			log.Error(err, "Unable to get ScalablePod")
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	log.Printf("Reconciling ScalablePod `%s`\n", scalablePod.Name)
+	if scalablePod.Status.ClaimID != "" {
+		log = log.WithValues("claimID", scalablePod.Status.ClaimID)
+		ctx = ctrl.LoggerInto(ctx, log)
+	}
+
+	// Link to the request that claimed the ScalablePod, as the reconcile isn't part of its trace
+	ctx, span := tracing.Tracer().Start(ctx, "Reconcile ScalablePod", trace.WithLinks(tracing.Link(&scalablePod)...),
+		trace.WithAttributes(attribute.String("scalablepod", req.Name), attribute.String("namespace", req.Namespace)))
+	result, err := r.reconcileState(&scalablePod, ctx)
+	tracing.End(span, err)
+	return result, err
+}
+
+// reconcileState moves the ScalablePod on from its current state.
+func (r *ScalablePodReconciler) reconcileState(scalablePod *scalablev1.ScalablePod, ctx context.Context) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	log.V(1).Info("Reconciling ScalablePod")
 	switch {
 	// If the SP was just added, it won't have a Status
 	case scalablePod.Status.Status == nil:
-		log.Printf("ScalablePod %s/%s is new. Initializing...\n", scalablePod.Namespace, scalablePod.Name)
+		log.Info("ScalablePod is new, initializing")
 		scalablePod.Status.Status = new(scalablev1.SPStatus)
 		*scalablePod.Status.Status = scalablev1.SPInactive
-		if err := r.Status().Update(ctx, &scalablePod); err != nil {
-			log.Println("Unable to update ScalablePod status")
+		if err := r.updateStatus(scalablePod, ctx); err != nil {
 			return ctrl.Result{Requeue: true}, err
 		}
 	case *scalablePod.Status.Status == scalablev1.SPInactive:
-		log.Printf("State: %s\n", scalablev1.SPInactive)
 		if scalablePod.Status.Requested { // If someone has requested a ScalablePod, spin one up
-			err := r.startAndBindPodTo(&scalablePod, ctx)
+			if scalablePod.Status.Warm {
+				r.Recorder.Eventf(scalablePod, corev1.EventTypeNormal, ReasonRequested, "Pre-warming for pool %s", scalablePod.Labels[scalablev1.PoolLabel])
+			} else {
+				r.Recorder.Event(scalablePod, corev1.EventTypeNormal, ReasonRequested, "Starting a pod for a request")
+			}
+			// The class may have been deleted since the ScalablePod was claimed, which leaves it to its own settings if
+			// it names its own image
+			class, err := r.classOf(scalablePod, ctx)
+			if apierrors.IsNotFound(err) && scalablePod.Spec.PodImageName != "" {
+				r.reportClassMissing(scalablePod)
+				err = nil
+			}
+			if err == nil {
+				err = r.startAndBindPodTo(scalablePod, class, ctx)
+			}
 			if err != nil {
-				log.Println("Unable to bind new pod to ScalablePod")
+				podCreateFailures.WithLabelValues(poolLabels(scalablePod)...).Inc()
+				r.Recorder.Eventf(scalablePod, corev1.EventTypeWarning, ReasonPodCreateFailed, "Unable to create pod: %v", err)
+				log.Error(err, "Unable to bind new pod to ScalablePod")
 				return ctrl.Result{Requeue: true}, err
 			}
-			log.Printf("ScalablePod Pod namespaced name after startAndBindPodTo: `%s/%s`", scalablePod.Status.BoundPod.Namespace, scalablePod.Status.BoundPod.Name)
+			log.Info("Bound new pod to ScalablePod", "pod", scalablePod.Status.BoundPod.Name, "podNamespace", scalablePod.Status.BoundPod.Namespace, "warm", scalablePod.Status.Warm)
+			r.Recorder.Eventf(scalablePod, corev1.EventTypeNormal, ReasonPodCreated, "Created pod %s/%s", scalablePod.Status.BoundPod.Namespace, scalablePod.Status.BoundPod.Name)
 			*scalablePod.Status.Status = scalablev1.SPActive
-			if err = r.Status().Update(ctx, &scalablePod); err != nil {
-				log.Println("Unable to update ScalablePod status")
+			if err = r.updateStatus(scalablePod, ctx); err != nil {
 				return ctrl.Result{Requeue: true}, err
 			}
-			shutdownDuration, _ := time.ParseDuration(fmt.Sprintf("%ds", scalablePod.Spec.MaxActiveTimeSec))
-			return ctrl.Result{RequeueAfter: shutdownDuration}, nil
+			activations.WithLabelValues(poolLabels(scalablePod)...).Inc()
+			audit.Record(audit.ForScalablePod(audit.TypeActivation, scalablePod))
+			if scalablePod.Status.Warm { // Warm ScalablePods don't expire until they're claimed, unless they're idle too long
+				return ctrl.Result{RequeueAfter: idleTimeout(class)}, nil
+			}
+			return ctrl.Result{RequeueAfter: scalablePod.ActiveTime(class)}, nil
 		}
 	case *scalablePod.Status.Status == scalablev1.SPActive:
-		log.Printf("State: %s\n", scalablev1.SPActive)
-		shutdownDuration, _ := time.ParseDuration(fmt.Sprintf("%ds", scalablePod.Spec.MaxActiveTimeSec))
-		shutdownTime := scalablePod.Status.StartedAt.Add(shutdownDuration)
-		if shutdownTime.Before(metav1.Now().Time) { // We need to spin down this ScalablePod
-			err := r.deleteBoundPod(&scalablePod, ctx)
-			if err != nil {
-				log.Println("Unable to delete bound pod")
+		if !scalablePod.Status.Requested { // The ScalablePod was released before its TTL expired
+			log.Info("ScalablePod was released")
+			r.Recorder.Event(scalablePod, corev1.EventTypeNormal, ReasonReleased, "Released, deleting pod")
+			return r.deactivate(scalablePod, DeactivationReleased, ctx)
+		}
+		pod, err := r.boundPod(scalablePod, ctx)
+		if err != nil {
+			log.Error(err, "Unable to get bound pod")
+			return ctrl.Result{Requeue: true}, err
+		}
+		if preempted(scalablePod, pod) {
+			log.Info("Bound pod was preempted", "pod", scalablePod.Status.BoundPod.Name)
+			r.Recorder.Eventf(scalablePod, corev1.EventTypeWarning, ReasonPreempted, "Pod %s/%s was deleted or evicted", scalablePod.Status.BoundPod.Namespace, scalablePod.Status.BoundPod.Name)
+			return r.deactivate(scalablePod, DeactivationPreempted, ctx)
+		}
+		if scalablePod.Status.ReadyAt == nil && podReady(pod) {
+			log.Info("Bound pod is Ready", "pod", pod.Name)
+			scalablePod.Status.ReadyAt = &metav1.Time{Time: time.Now()}
+			if err = r.updateStatus(scalablePod, ctx); err != nil {
 				return ctrl.Result{Requeue: true}, err
 			}
-			scalablePod.Status.Requested = false
-			*scalablePod.Status.Status = scalablev1.SPInactive
-			log.Printf("Changing status to %s\n", scalablev1.SPInactive)
-			if err = r.Status().Update(ctx, &scalablePod); err != nil {
-				log.Println("Unable to update ScalablePod status")
-				return ctrl.Result{Requeue: true}, err
+			// Warm ScalablePods count from when they're claimed instead
+			if wait, ok := TimeToReady(scalablePod); ok && !scalablePod.Status.Warm {
+				timeToReady.WithLabelValues(poolLabels(scalablePod)...).Observe(wait.Seconds())
+				r.Recorder.Eventf(scalablePod, corev1.EventTypeNormal, ReasonPodReady, "Pod %s is Ready after %s", pod.Name, wait.Round(time.Millisecond))
+			} else {
+				r.Recorder.Eventf(scalablePod, corev1.EventTypeNormal, ReasonPodReady, "Pod %s is Ready", pod.Name)
+			}
+		}
+		// The class may have been deleted since the pod started, which leaves the ScalablePod to its own TTL, or the
+		// built-in one if it has none
+		class, err := r.classOf(scalablePod, ctx)
+		if apierrors.IsNotFound(err) {
+			if r.reportClassMissing(scalablePod) {
+				if err = r.updateStatus(scalablePod, ctx); err != nil {
+					return ctrl.Result{Requeue: true}, err
+				}
+			} else {
+				log.V(1).Info("ScalablePodClass not found", "class", scalablePod.Spec.ClassName)
+			}
+		} else if err != nil {
+			log.Error(err, "Unable to get ScalablePodClass", "class", scalablePod.Spec.ClassName)
+			return ctrl.Result{Requeue: true}, err
+		}
+		if scalablePod.Status.Warm { // Still waiting to be claimed
+			idle := idleTimeout(class)
+			if idle == 0 {
+				break
+			}
+			idleTime := scalablePod.Status.StartedAt.Add(idle)
+			if idleTime.Before(metav1.Now().Time) {
+				log.Info("Warm ScalablePod was idle", "idleTimeout", idle)
+				r.Recorder.Eventf(scalablePod, corev1.EventTypeNormal, ReasonIdle, "Warm for %s without being claimed, deleting pod", idle)
+				return r.deactivate(scalablePod, DeactivationIdle, ctx)
 			}
+			return ctrl.Result{RequeueAfter: time.Until(idleTime)}, nil
+		}
+		shutdownDuration := scalablePod.ActiveTime(class)
+		leaseStart := scalablePod.Status.StartedAt.Time
+		if renewedAt := scalablePod.Status.LeaseRenewedAt; renewedAt != nil && renewedAt.After(leaseStart) {
+			leaseStart = renewedAt.Time
+		}
+		shutdownTime := leaseStart.Add(shutdownDuration)
+		if shutdownTime.Before(metav1.Now().Time) { // We need to spin down this ScalablePod
+			log.Info("ScalablePod expired", "maxActiveTime", shutdownDuration)
+			r.Recorder.Eventf(scalablePod, corev1.EventTypeNormal, ReasonExpired, "Active for %s since its lease was last renewed, deleting pod", shutdownDuration)
+			return r.deactivate(scalablePod, DeactivationExpired, ctx)
 		}
+		// A warm ScalablePod's TTL starts when it is claimed, and renewing the lease extends it, so check back when it runs out
+		return ctrl.Result{RequeueAfter: time.Until(shutdownTime)}, nil
 	}
 	// Don't requeue
 	return ctrl.Result{}, nil
@@ -105,49 +208,289 @@ func (r *ScalablePodReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ScalablePodReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := registerUsageMetrics(mgr.GetClient()); err != nil {
+		return err
+	}
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &scalablev1.ScalablePod{}, ClaimIDField, func(obj client.Object) []string {
+		if claimID := obj.(*scalablev1.ScalablePod).Status.ClaimID; claimID != "" {
+			return []string{claimID}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = mgr.GetFieldIndexer().IndexField(context.Background(), &scalablev1.ScalablePod{}, IdempotencyKeyField, func(obj client.Object) []string {
+		if key := obj.(*scalablev1.ScalablePod).Status.IdempotencyKey; key != "" {
+			return []string{key}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&scalablev1.ScalablePod{}).
-		// Owns(&corev1.Pod{}).
+		// Bound pods are labelled rather than owned, as they can be in another namespace
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(boundScalablePodOf)).
 		Complete(r)
 }
 
-func (r *ScalablePodReconciler) deleteBoundPod(scalablePod *scalablev1.ScalablePod, ctx context.Context) error {
-	var pod corev1.Pod
-	r.Get(ctx, types.NamespacedName{Namespace: scalablePod.Status.BoundPod.Namespace, Name: scalablePod.Status.BoundPod.Name}, &pod)
-	log.Printf("Removing bound pod w/name `%s` from inactive ScalablePod\n", pod.Name)
-	err := r.Client.Delete(ctx, pod.DeepCopy())
+// ClaimIDField indexes ScalablePods by the claim ID in their status, for client.MatchingFields.
+const ClaimIDField = "status.claimID"
+
+// boundScalablePodOf maps a pod to the ScalablePod it is bound to, if any.
+func boundScalablePodOf(obj client.Object) []reconcile.Request {
+	name := obj.GetLabels()[scalablev1.ScalablePodNameLabel]
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetLabels()[scalablev1.ScalablePodNamespaceLabel], Name: name}}}
+}
+
+// Audit event types of the Deactivation reasons
+var auditTypes = map[string]string{
+	DeactivationExpired:   audit.TypeExpiry,
+	DeactivationReleased:  audit.TypeRelease,
+	DeactivationPreempted: audit.TypePreemption,
+	DeactivationIdle:      audit.TypeRelease,
+}
+
+// deactivate deletes the ScalablePod's bound pod and resets it to Inactive, for one of the Deactivation reasons.
+func (r *ScalablePodReconciler) deactivate(scalablePod *scalablev1.ScalablePod, reason string, ctx context.Context) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+	now := time.Now()
+	// Taken before the pod and claim are cleared from the status
+	event := audit.ForScalablePod(auditTypes[reason], scalablePod)
+	pod, err := r.boundPod(scalablePod, ctx)
+	usage := usageRecord(scalablePod, pod, reason, now)
+	activation := activationRecord(scalablePod, pod, reason, now)
+	if err == nil {
+		err = r.deleteBoundPod(scalablePod, pod, ctx)
+	}
 	if err != nil {
-		return err
+		log.Error(err, "Unable to delete bound pod")
+		r.Recorder.Eventf(scalablePod, corev1.EventTypeWarning, ReasonPodDeleteFailed, "Unable to delete pod: %v", err)
+		return ctrl.Result{Requeue: true}, err
+	}
+	// Written before the claim is cleared, so that it isn't lost if the operator stops in between. The usage
+	// controller charges the claim to quotas from it once the claim is cleared.
+	if err := r.Create(ctx, usage); err != nil && !apierrors.IsAlreadyExists(err) {
+		log.Error(err, "Unable to record usage", "activeSeconds", usage.Spec.ActiveSeconds, "claimedBy", usage.Spec.Claimant)
+		return ctrl.Result{Requeue: true}, err
+	}
+	scalablePod.Status.Requested = false
+	scalablePod.Status.Warm = false
+	scalablePod.Status.RequestedAt = nil
+	scalablePod.Status.ReadyAt = nil
+	scalablePod.Status.ClaimID = ""
+	scalablePod.Status.LeaseRenewedAt = nil
+	scalablePod.Status.ClaimedBy = ""
+	scalablePod.Status.IdempotencyKey = ""
+	scalablePod.Status.ClassMissing = false
+	scalablePod.Status.History = append(scalablePod.Status.History, activation)
+	if excess := len(scalablePod.Status.History) - scalablev1.ActivationHistoryLimit; excess > 0 {
+		scalablePod.Status.History = scalablePod.Status.History[excess:]
+	}
+	*scalablePod.Status.Status = scalablev1.SPInactive
+	log.Info("Deactivating ScalablePod", "reason", reason)
+	if err = r.updateStatus(scalablePod, ctx); err != nil {
+		return ctrl.Result{Requeue: true}, err
+	}
+	deactivations.WithLabelValues(append(poolLabels(scalablePod), reason)...).Inc()
+	audit.Record(event)
+	// The next claim, or pre-warm, shouldn't be linked to this one's trace
+	if _, ok := scalablePod.Annotations[scalablev1.TraceParentAnnotation]; ok {
+		patch := client.MergeFrom(scalablePod.DeepCopy())
+		delete(scalablePod.Annotations, scalablev1.TraceParentAnnotation)
+		if err := r.Patch(ctx, scalablePod, patch); err != nil {
+			log.Error(err, "Unable to remove trace annotation")
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// activationRecord returns the history entry of the ScalablePod's activation that is ending now, as its status stands
+// before it is deactivated.
+func activationRecord(scalablePod *scalablev1.ScalablePod, pod *corev1.Pod, reason string, now time.Time) scalablev1.ActivationRecord {
+	activation := scalablev1.ActivationRecord{
+		ClaimID:   scalablePod.Status.ClaimID,
+		ClaimedBy: scalablePod.Status.ClaimedBy,
+		StartedAt: scalablePod.Status.StartedAt,
+		EndedAt:   metav1.Time{Time: now},
+		Reason:    reason,
+	}
+	if scalablePod.Status.BoundPod != nil {
+		activation.Pod = scalablePod.Status.BoundPod.Name
+	}
+	if pod != nil {
+		for _, container := range pod.Status.ContainerStatuses {
+			if terminated := container.State.Terminated; terminated != nil {
+				exitCode := terminated.ExitCode
+				activation.ExitCode = &exitCode
+			} else if terminated := container.LastTerminationState.Terminated; terminated != nil {
+				exitCode := terminated.ExitCode
+				activation.ExitCode = &exitCode
+			}
+		}
+	}
+	return activation
+}
+
+// updateStatus writes the ScalablePod's status. Failures other than conflicts, which the requeue resolves, are recorded
+// as Events.
+func (r *ScalablePodReconciler) updateStatus(scalablePod *scalablev1.ScalablePod, ctx context.Context) error {
+	ctx, span := tracing.Tracer().Start(ctx, "UpdateStatus")
+	err := r.Status().Update(ctx, scalablePod)
+	tracing.End(span, err)
+	if err != nil {
+		if apierrors.IsConflict(err) {
+			ctrl.LoggerFrom(ctx).V(1).Info("ScalablePod changed while reconciling, retrying")
+		} else {
+			ctrl.LoggerFrom(ctx).Error(err, "Unable to update ScalablePod status")
+			r.Recorder.Eventf(scalablePod, corev1.EventTypeWarning, ReasonUpdateFailed, "Unable to update status: %v", err)
+		}
+	}
+	return err
+}
+
+// deleteBoundPod deletes the ScalablePod's bound pod, as returned by boundPod, and unbinds it.
+func (r *ScalablePodReconciler) deleteBoundPod(scalablePod *scalablev1.ScalablePod, pod *corev1.Pod, ctx context.Context) error {
+	if pod != nil {
+		ctrl.LoggerFrom(ctx).V(1).Info("Deleting bound pod", "pod", pod.Name)
+		ctx, span := tracing.Tracer().Start(ctx, "DeletePod", trace.WithAttributes(attribute.String("pod", pod.Name)))
+		err := client.IgnoreNotFound(r.Client.Delete(ctx, pod))
+		tracing.End(span, err)
+		if err != nil {
+			return err
+		}
 	}
 	scalablePod.Status.BoundPod = nil
 	return nil
 }
 
-func (r *ScalablePodReconciler) startAndBindPodTo(scalablePod *scalablev1.ScalablePod, ctx context.Context) error {
+// boundPod returns the ScalablePod's bound pod, or nil if it has none or the pod doesn't exist.
+func (r *ScalablePodReconciler) boundPod(scalablePod *scalablev1.ScalablePod, ctx context.Context) (*corev1.Pod, error) {
+	if scalablePod.Status.BoundPod == nil {
+		return nil, nil
+	}
+	var pod corev1.Pod
+	if err := r.Get(ctx, types.NamespacedName{Namespace: scalablePod.Status.BoundPod.Namespace, Name: scalablePod.Status.BoundPod.Name}, &pod); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return &pod, nil
+}
+
+// preempted reports whether an Active ScalablePod's bound pod has been deleted or evicted. A pod that is missing before
+// it was ever Ready may just not have reached the cache yet, so it only counts once the pod has been seen.
+func preempted(scalablePod *scalablev1.ScalablePod, pod *corev1.Pod) bool {
+	if pod == nil {
+		return scalablePod.Status.BoundPod != nil && scalablePod.Status.ReadyAt != nil
+	}
+	return pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodFailed
+}
+
+// podReady reports whether the pod has the Ready condition.
+func podReady(pod *corev1.Pod) bool {
+	if pod == nil {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// classOf returns the ScalablePodClass the ScalablePod names, or nil if it doesn't name one.
+func (r *ScalablePodReconciler) classOf(scalablePod *scalablev1.ScalablePod, ctx context.Context) (*scalablev1.ScalablePodClass, error) {
+	if scalablePod.Spec.ClassName == "" {
+		return nil, nil
+	}
+	var class scalablev1.ScalablePodClass
+	if err := r.Get(ctx, types.NamespacedName{Name: scalablePod.Spec.ClassName}, &class); err != nil {
+		return nil, err
+	}
+	return &class, nil
+}
+
+// reportClassMissing records a warning that the ScalablePod's class doesn't exist, once per activation. It returns
+// whether the status changed.
+func (r *ScalablePodReconciler) reportClassMissing(scalablePod *scalablev1.ScalablePod) bool {
+	if scalablePod.Status.ClassMissing {
+		return false
+	}
+	scalablePod.Status.ClassMissing = true
+	r.Recorder.Eventf(scalablePod, corev1.EventTypeWarning, ReasonClassMissing, "ScalablePodClass %s not found, using the ScalablePod's own settings", scalablePod.Spec.ClassName)
+	return true
+}
+
+// idleTimeout returns how long a warm ScalablePod of the class may wait to be claimed, or 0 if it may wait indefinitely.
+func idleTimeout(class *scalablev1.ScalablePodClass) time.Duration {
+	if class == nil || class.Spec.IdleTimeoutSec == nil {
+		return 0
+	}
+	return time.Duration(*class.Spec.IdleTimeoutSec) * time.Second
+}
+
+/* startAndBindPodTo creates the ScalablePod's pod and binds it. The ScalablePod's class, if it has one, fills in what
+ * its spec doesn't set, and then the built-in defaults, which covers ScalablePods created while the defaulting webhook
+ * was off. The class must be available in its namespace.
+ */
+func (r *ScalablePodReconciler) startAndBindPodTo(scalablePod *scalablev1.ScalablePod, class *scalablev1.ScalablePodClass, ctx context.Context) error {
+	resolved := scalablePod.DeepCopy()
+	if class != nil {
+		if !class.AllowsNamespace(scalablePod.Namespace) {
+			return fmt.Errorf("ScalablePodClass %s isn't available in namespace %s", class.Name, scalablePod.Namespace)
+		}
+		resolved.ApplyClass(class)
+	}
+	resolved.ApplyBuiltinDefaults()
+	spec := &resolved.Spec
 	podName := uuid.New().String()
+	container := corev1.Container{
+		Name:            "main",
+		Image:           fmt.Sprintf("%s:%s", spec.PodImageName, spec.PodImageTag),
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Command: []string{
+			"sleep",
+			"3600",
+		},
+	}
+	if resources := spec.Resources; resources != nil {
+		container.Resources = *resources.DeepCopy()
+	}
+	if securityContext := spec.SecurityContext; securityContext != nil {
+		container.SecurityContext = securityContext.DeepCopy()
+	}
+	if port := spec.Port; port != nil { // The workload serves requests itself
+		container.Command = nil
+		container.Ports = []corev1.ContainerPort{{Name: "http", ContainerPort: *port}}
+		container.ReadinessProbe = &corev1.Probe{
+			Handler:       corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(int(*port))}},
+			PeriodSeconds: 1,
+		}
+	}
 	pod := corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      podName,
 			Namespace: "default",
+			Labels: map[string]string{
+				scalablev1.ScalablePodNameLabel:      scalablePod.Name,
+				scalablev1.ScalablePodNamespaceLabel: scalablePod.Namespace,
+			},
 		},
 		Spec: corev1.PodSpec{
-			Containers: []corev1.Container{
-				{
-					Name:            "main",
-					Image:           fmt.Sprintf("%s:%s", scalablePod.Spec.PodImageName, scalablePod.Spec.PodImageTag),
-					ImagePullPolicy: corev1.PullIfNotPresent,
-					Command: []string{
-						"sleep",
-						"3600",
-					},
-				},
-			},
+			Containers: []corev1.Container{container},
 		},
 	}
 	// Create the Pod
-	log.Printf("Creating pod `%s`\n", pod.Name)
-	if err := r.Client.Create(ctx, &pod); err != nil {
-		log.Printf("Failed to create pod for requested ScalablePod `%s/%s`\n", scalablePod.Namespace, scalablePod.Name)
+	ctrl.LoggerFrom(ctx).V(1).Info("Creating pod", "pod", pod.Name)
+	ctx, span := tracing.Tracer().Start(ctx, "CreatePod", trace.WithAttributes(attribute.String("pod", pod.Name)))
+	err := r.Client.Create(ctx, &pod)
+	tracing.End(span, err)
+	if err != nil {
 		return err
 	}
 	scalablePod.Status.BoundPod = &scalablev1.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
@@ -0,0 +1,562 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/audit"
+	"github.com/edwmorgan/k8s-operator-example/tracing"
+)
+
+// failingCreates is a client that can't create anything.
+type failingCreates struct {
+	client.Client
+}
+
+func (c failingCreates) Create(context.Context, client.Object, ...client.CreateOption) error {
+	return errors.New("quota exceeded")
+}
+
+// newReconciler returns a ScalablePodReconciler for a single requested, Inactive ScalablePod.
+func newReconciler(t *testing.T) (*ScalablePodReconciler, *record.FakeRecorder, types.NamespacedName) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	inactive := scalablev1.SPInactive
+	sp := &scalablev1.ScalablePod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sp1"},
+		Spec:       scalablev1.ScalablePodSpec{MaxActiveTimeSec: 600},
+		Status:     scalablev1.ScalablePodStatus{Status: &inactive, Requested: true, RequestedAt: &metav1.Time{Time: time.Now()}},
+	}
+	recorder := record.NewFakeRecorder(10)
+	r := &ScalablePodReconciler{Client: fake.NewFakeClientWithScheme(scheme, sp), Scheme: scheme, Recorder: recorder}
+	return r, recorder, types.NamespacedName{Namespace: sp.Namespace, Name: sp.Name}
+}
+
+// reconcileEvents reconciles the ScalablePod and returns the reasons of the Events it recorded.
+func reconcileEvents(t *testing.T, r *ScalablePodReconciler, recorder *record.FakeRecorder, key types.NamespacedName) []string {
+	r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	var reasons []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			reasons = append(reasons, strings.Fields(event)[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+// update changes the ScalablePod's status.
+func update(t *testing.T, r *ScalablePodReconciler, key types.NamespacedName, change func(*scalablev1.ScalablePod)) {
+	var sp scalablev1.ScalablePod
+	if err := r.Get(context.Background(), key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	change(&sp)
+	if err := r.Status().Update(context.Background(), &sp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setBoundPod changes the ScalablePod's bound pod.
+func setBoundPod(t *testing.T, r *ScalablePodReconciler, key types.NamespacedName, change func(*corev1.Pod)) {
+	var sp scalablev1.ScalablePod
+	if err := r.Get(context.Background(), key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	var pod corev1.Pod
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: sp.Status.BoundPod.Namespace, Name: sp.Status.BoundPod.Name}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	change(&pod)
+	if err := r.Update(context.Background(), &pod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectReasons(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected events %v, got %v", expected, got)
+	}
+}
+
+func TestEventsThroughTTLExpiry(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonRequested, ReasonPodCreated)
+
+	setBoundPod(t, r, key, func(pod *corev1.Pod) {
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonPodReady)
+	expectReasons(t, reconcileEvents(t, r, recorder, key))
+
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.StartedAt = metav1.NewTime(time.Now().Add(-time.Hour))
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonExpired)
+}
+
+func TestLeaseRenewalDelaysExpiry(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	reconcileEvents(t, r, recorder, key)
+
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		renewedAt := metav1.Now()
+		sp.Status.StartedAt = metav1.NewTime(time.Now().Add(-time.Hour))
+		sp.Status.LeaseRenewedAt = &renewedAt
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key))
+
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		renewedAt := metav1.NewTime(time.Now().Add(-time.Hour))
+		sp.Status.LeaseRenewedAt = &renewedAt
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonExpired)
+
+	var sp scalablev1.ScalablePod
+	if err := r.Get(context.Background(), key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	if sp.Status.LeaseRenewedAt != nil {
+		t.Errorf("expected the lease to be cleared on deactivation, got %v", sp.Status.LeaseRenewedAt)
+	}
+}
+
+func TestEventsOnRelease(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	reconcileEvents(t, r, recorder, key)
+
+	update(t, r, key, func(sp *scalablev1.ScalablePod) { sp.Status.Requested = false })
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonReleased)
+}
+
+func TestEventsOnPreemption(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	reconcileEvents(t, r, recorder, key)
+
+	setBoundPod(t, r, key, func(pod *corev1.Pod) {
+		pod.Status.Phase = corev1.PodFailed
+		pod.Status.Reason = "Evicted"
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonPreempted)
+
+	var sp scalablev1.ScalablePod
+	if err := r.Get(context.Background(), key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	if *sp.Status.Status != scalablev1.SPInactive || sp.Status.BoundPod != nil {
+		t.Errorf("expected a preempted ScalablePod to be deactivated, got %+v", sp.Status)
+	}
+}
+
+func TestEventsOnPodCreateFailure(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	r.Client = failingCreates{r.Client}
+
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonRequested, ReasonPodCreateFailed)
+}
+
+func TestReconcileLinksToClaim(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	r, _, key := newReconciler(t)
+
+	ctx, claim := tracing.Tracer().Start(context.Background(), "Claim ScalablePod")
+	var sp scalablev1.ScalablePod
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	tracing.Annotate(ctx, &sp)
+	if err := r.Update(ctx, &sp); err != nil {
+		t.Fatal(err)
+	}
+	claim.End()
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	reconcile, ok := spans["Reconcile ScalablePod"]
+	if !ok {
+		t.Fatalf("expected a reconcile span, got %v", spans)
+	}
+	if links := reconcile.Links(); len(links) != 1 || links[0].SpanContext.SpanID() != claim.SpanContext().SpanID() {
+		t.Errorf("expected the reconcile to link to the claim, got %+v", links)
+	}
+	for _, name := range []string{"CreatePod", "UpdateStatus"} {
+		if span, ok := spans[name]; !ok || span.Parent().SpanID() != reconcile.SpanContext().SpanID() {
+			t.Errorf("expected a %s span within the reconcile, got %v", name, spans)
+		}
+	}
+}
+
+func TestReconcileAuditsClaimedPod(t *testing.T) {
+	var buffer bytes.Buffer
+	audit.SetSink(audit.NewJSONLinesSink(&buffer))
+	defer audit.SetSink(nil)
+	r, recorder, key := newReconciler(t)
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.ClaimID = "claim-1"
+		sp.Status.ClaimedBy = "alice"
+	})
+	reconcileEvents(t, r, recorder, key)
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.StartedAt = metav1.NewTime(time.Now().Add(-time.Hour))
+	})
+	reconcileEvents(t, r, recorder, key)
+
+	var events []audit.Event
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var event audit.Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 || events[0].Type != audit.TypeActivation || events[1].Type != audit.TypeExpiry {
+		t.Fatalf("expected the activation and expiry to be audited, got %+v", events)
+	}
+	for _, event := range events {
+		if event.Caller != "alice" || event.ClaimID != "claim-1" || event.Pod == "" || event.Pod != events[0].Pod {
+			t.Errorf("expected the claim and its pod to be audited, got %+v", event)
+		}
+	}
+}
+
+func TestReconcileRecordsUsage(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	var sp scalablev1.ScalablePod
+	if err := r.Get(context.Background(), key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	sp.Labels = map[string]string{scalablev1.PoolLabel: "web"}
+	sp.Spec.Resources = &corev1.ResourceRequirements{Requests: corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("500m"),
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+	}}
+	if err := r.Update(context.Background(), &sp); err != nil {
+		t.Fatal(err)
+	}
+	claimedAt := time.Now().Add(-time.Hour)
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.ClaimID = "claim-1"
+		sp.Status.ClaimedBy = "alice"
+		sp.Status.RequestedAt = &metav1.Time{Time: claimedAt}
+	})
+	reconcileEvents(t, r, recorder, key)
+	var pod *corev1.Pod
+	setBoundPod(t, r, key, func(p *corev1.Pod) { pod = p })
+	if requests := pod.Spec.Containers[0].Resources.Requests; requests.Cpu().String() != "500m" {
+		t.Errorf("expected the pod to request the ScalablePod's resources, got %v", requests)
+	}
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.StartedAt = metav1.NewTime(claimedAt)
+	})
+	reconcileEvents(t, r, recorder, key)
+
+	var usages scalablev1.ScalablePodUsageList
+	if err := r.List(context.Background(), &usages); err != nil {
+		t.Fatal(err)
+	}
+	if len(usages.Items) != 1 {
+		t.Fatalf("expected the expiry to record the usage, got %+v", usages.Items)
+	}
+	usage := usages.Items[0]
+	if usage.Namespace != "default" || usage.Labels[scalablev1.PoolLabel] != "web" || usage.Labels[scalablev1.ScalablePodNameLabel] != "sp1" {
+		t.Errorf("expected the usage to be labelled with its ScalablePod and pool, got %+v", usage.ObjectMeta)
+	}
+	spec := usage.Spec
+	if spec.ScalablePod != "sp1" || spec.Pool != "web" || spec.Claimant != "alice" || spec.ClaimID != "claim-1" || spec.Reason != DeactivationExpired ||
+		spec.Pod == nil || spec.Pod.Name != pod.Name {
+		t.Errorf("expected the claim to be recorded, got %+v", spec)
+	}
+	if spec.ActiveSeconds < 3599 || spec.ActiveSeconds > 3605 || spec.EndedAt.Sub(spec.StartedAt.Time) < 59*time.Minute {
+		t.Errorf("expected the hour since the claim to be recorded, got %d seconds from %s to %s", spec.ActiveSeconds, spec.StartedAt, spec.EndedAt)
+	}
+	if spec.Requests.Cpu().String() != "500m" || spec.Requests.Memory().String() != "1Gi" {
+		t.Errorf("expected the pod's requests to be recorded, got %v", spec.Requests)
+	}
+}
+
+func TestReconcileKeepsActivationHistory(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.ClaimID = "claim-0"
+		sp.Status.ClaimedBy = "alice"
+	})
+	reconcileEvents(t, r, recorder, key)
+	setBoundPod(t, r, key, func(pod *corev1.Pod) {
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "main",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 137}},
+		}}
+	})
+	update(t, r, key, func(sp *scalablev1.ScalablePod) { sp.Status.Requested = false })
+	reconcileEvents(t, r, recorder, key)
+
+	var sp scalablev1.ScalablePod
+	if err := r.Get(context.Background(), key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	if len(sp.Status.History) != 1 {
+		t.Fatalf("expected the activation to be kept, got %+v", sp.Status.History)
+	}
+	activation := sp.Status.History[0]
+	if activation.ClaimID != "claim-0" || activation.ClaimedBy != "alice" || activation.Pod == "" || activation.Reason != DeactivationReleased ||
+		activation.StartedAt.IsZero() || activation.EndedAt.IsZero() || activation.ExitCode == nil || *activation.ExitCode != 137 {
+		t.Errorf("expected the claim, pod, times, reason and exit code, got %+v", activation)
+	}
+
+	for i := 1; i <= scalablev1.ActivationHistoryLimit+2; i++ {
+		update(t, r, key, func(sp *scalablev1.ScalablePod) {
+			sp.Status.Requested = true
+			sp.Status.RequestedAt = &metav1.Time{Time: time.Now()}
+			sp.Status.ClaimID = fmt.Sprintf("claim-%d", i)
+		})
+		reconcileEvents(t, r, recorder, key)
+		update(t, r, key, func(sp *scalablev1.ScalablePod) { sp.Status.Requested = false })
+		reconcileEvents(t, r, recorder, key)
+	}
+	if err := r.Get(context.Background(), key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	history := sp.Status.History
+	if len(history) != scalablev1.ActivationHistoryLimit || history[0].ClaimID != "claim-3" || history[len(history)-1].ClaimID != "claim-12" {
+		t.Errorf("expected only the latest activations to be kept, oldest first, got %+v", history)
+	}
+}
+
+func TestReconcileResolvesClass(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	ctx := context.Background()
+	var sp scalablev1.ScalablePod
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	sp.Spec.ClassName = "web"
+	if err := r.Update(ctx, &sp); err != nil {
+		t.Fatal(err)
+	}
+
+	// The class doesn't exist yet
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonRequested, ReasonPodCreateFailed)
+
+	class := &scalablev1.ScalablePodClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec: scalablev1.ScalablePodClassSpec{
+			Defaults: scalablev1.ScalablePodClassDefaults{
+				PodImageName:        "nginx",
+				ScalablePodDefaults: scalablev1.ScalablePodDefaults{PodImageTag: "1.21"},
+			},
+			ActiveTimeLimits:  &scalablev1.ActiveTimeLimits{MaxSec: 60},
+			AllowedNamespaces: []string{"team-a"},
+		},
+	}
+	if err := r.Create(ctx, class); err != nil {
+		t.Fatal(err)
+	}
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonRequested, ReasonPodCreateFailed)
+
+	class.Spec.AllowedNamespaces = append(class.Spec.AllowedNamespaces, "default")
+	if err := r.Update(ctx, class); err != nil {
+		t.Fatal(err)
+	}
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != time.Minute {
+		t.Errorf("expected the TTL to be held to the class's limit, got %+v", result)
+	}
+	drainEvents(recorder)
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	var pod corev1.Pod
+	if err := r.Get(ctx, types.NamespacedName{Namespace: sp.Status.BoundPod.Namespace, Name: sp.Status.BoundPod.Name}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if image := pod.Spec.Containers[0].Image; image != "nginx:1.21" {
+		t.Errorf("expected the pod to run the class's image, got %s", image)
+	}
+	if sp.Spec.PodImageName != "" {
+		t.Errorf("expected the ScalablePod's spec to be left alone, got %+v", sp.Spec)
+	}
+
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.StartedAt = metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonExpired)
+}
+
+func TestReconcileWithoutClass(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	ctx := context.Background()
+	var sp scalablev1.ScalablePod
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	// As if created while the defaulting webhook was off
+	sp.Spec.ClassName = "web"
+	sp.Spec.MaxActiveTimeSec = 0
+	if err := r.Update(ctx, &sp); err != nil {
+		t.Fatal(err)
+	}
+	class := &scalablev1.ScalablePodClass{ObjectMeta: metav1.ObjectMeta{Name: "web"}}
+	if err := r.Create(ctx, class); err != nil {
+		t.Fatal(err)
+	}
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != time.Hour {
+		t.Errorf("expected the built-in TTL without one from the ScalablePod or its class, got %+v", result)
+	}
+	drainEvents(recorder)
+
+	if err := r.Delete(ctx, class); err != nil {
+		t.Fatal(err)
+	}
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.StartedAt = metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonClassMissing)
+	// Only reported once per activation
+	expectReasons(t, reconcileEvents(t, r, recorder, key))
+}
+
+func TestReconcileClassDeletedBeforeClaim(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	ctx := context.Background()
+	var sp scalablev1.ScalablePod
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	sp.Spec.ClassName = "deleted"
+	sp.Spec.PodImageName = "nginx"
+	if err := r.Update(ctx, &sp); err != nil {
+		t.Fatal(err)
+	}
+
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonRequested, ReasonClassMissing, ReasonPodCreated)
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	if *sp.Status.Status != scalablev1.SPActive || !sp.Status.ClassMissing {
+		t.Fatalf("expected an Active ScalablePod with its class missing, got %+v", sp.Status)
+	}
+	var pod corev1.Pod
+	if err := r.Get(ctx, types.NamespacedName{Namespace: sp.Status.BoundPod.Namespace, Name: sp.Status.BoundPod.Name}, &pod); err != nil {
+		t.Fatal(err)
+	}
+	if image := pod.Spec.Containers[0].Image; image != "nginx:latest" {
+		t.Errorf("expected the built-in image tag, got %s", image)
+	}
+	expectReasons(t, reconcileEvents(t, r, recorder, key))
+}
+
+func TestReconcileRecyclesIdleWarmPods(t *testing.T) {
+	r, recorder, key := newReconciler(t)
+	ctx := context.Background()
+	idleTimeoutSec := int32(300)
+	if err := r.Create(ctx, &scalablev1.ScalablePodClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec:       scalablev1.ScalablePodClassSpec{IdleTimeoutSec: &idleTimeoutSec},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var sp scalablev1.ScalablePod
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	sp.Spec.ClassName = "web"
+	if err := r.Update(ctx, &sp); err != nil {
+		t.Fatal(err)
+	}
+	update(t, r, key, func(sp *scalablev1.ScalablePod) { sp.Status.Warm = true })
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	if err != nil || result.RequeueAfter != 5*time.Minute {
+		t.Errorf("expected a warm ScalablePod to be checked again at its idle timeout, got %+v, %v", result, err)
+	}
+	drainEvents(recorder)
+	expectReasons(t, reconcileEvents(t, r, recorder, key))
+
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.StartedAt = metav1.NewTime(time.Now().Add(-10 * time.Minute))
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key), ReasonIdle)
+	if err := r.Get(ctx, key, &sp); err != nil {
+		t.Fatal(err)
+	}
+	if *sp.Status.Status != scalablev1.SPInactive || sp.Status.History[0].Reason != DeactivationIdle {
+		t.Errorf("expected an idle warm ScalablePod to be deactivated, got %+v", sp.Status)
+	}
+
+	// A claimed ScalablePod isn't idle
+	update(t, r, key, func(sp *scalablev1.ScalablePod) { sp.Status.Requested = true })
+	reconcileEvents(t, r, recorder, key)
+	update(t, r, key, func(sp *scalablev1.ScalablePod) {
+		sp.Status.StartedAt = metav1.NewTime(time.Now().Add(-6 * time.Minute))
+	})
+	expectReasons(t, reconcileEvents(t, r, recorder, key))
+}
+
+// drainEvents discards the Events recorded so far.
+func drainEvents(recorder *record.FakeRecorder) {
+	for {
+		select {
+		case <-recorder.Events:
+		default:
+			return
+		}
+	}
+}
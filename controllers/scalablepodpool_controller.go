@@ -0,0 +1,227 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// ScalablePodPoolReconciler reconciles a ScalablePodPool object
+type ScalablePodPoolReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Clock the pool's schedules are evaluated against
+	Clock clock.Clock
+	// Forecaster predicts demand for pools with prediction enabled
+	Forecaster *DemandForecaster
+}
+
+// How often pools with prediction enabled are re-evaluated, as the forecast changes without any object changing
+const predictionResync = time.Minute
+
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodpools,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodpools/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodpools/finalizers,verbs=update
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodclasses,verbs=get;list;watch
+
+// Reconcile works out the pool's capacity from its schedules, pre-warms ScalablePods up to the warm minimum and
+// releases warm ScalablePods above it. Claimed ScalablePods are never released by the pool, even when a schedule
+// lowers the cap below the number in use; the cap only stops new activations.
+func (r *ScalablePodPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("pool", req.Name)
+	var pool scalablev1.ScalablePodPool
+	if err := r.Get(ctx, req.NamespacedName, &pool); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			log.Error(err, "Unable to get ScalablePodPool")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	spec, err := r.withClass(ctx, pool.Spec)
+	if err != nil {
+		log.Error(err, "Unable to get ScalablePodClass", "class", pool.Spec.ClassName)
+		return ctrl.Result{Requeue: true}, err
+	}
+	now := r.Clock.Now()
+	capacity, err := evaluateSchedules(spec, now)
+	pool.Status.ScheduleError = ""
+	if err != nil {
+		log.Error(err, "Unable to evaluate schedules")
+		pool.Status.ScheduleError = err.Error()
+	}
+	pool.Status.PredictedWarm = nil
+	if pool.Spec.Prediction != nil && r.Forecaster != nil {
+		predicted := predictedWarm(r.Forecaster, req.NamespacedName, pool.Spec.Prediction, now)
+		pool.Status.PredictedWarm = &predicted
+		if predicted > capacity.minWarm {
+			capacity.minWarm = predicted
+		}
+	}
+
+	var scalablePods scalablev1.ScalablePodList
+	if err := r.List(ctx, &scalablePods, client.InNamespace(pool.Namespace), client.MatchingLabels{scalablev1.PoolLabel: pool.Name}); err != nil {
+		log.Error(err, "Unable to list ScalablePods in pool")
+		return ctrl.Result{Requeue: true}, err
+	}
+	var active, warm int32
+	for _, sp := range scalablePods.Items {
+		if sp.Status.Requested {
+			active++
+			if sp.Status.Warm {
+				warm++
+			}
+		}
+	}
+
+	// Pre-warm Inactive ScalablePods until the warm minimum is met or the cap is reached
+	for i := range scalablePods.Items {
+		if warm >= capacity.minWarm || (capacity.maxActive != nil && active >= *capacity.maxActive) {
+			break
+		}
+		sp := &scalablePods.Items[i]
+		if sp.Status.Status == nil || *sp.Status.Status != scalablev1.SPInactive || sp.Status.Requested {
+			continue
+		}
+		log.Info("Pre-warming ScalablePod", "scalablepod", sp.Name)
+		sp.Status.Requested = true
+		sp.Status.Warm = true
+		sp.Status.RequestedAt = &metav1.Time{Time: now}
+		if err := r.Status().Update(ctx, sp); err != nil {
+			log.Error(err, "Unable to update ScalablePod status", "scalablepod", sp.Name)
+			return ctrl.Result{Requeue: true}, err
+		}
+		active++
+		warm++
+	}
+
+	// Release warm ScalablePods nobody has claimed once they are no longer needed
+	for i := range scalablePods.Items {
+		if warm <= capacity.minWarm {
+			break
+		}
+		sp := &scalablePods.Items[i]
+		if !sp.Status.Requested || !sp.Status.Warm {
+			continue
+		}
+		log.Info("Releasing warm ScalablePod", "scalablepod", sp.Name)
+		sp.Status.Requested = false
+		if err := r.Status().Update(ctx, sp); err != nil {
+			log.Error(err, "Unable to update ScalablePod status", "scalablepod", sp.Name)
+			return ctrl.Result{Requeue: true}, err
+		}
+		active--
+		warm--
+	}
+
+	pool.Status.ActiveSchedule = capacity.schedule
+	pool.Status.MinWarm = capacity.minWarm
+	pool.Status.MaxActive = capacity.maxActive
+	pool.Status.Active = active
+	pool.Status.Warm = warm
+	pool.Status.NextTransition = nil
+	if !capacity.next.IsZero() {
+		pool.Status.NextTransition = &metav1.Time{Time: capacity.next}
+	}
+	if err := r.Status().Update(ctx, &pool); err != nil {
+		log.Error(err, "Unable to update ScalablePodPool status")
+		return ctrl.Result{Requeue: true}, err
+	}
+	log.V(1).Info("Reconciled ScalablePodPool", "schedule", capacity.schedule, "minWarm", capacity.minWarm, "active", active, "warm", warm)
+
+	var requeueAfter time.Duration
+	if !capacity.next.IsZero() {
+		requeueAfter = capacity.next.Sub(now)
+	}
+	if pool.Status.PredictedWarm != nil && (requeueAfter == 0 || requeueAfter > predictionResync) {
+		requeueAfter = predictionResync
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// withClass returns the pool's spec with the warm pool settings of its class filled in where it doesn't set them. A
+// class that doesn't exist is ignored.
+func (r *ScalablePodPoolReconciler) withClass(ctx context.Context, spec scalablev1.ScalablePodPoolSpec) (scalablev1.ScalablePodPoolSpec, error) {
+	if spec.ClassName == "" {
+		return spec, nil
+	}
+	var class scalablev1.ScalablePodClass
+	if err := r.Get(ctx, types.NamespacedName{Name: spec.ClassName}, &class); err != nil {
+		return spec, client.IgnoreNotFound(err)
+	}
+	if warmPool := class.Spec.WarmPool; warmPool != nil {
+		if spec.MinWarm == nil {
+			minWarm := warmPool.MinWarm
+			spec.MinWarm = &minWarm
+		}
+		if spec.MaxActive == nil {
+			spec.MaxActive = warmPool.MaxActive
+		}
+	}
+	return spec, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ScalablePodPoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Clock == nil {
+		r.Clock = clock.RealClock{}
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&scalablev1.ScalablePodPool{}).
+		// Re-check the warm minimum whenever one of the pool's ScalablePods changes, e.g. when a warm one is claimed
+		Watches(&source.Kind{Type: &scalablev1.ScalablePod{}}, handler.EnqueueRequestsFromMapFunc(poolOf)).
+		// Pick up changes to the warm pool settings of the pools' classes
+		Watches(&source.Kind{Type: &scalablev1.ScalablePodClass{}}, handler.EnqueueRequestsFromMapFunc(r.poolsOfClass)).
+		Complete(r)
+}
+
+// poolOf maps a ScalablePod to the ScalablePodPool it is labelled with, if any.
+func poolOf(obj client.Object) []reconcile.Request {
+	pool := obj.GetLabels()[scalablev1.PoolLabel]
+	if pool == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: pool}}}
+}
+
+// poolsOfClass maps a ScalablePodClass to the ScalablePodPools that use it.
+func (r *ScalablePodPoolReconciler) poolsOfClass(obj client.Object) []reconcile.Request {
+	var pools scalablev1.ScalablePodPoolList
+	if err := r.List(context.Background(), &pools); err != nil {
+		ctrl.Log.WithName("pool").Error(err, "Unable to list ScalablePodPools", "class", obj.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, pool := range pools.Items {
+		if pool.Spec.ClassName == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: pool.Namespace, Name: pool.Name}})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// ScalablePodQuotaReconciler reconciles a ScalablePodQuota object
+type ScalablePodQuotaReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Clock days and active time are counted against
+	Clock clock.Clock
+}
+
+// How often the usage of quotas with active claims is brought up to date, as the active time grows without any
+// object changing
+const quotaResync = time.Minute
+
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodquotas,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodquotas/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodquotas/finalizers,verbs=update
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodclasses,verbs=get;list;watch
+
+// Reconcile reports the quota's usage in its status. The request server enforces the quota from the ScalablePods
+// themselves, so the status is for people to read, apart from the time released claims were active, which is only
+// kept there.
+func (r *ScalablePodQuotaReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("quota", req.Name)
+	var quota scalablev1.ScalablePodQuota
+	if err := r.Get(ctx, req.NamespacedName, &quota); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			log.Error(err, "Unable to get ScalablePodQuota")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	var scalablePods scalablev1.ScalablePodList
+	if err := r.List(ctx, &scalablePods, client.InNamespace(quota.Namespace)); err != nil {
+		log.Error(err, "Unable to list ScalablePods")
+		return ctrl.Result{Requeue: true}, err
+	}
+	classes, err := classesByName(ctx, r)
+	if err != nil {
+		log.Error(err, "Unable to list ScalablePodClasses")
+		return ctrl.Result{Requeue: true}, err
+	}
+
+	now := r.Clock.Now()
+	usage, err := usageOf(&quota, scalablePods.Items, classes, now)
+	quota.Status.TimeZoneError = ""
+	if err != nil {
+		log.Error(err, "Unable to load time zone")
+		quota.Status.TimeZoneError = err.Error()
+	}
+	if quota.Status.Day != usage.day {
+		quota.Status.Day = usage.day
+		quota.Status.ReleasedSecondsToday = 0
+	}
+	quota.Status.Active = usage.active
+	quota.Status.ActiveSecondsToday = usage.activeSeconds
+	quota.Status.Exceeded, _ = usage.exceeded(&quota, now)
+	quota.Status.UpdatedAt = &metav1.Time{Time: now}
+	if err := r.Status().Update(ctx, &quota); err != nil {
+		log.Error(err, "Unable to update ScalablePodQuota status")
+		return ctrl.Result{Requeue: true}, err
+	}
+	log.V(1).Info("Reconciled ScalablePodQuota", "active", usage.active, "activeSeconds", usage.activeSeconds, "exceeded", quota.Status.Exceeded)
+
+	// Start counting afresh when the day ends, and keep the active time current while claims are active
+	requeueAfter := usage.dayEnd.Sub(now)
+	if usage.active > 0 && requeueAfter > quotaResync {
+		requeueAfter = quotaResync
+	}
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ScalablePodQuotaReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Clock == nil {
+		r.Clock = clock.RealClock{}
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&scalablev1.ScalablePodQuota{}).
+		// Claims and releases change the usage of every quota in the namespace
+		Watches(&source.Kind{Type: &scalablev1.ScalablePod{}}, handler.EnqueueRequestsFromMapFunc(r.quotasOf)).
+		Complete(r)
+}
+
+// quotasOf maps a ScalablePod to the ScalablePodQuotas in its namespace.
+func (r *ScalablePodQuotaReconciler) quotasOf(obj client.Object) []reconcile.Request {
+	var quotas scalablev1.ScalablePodQuotaList
+	if err := r.List(context.Background(), &quotas, client.InNamespace(obj.GetNamespace())); err != nil {
+		ctrl.Log.WithName("quota").Error(err, "Unable to list ScalablePodQuotas", "namespace", obj.GetNamespace())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(quotas.Items))
+	for _, quota := range quotas.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: quota.Namespace, Name: quota.Name}})
+	}
+	return requests
+}
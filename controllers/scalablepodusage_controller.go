@@ -0,0 +1,190 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// ScalablePodUsageReconciler charges the claims ScalablePodUsage records show to quotas, and deletes the records once
+// they are older than the retention period.
+type ScalablePodUsageReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Clock the age of records is measured with
+	Clock clock.Clock
+	// How long records are kept after their usage ended. They are kept forever if it is zero.
+	Retention time.Duration
+}
+
+//+kubebuilder:rbac:groups=scalable.scalablepod.tutorial.io,resources=scalablepodusages,verbs=get;list;watch;create;patch;delete
+
+func (r *ScalablePodUsageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("usage", req.Name)
+	var usage scalablev1.ScalablePodUsage
+	if err := r.Get(ctx, req.NamespacedName, &usage); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			log.Error(err, "Unable to get ScalablePodUsage")
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if usage.Spec.ClaimID != "" && usage.Annotations[scalablev1.QuotaChargedAnnotation] == "" {
+		if result, err := r.chargeQuotas(ctx, &usage); err != nil || !result.IsZero() {
+			return result, err
+		}
+	}
+	if r.Retention == 0 {
+		return ctrl.Result{}, nil
+	}
+	if expires := usage.Spec.EndedAt.Add(r.Retention); r.Clock.Now().Before(expires) {
+		return ctrl.Result{RequeueAfter: expires.Sub(r.Clock.Now())}, nil
+	}
+	log.V(1).Info("Deleting expired ScalablePodUsage", "endedAt", usage.Spec.EndedAt)
+	if err := r.Delete(ctx, &usage); client.IgnoreNotFound(err) != nil {
+		log.Error(err, "Unable to delete ScalablePodUsage")
+		return ctrl.Result{Requeue: true}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+/* chargeQuotas adds the time a released claim was active to the quotas covering its claimant, so that it still counts
+ * once the ScalablePod no longer shows the claim, and marks the record charged so that it is only added once. Until
+ * the claim is gone from the ScalablePod's status, quotas count it from there, so it is charged after.
+ */
+func (r *ScalablePodUsageReconciler) chargeQuotas(ctx context.Context, usage *scalablev1.ScalablePodUsage) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx).WithValues("usage", usage.Name, "claimID", usage.Spec.ClaimID)
+	var sp scalablev1.ScalablePod
+	err := r.Get(ctx, types.NamespacedName{Namespace: usage.Namespace, Name: usage.Spec.ScalablePod}, &sp)
+	if client.IgnoreNotFound(err) != nil {
+		log.Error(err, "Unable to get ScalablePod")
+		return ctrl.Result{Requeue: true}, err
+	}
+	if err == nil && sp.Status.ClaimID == usage.Spec.ClaimID {
+		return ctrl.Result{RequeueAfter: time.Second}, nil
+	}
+	if err := chargeQuotas(ctx, r.Client, usage.Namespace, usage.Spec.Claimant, usage.Spec.StartedAt.Time, usage.Spec.EndedAt.Time); err != nil {
+		log.Error(err, "Unable to charge released claim to quotas")
+		return ctrl.Result{Requeue: true}, err
+	}
+	patch := client.MergeFrom(usage.DeepCopy())
+	if usage.Annotations == nil {
+		usage.Annotations = map[string]string{}
+	}
+	usage.Annotations[scalablev1.QuotaChargedAnnotation] = "true"
+	if err := r.Patch(ctx, usage, patch); err != nil {
+		log.Error(err, "Unable to mark ScalablePodUsage charged")
+		return ctrl.Result{Requeue: true}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ScalablePodUsageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if r.Clock == nil {
+		r.Clock = clock.RealClock{}
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&scalablev1.ScalablePodUsage{}).
+		Complete(r)
+}
+
+// usageRecord returns the record of a ScalablePod's usage that is ending now, as its status stands before it is
+// deactivated. A claimed ScalablePod's usage starts when it was claimed, as quotas count it. The time a warm
+// ScalablePod waited to be claimed isn't recorded at all, as claiming it resets status.startedAt, so it is billed to
+// neither its claimant nor its pool. The requests are read from the bound pod, or from
+// the ScalablePod's spec if the pod is gone.
+func usageRecord(sp *scalablev1.ScalablePod, pod *corev1.Pod, reason string, now time.Time) *scalablev1.ScalablePodUsage {
+	startedAt := sp.Status.StartedAt
+	if claimed(sp) {
+		startedAt = *sp.Status.RequestedAt
+	}
+	labels := map[string]string{scalablev1.ScalablePodNameLabel: sp.Name}
+	if pool := sp.Labels[scalablev1.PoolLabel]; pool != "" {
+		labels[scalablev1.PoolLabel] = pool
+	}
+	usage := &scalablev1.ScalablePodUsage{
+		ObjectMeta: metav1.ObjectMeta{Namespace: sp.Namespace, Name: usageName(sp, startedAt), Labels: labels},
+		Spec: scalablev1.ScalablePodUsageSpec{
+			ScalablePod:   sp.Name,
+			Pool:          sp.Labels[scalablev1.PoolLabel],
+			Claimant:      sp.Status.ClaimedBy,
+			ClaimID:       sp.Status.ClaimID,
+			StartedAt:     startedAt,
+			EndedAt:       metav1.Time{Time: now},
+			ActiveSeconds: secondsSince(startedAt.Time, time.Time{}, now),
+			Reason:        reason,
+		},
+	}
+	if sp.Status.BoundPod != nil {
+		boundPod := *sp.Status.BoundPod
+		usage.Spec.Pod = &boundPod
+	}
+	if pod != nil {
+		usage.Spec.Requests = podRequests(pod)
+	} else if resources := sp.Spec.Resources; resources != nil && len(resources.Requests) > 0 {
+		usage.Spec.Requests = resources.Requests.DeepCopy()
+	}
+	return usage
+}
+
+// usageName names the record of the ScalablePod's usage from startedAt after the usage, so that a deactivation that is
+// retried once its record was written finds the record there rather than writing another.
+func usageName(sp *scalablev1.ScalablePod, startedAt metav1.Time) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%d", sp.UID, sp.Status.ClaimID, startedAt.Unix())))
+	name := sp.Name
+	if max := validation.DNS1123SubdomainMaxLength - 17; len(name) > max {
+		name = strings.TrimRight(name[:max], ".-")
+	}
+	return fmt.Sprintf("%s-%x", name, sum[:8])
+}
+
+// podRequests adds up the resources the pod's containers request.
+func podRequests(pod *corev1.Pod) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		for name, quantity := range container.Resources.Requests {
+			total := requests[name]
+			total.Add(quantity)
+			requests[name] = total
+		}
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	return requests
+}
+
+// resourceSeconds returns the quantity held for the number of seconds, e.g. CPU-seconds for a CPU request.
+func resourceSeconds(quantity resource.Quantity, seconds int64) float64 {
+	return float64(quantity.MilliValue()) / 1000 * float64(seconds)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// poolCapacity is the warm minimum and active cap a ScalablePodPool is held to at a point in time.
+type poolCapacity struct {
+	// Name of the open schedule, empty if none is open
+	schedule  string
+	minWarm   int32
+	maxActive *int32
+	// When any schedule next opens or closes; zero if none ever will
+	next time.Time
+}
+
+// evaluateSchedules works out which of the pool's schedules is open at `now`. A schedule's window is open when
+// its End fires before its Start does next. Schedules that fail to parse are skipped and reported in the error.
+func evaluateSchedules(spec scalablev1.ScalablePodPoolSpec, now time.Time) (poolCapacity, error) {
+	capacity := poolCapacity{maxActive: spec.MaxActive}
+	if spec.MinWarm != nil {
+		capacity.minWarm = *spec.MinWarm
+	}
+	var errs []error
+	open := false
+	for _, schedule := range spec.Schedules {
+		nextStart, nextEnd, err := nextFirings(schedule, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("schedule %q: %w", schedule.Name, err))
+			continue
+		}
+		for _, t := range []time.Time{nextStart, nextEnd} {
+			if !t.IsZero() && (capacity.next.IsZero() || t.Before(capacity.next)) {
+				capacity.next = t
+			}
+		}
+		windowOpen := !nextEnd.IsZero() && (nextStart.IsZero() || nextEnd.Before(nextStart))
+		if open || !windowOpen {
+			continue
+		}
+		open = true
+		capacity.schedule = schedule.Name
+		if schedule.MinWarm != nil {
+			capacity.minWarm = *schedule.MinWarm
+		}
+		if schedule.MaxActive != nil {
+			capacity.maxActive = schedule.MaxActive
+		}
+	}
+	return capacity, utilerrors.NewAggregate(errs)
+}
+
+// nextFirings returns when the schedule's Start and End expressions next fire after `now`, in its time zone.
+func nextFirings(schedule scalablev1.CapacitySchedule, now time.Time) (time.Time, time.Time, error) {
+	location := time.UTC
+	if schedule.TimeZone != "" {
+		var err error
+		if location, err = time.LoadLocation(schedule.TimeZone); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	start, err := cronParser.Parse(schedule.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("start: %w", err)
+	}
+	end, err := cronParser.Parse(schedule.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("end: %w", err)
+	}
+	local := now.In(location)
+	return start.Next(local), end.Next(local), nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+var officeHours = scalablev1.ScalablePodPoolSpec{
+	MinWarm:   int32Ptr(0),
+	MaxActive: int32Ptr(2),
+	Schedules: []scalablev1.CapacitySchedule{
+		{Name: "workday", Start: "0 9 * * 1-5", End: "0 17 * * 1-5", TimeZone: "America/New_York", MinWarm: int32Ptr(3), MaxActive: int32Ptr(10)},
+		{Name: "lunch", Start: "0 12 * * *", End: "0 13 * * *", TimeZone: "America/New_York", MinWarm: int32Ptr(5)},
+	},
+}
+
+func TestEvaluateSchedules(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		now       time.Time
+		schedule  string
+		minWarm   int32
+		maxActive int32
+		next      time.Time
+	}{
+		{"before work", time.Date(2021, 9, 6, 8, 30, 0, 0, newYork), "", 0, 2, time.Date(2021, 9, 6, 9, 0, 0, 0, newYork)},
+		{"at start", time.Date(2021, 9, 6, 9, 0, 0, 0, newYork), "workday", 3, 10, time.Date(2021, 9, 6, 12, 0, 0, 0, newYork)},
+		{"first open schedule wins", time.Date(2021, 9, 6, 12, 30, 0, 0, newYork), "workday", 3, 10, time.Date(2021, 9, 6, 13, 0, 0, 0, newYork)},
+		{"at end", time.Date(2021, 9, 6, 17, 0, 0, 0, newYork), "", 0, 2, time.Date(2021, 9, 7, 9, 0, 0, 0, newYork)},
+		{"weekend lunch", time.Date(2021, 9, 4, 12, 30, 0, 0, newYork), "lunch", 5, 2, time.Date(2021, 9, 4, 13, 0, 0, 0, newYork)},
+		{"time zone is honoured", time.Date(2021, 9, 6, 14, 0, 0, 0, time.UTC), "workday", 3, 10, time.Date(2021, 9, 6, 12, 0, 0, 0, newYork)},
+	}
+	for _, test := range tests {
+		capacity, err := evaluateSchedules(officeHours, test.now)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if capacity.schedule != test.schedule || capacity.minWarm != test.minWarm || *capacity.maxActive != test.maxActive {
+			t.Errorf("%s: got schedule %q, minWarm %d, maxActive %d", test.name, capacity.schedule, capacity.minWarm, *capacity.maxActive)
+		}
+		if !capacity.next.Equal(test.next) {
+			t.Errorf("%s: got next transition %v, want %v", test.name, capacity.next, test.next)
+		}
+	}
+}
+
+func TestEvaluateSchedulesSkipsInvalid(t *testing.T) {
+	spec := scalablev1.ScalablePodPoolSpec{
+		MinWarm: int32Ptr(1),
+		Schedules: []scalablev1.CapacitySchedule{
+			{Name: "typo", Start: "0 9 * *", End: "0 17 * * *"},
+			{Name: "nowhere", Start: "0 9 * * *", End: "0 17 * * *", TimeZone: "Mars/Olympus_Mons"},
+		},
+	}
+	capacity, err := evaluateSchedules(spec, time.Date(2021, 9, 6, 10, 0, 0, 0, time.UTC))
+	if err == nil {
+		t.Error("expected an error for invalid schedules")
+	}
+	if capacity.schedule != "" || capacity.minWarm != 1 {
+		t.Errorf("invalid schedules should fall back to the pool spec, got %+v", capacity)
+	}
+}
+
+func TestPoolReconcilePreWarms(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	inactive := scalablev1.SPInactive
+	pool := &scalablev1.ScalablePodPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "office-hours"},
+		Spec:       officeHours,
+	}
+	objs := []runtime.Object{pool}
+	for _, name := range []string{"sp1", "sp2", "sp3", "sp4"} {
+		objs = append(objs, &scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{scalablev1.PoolLabel: pool.Name}},
+			Status:     scalablev1.ScalablePodStatus{Status: &inactive},
+		})
+	}
+	c := fake.NewFakeClientWithScheme(scheme, objs...)
+	newYork, _ := time.LoadLocation("America/New_York")
+	fakeClock := clock.NewFakeClock(time.Date(2021, 9, 6, 9, 30, 0, 0, newYork))
+	r := &ScalablePodPoolReconciler{Client: c, Scheme: scheme, Clock: fakeClock}
+	key := types.NamespacedName{Namespace: "default", Name: pool.Name}
+
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequeueAfter != 150*time.Minute {
+		t.Errorf("expected a requeue at lunchtime, got %v", result.RequeueAfter)
+	}
+	if err := c.Get(context.Background(), key, pool); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Status.ActiveSchedule != "workday" || pool.Status.Warm != 3 {
+		t.Errorf("expected 3 ScalablePods warmed by workday, got %+v", pool.Status)
+	}
+
+	// After work, the warm ScalablePods are released
+	fakeClock.SetTime(time.Date(2021, 9, 6, 17, 30, 0, 0, newYork))
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	pool = &scalablev1.ScalablePodPool{}
+	if err := c.Get(context.Background(), key, pool); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Status.ActiveSchedule != "" || pool.Status.Warm != 0 || pool.Status.Active != 0 {
+		t.Errorf("expected warm ScalablePods to be released, got %+v", pool.Status)
+	}
+}
+
+func TestPoolUsesClassWarmPool(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	inactive := scalablev1.SPInactive
+	class := &scalablev1.ScalablePodClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec:       scalablev1.ScalablePodClassSpec{WarmPool: &scalablev1.ClassWarmPool{MinWarm: 3, MaxActive: int32Ptr(2)}},
+	}
+	pool := &scalablev1.ScalablePodPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       scalablev1.ScalablePodPoolSpec{ClassName: "web", MinWarm: int32Ptr(1)},
+	}
+	objs := []runtime.Object{class, pool}
+	for _, name := range []string{"sp1", "sp2", "sp3"} {
+		objs = append(objs, &scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{scalablev1.PoolLabel: pool.Name}},
+			Status:     scalablev1.ScalablePodStatus{Status: &inactive},
+		})
+	}
+	c := fake.NewFakeClientWithScheme(scheme, objs...)
+	r := &ScalablePodPoolReconciler{Client: c, Scheme: scheme, Clock: clock.NewFakeClock(time.Date(2021, 9, 6, 9, 30, 0, 0, time.UTC))}
+	key := types.NamespacedName{Namespace: "default", Name: pool.Name}
+
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(context.Background(), key, pool); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Status.MinWarm != 1 || pool.Status.MaxActive == nil || *pool.Status.MaxActive != 2 || pool.Status.Warm != 1 {
+		t.Errorf("expected the pool's own minWarm and the class's maxActive, got %+v", pool.Status)
+	}
+	if spec, err := r.withClass(context.Background(), scalablev1.ScalablePodPoolSpec{ClassName: "web", MinWarm: int32Ptr(0)}); err != nil || *spec.MinWarm != 0 {
+		t.Errorf("expected a minWarm of 0 set on the pool to be kept, got %+v, %v", spec, err)
+	}
+	if spec, err := r.withClass(context.Background(), scalablev1.ScalablePodPoolSpec{ClassName: "web"}); err != nil || *spec.MinWarm != 3 {
+		t.Errorf("expected the class's minWarm when the pool doesn't set one, got %+v, %v", spec, err)
+	}
+	if requests := r.poolsOfClass(class); len(requests) != 1 || requests[0].NamespacedName != key {
+		t.Errorf("expected the pool to be reconciled when its class changes, got %v", requests)
+	}
+
+	// Pools carry on without a class that doesn't exist
+	if err := c.Delete(context.Background(), class); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err != nil {
+		t.Errorf("expected the pool to be reconciled without its class, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// Usage counts a set of ScalablePods, such as a pool, by what they are doing.
+type Usage struct {
+	// ScalablePods claimed by a request, whether or not their pod has started
+	Active int64
+	// Claimed ScalablePods whose pod isn't Ready yet
+	Waiting int64
+	// ScalablePods warmed up ahead of demand and not yet claimed
+	Warm int64
+	// ScalablePods with no pod
+	Inactive int64
+	// Mean time claimed ScalablePods took from being requested to having a Ready pod, zero if none are Ready
+	MeanTimeToReady time.Duration
+}
+
+// UsageOf counts the given ScalablePods.
+func UsageOf(scalablePods []scalablev1.ScalablePod) Usage {
+	var usage Usage
+	var totalTimeToReady time.Duration
+	var ready int64
+	for _, sp := range scalablePods {
+		switch {
+		case sp.Status.Requested && sp.Status.Warm:
+			usage.Warm++
+		case sp.Status.Requested:
+			usage.Active++
+			if sp.Status.ReadyAt == nil {
+				usage.Waiting++
+			}
+			if timeToReady, ok := TimeToReady(&sp); ok {
+				totalTimeToReady += timeToReady
+				ready++
+			}
+		default:
+			usage.Inactive++
+		}
+	}
+	if ready > 0 {
+		usage.MeanTimeToReady = totalTimeToReady / time.Duration(ready)
+	}
+	return usage
+}
+
+// TimeToReady is how long the ScalablePod's claimant waited for a Ready pod. It is zero for warm ScalablePods that
+// were Ready before they were claimed, and not known until the pod is Ready.
+func TimeToReady(sp *scalablev1.ScalablePod) (time.Duration, bool) {
+	if sp.Status.RequestedAt == nil || sp.Status.ReadyAt == nil {
+		return 0, false
+	}
+	if wait := sp.Status.ReadyAt.Sub(sp.Status.RequestedAt.Time); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package externalscaler
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/controllers"
+)
+
+var log = logf.Log.WithName("externalscaler")
+
+// Metrics reported to KEDA
+const (
+	// ScalablePods claimed by a request
+	ActiveScalablePodsMetric = "activeScalablePods"
+	// Claimed ScalablePods still waiting for their pod to be Ready
+	QueueDepthMetric = "queueDepth"
+)
+
+// Server implements KEDA's external scaler protocol, so that KEDA-scaled workloads can follow ScalablePod demand.
+// The ScaledObject's scaler metadata picks the ScalablePods and metric:
+//   namespace  - namespace of the ScalablePods, defaults to the ScaledObject's own, and must be it unless
+//                AllowCrossNamespace is set
+//   pool       - only count ScalablePods in this ScalablePodPool
+//   metric     - activeScalablePods (the default) or queueDepth
+//   targetSize - metric value each replica of the scaled workload can handle, defaults to 1
+// A ScaledObject is active while any of its ScalablePods are claimed. Anyone who can reach the server can name any
+// ScaledObject, so it should only be reachable by KEDA, or serve TLS with a client CA.
+type Server struct {
+	UnimplementedExternalScalerServer
+	Client client.Client
+	// Address the gRPC server listens on
+	BindAddress string
+	// Directory holding tls.crt and tls.key, and optionally ca.crt to require client certificates signed by. The server
+	// doesn't use TLS if it is empty.
+	CertDir string
+	// Whether ScaledObjects may count ScalablePods outside their own namespace
+	AllowCrossNamespace bool
+	// How often StreamIsActive re-checks the ScalablePods
+	PollInterval time.Duration
+}
+
+// Start serves the external scaler until the context is cancelled.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.BindAddress)
+	if err != nil {
+		return err
+	}
+	var opts []grpc.ServerOption
+	if s.CertDir != "" {
+		creds, err := s.credentials()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(opts...)
+	RegisterExternalScalerServer(server, s)
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+	log.Info("Serving KEDA external scaler", "address", s.BindAddress, "tls", s.CertDir != "")
+	return server.Serve(listener)
+}
+
+// credentials loads the server's certificate from CertDir, and the CA its clients' certificates must be signed by if
+// there is one.
+func (s *Server) credentials() (credentials.TransportCredentials, error) {
+	certificate, err := tls.LoadX509KeyPair(filepath.Join(s.CertDir, "tls.crt"), filepath.Join(s.CertDir, "tls.key"))
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	caPEM, err := ioutil.ReadFile(filepath.Join(s.CertDir, "ca.crt"))
+	if err == nil {
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates in %s", filepath.Join(s.CertDir, "ca.crt"))
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// NeedLeaderElection is false as the scaler only reads ScalablePods, so every replica can serve it.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Server) IsActive(ctx context.Context, ref *ScaledObjectRef) (*IsActiveResponse, error) {
+	usage, err := s.usage(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	return &IsActiveResponse{Result: usage.Active > 0}, nil
+}
+
+// StreamIsActive polls the ScalablePods and sends whether the ScaledObject is active whenever that changes.
+func (s *Server) StreamIsActive(ref *ScaledObjectRef, stream ExternalScaler_StreamIsActiveServer) error {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	var sent, wasActive bool
+	for {
+		usage, err := s.usage(stream.Context(), ref)
+		if err != nil {
+			return err
+		}
+		if active := usage.Active > 0; !sent || active != wasActive {
+			if err := stream.Send(&IsActiveResponse{Result: active}); err != nil {
+				return err
+			}
+			sent, wasActive = true, active
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) GetMetricSpec(ctx context.Context, ref *ScaledObjectRef) (*GetMetricSpecResponse, error) {
+	metric, err := metricName(ref)
+	if err != nil {
+		return nil, err
+	}
+	targetSize := int64(1)
+	if value, ok := ref.ScalerMetadata["targetSize"]; ok {
+		if targetSize, err = strconv.ParseInt(value, 10, 64); err != nil || targetSize < 1 {
+			return nil, status.Errorf(codes.InvalidArgument, "targetSize must be a positive integer, got %q", value)
+		}
+	}
+	return &GetMetricSpecResponse{MetricSpecs: []*MetricSpec{{MetricName: metric, TargetSize: targetSize}}}, nil
+}
+
+func (s *Server) GetMetrics(ctx context.Context, req *GetMetricsRequest) (*GetMetricsResponse, error) {
+	metric, err := metricName(req.ScaledObjectRef)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.usage(ctx, req.ScaledObjectRef)
+	if err != nil {
+		return nil, err
+	}
+	value := usage.Active
+	if metric == QueueDepthMetric {
+		value = usage.Waiting
+	}
+	return &GetMetricsResponse{MetricValues: []*MetricValue{{MetricName: metric, MetricValue: value}}}, nil
+}
+
+// usage counts the ScalablePods the ScaledObject's metadata selects.
+func (s *Server) usage(ctx context.Context, ref *ScaledObjectRef) (controllers.Usage, error) {
+	if ref == nil {
+		return controllers.Usage{}, status.Error(codes.InvalidArgument, "missing ScaledObjectRef")
+	}
+	namespace := ref.Namespace
+	if value, ok := ref.ScalerMetadata["namespace"]; ok && value != namespace {
+		if !s.AllowCrossNamespace {
+			return controllers.Usage{}, status.Errorf(codes.PermissionDenied, "ScaledObject %s/%s may not count ScalablePods in namespace %s", ref.Namespace, ref.Name, value)
+		}
+		namespace = value
+	}
+	opts := []client.ListOption{client.InNamespace(namespace)}
+	if pool := ref.ScalerMetadata["pool"]; pool != "" {
+		opts = append(opts, client.MatchingLabels{scalablev1.PoolLabel: pool})
+	}
+	var scalablePods scalablev1.ScalablePodList
+	if err := s.Client.List(ctx, &scalablePods, opts...); err != nil {
+		return controllers.Usage{}, status.Errorf(codes.Unavailable, "unable to list ScalablePods: %v", err)
+	}
+	return controllers.UsageOf(scalablePods.Items), nil
+}
+
+// metricName returns the metric the ScaledObject asked for.
+func metricName(ref *ScaledObjectRef) (string, error) {
+	if ref == nil {
+		return "", status.Error(codes.InvalidArgument, "missing ScaledObjectRef")
+	}
+	switch metric := ref.ScalerMetadata["metric"]; metric {
+	case "", ActiveScalablePodsMetric:
+		return ActiveScalablePodsMetric, nil
+	case QueueDepthMetric:
+		return QueueDepthMetric, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "unknown metric %q", metric)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package externalscaler
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/cert"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// scalablePod returns a ScalablePod in the given pool, with a Ready pod if it is Active.
+func scalablePod(name, pool string, state scalablev1.SPStatus, requested bool) *scalablev1.ScalablePod {
+	sp := &scalablev1.ScalablePod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{scalablev1.PoolLabel: pool}},
+		Status:     scalablev1.ScalablePodStatus{Status: &state, Requested: requested},
+	}
+	if state == scalablev1.SPActive {
+		now := metav1.Now()
+		sp.Status.ReadyAt = &now
+	}
+	return sp
+}
+
+// startServer serves the scaler over an in-memory connection and returns a client for it.
+func startServer(t *testing.T, scaler *Server) ExternalScalerClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	scaler.PollInterval = 10 * time.Millisecond
+	RegisterExternalScalerServer(server, scaler)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewExternalScalerClient(conn)
+}
+
+func TestMetrics(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewFakeClientWithScheme(scheme,
+		scalablePod("running", "web", scalablev1.SPActive, true),
+		scalablePod("starting", "web", scalablev1.SPInactive, true),
+		scalablePod("idle", "web", scalablev1.SPInactive, false),
+		scalablePod("elsewhere", "batch", scalablev1.SPActive, true),
+	)
+	scaler := startServer(t, &Server{Client: c})
+	ctx := context.Background()
+	ref := &ScaledObjectRef{Name: "frontend", Namespace: "default", ScalerMetadata: map[string]string{"pool": "web"}}
+
+	active, err := scaler.IsActive(ctx, ref)
+	if err != nil || !active.Result {
+		t.Errorf("expected pool to be active, got %v, %v", active, err)
+	}
+
+	metrics, err := scaler.GetMetrics(ctx, &GetMetricsRequest{ScaledObjectRef: ref, MetricName: ActiveScalablePodsMetric})
+	if err != nil || metrics.MetricValues[0].MetricValue != 2 {
+		t.Errorf("expected 2 active ScalablePods, got %v, %v", metrics, err)
+	}
+
+	ref.ScalerMetadata["metric"] = QueueDepthMetric
+	ref.ScalerMetadata["targetSize"] = "5"
+	spec, err := scaler.GetMetricSpec(ctx, ref)
+	if err != nil || spec.MetricSpecs[0].MetricName != QueueDepthMetric || spec.MetricSpecs[0].TargetSize != 5 {
+		t.Errorf("unexpected metric spec %v, %v", spec, err)
+	}
+	metrics, err = scaler.GetMetrics(ctx, &GetMetricsRequest{ScaledObjectRef: ref, MetricName: QueueDepthMetric})
+	if err != nil || metrics.MetricValues[0].MetricValue != 1 {
+		t.Errorf("expected a queue depth of 1, got %v, %v", metrics, err)
+	}
+
+	ref.ScalerMetadata["metric"] = "cpu"
+	if _, err := scaler.GetMetricSpec(ctx, ref); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected unknown metrics to be rejected, got %v", err)
+	}
+}
+
+func TestStreamIsActive(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	idle := scalablePod("idle", "web", scalablev1.SPInactive, false)
+	c := fake.NewFakeClientWithScheme(scheme, idle)
+	scaler := startServer(t, &Server{Client: c})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := scaler.StreamIsActive(ctx, &ScaledObjectRef{Namespace: "default", ScalerMetadata: map[string]string{"pool": "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || resp.Result {
+		t.Fatalf("expected an inactive pool first, got %v, %v", resp, err)
+	}
+
+	idle.Status.Requested = true
+	if err := c.Status().Update(ctx, idle); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := stream.Recv(); err != nil || !resp.Result {
+		t.Fatalf("expected the pool to become active, got %v, %v", resp, err)
+	}
+}
+
+func TestNamespaceMetadata(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewFakeClientWithScheme(scheme, scalablePod("running", "web", scalablev1.SPActive, true))
+	ctx := context.Background()
+	own := &ScaledObjectRef{Name: "frontend", Namespace: "default", ScalerMetadata: map[string]string{"namespace": "default"}}
+	other := &ScaledObjectRef{Name: "frontend", Namespace: "team-a", ScalerMetadata: map[string]string{"namespace": "default"}}
+
+	scaler := startServer(t, &Server{Client: c})
+	if active, err := scaler.IsActive(ctx, own); err != nil || !active.Result {
+		t.Errorf("expected the ScaledObject's own namespace to be counted, got %v, %v", active, err)
+	}
+	if _, err := scaler.IsActive(ctx, other); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected another namespace to be refused, got %v", err)
+	}
+
+	scaler = startServer(t, &Server{Client: c, AllowCrossNamespace: true})
+	if active, err := scaler.IsActive(ctx, other); err != nil || !active.Result {
+		t.Errorf("expected another namespace to be counted when allowed, got %v, %v", active, err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey("scalablepod-keda-scaler", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scaler := &Server{CertDir: dir}
+	if creds, err := scaler.credentials(); err != nil || creds.Info().SecurityProtocol != "tls" {
+		t.Errorf("expected TLS credentials, got %v, %v", creds, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scaler.credentials(); err == nil {
+		t.Error("expected a client CA without certificates to be rejected")
+	}
+}
@@ -18,21 +18,47 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // ScalablePodPool schedules need time zones, which the distroless image doesn't ship
 
+	"github.com/google/uuid"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
 
 	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/audit"
+	"github.com/edwmorgan/k8s-operator-example/auth"
 	"github.com/edwmorgan/k8s-operator-example/controllers"
+	"github.com/edwmorgan/k8s-operator-example/externalscaler"
+	"github.com/edwmorgan/k8s-operator-example/metricsapi"
+	"github.com/edwmorgan/k8s-operator-example/ratelimit"
+	"github.com/edwmorgan/k8s-operator-example/tracing"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -41,6 +67,16 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// Header carrying the ID that ties together the logs of a request as it passes from the user-facing server to the
+// operator. One is generated if the request doesn't have one.
+const requestIDHeader = "X-Request-ID"
+
+// Header a caller sets on /request so that retries of the request are given the same claim
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
@@ -53,7 +89,23 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var operatorPort string
+	var kedaScalerAddr string
+	var kedaScalerCertDir string
+	var kedaScalerCrossNamespace bool
+	var metricsAPIAddr string
+	var metricsAPICertDir string
+	var usageRetention time.Duration
+	var allowedImages string
+	var defaultsFile string
 	flag.StringVar(&operatorPort, "operator-port", "19090", "The port to start the HTTP request server on.")
+	flag.StringVar(&kedaScalerAddr, "keda-scaler-bind-address", "", "The address the KEDA external scaler gRPC endpoint binds to. Leave empty to disable it.")
+	flag.StringVar(&kedaScalerCertDir, "keda-scaler-cert-dir", "", "The directory holding tls.crt and tls.key for the KEDA external scaler, and optionally ca.crt to require client certificates signed by. It doesn't use TLS if it is empty.")
+	flag.BoolVar(&kedaScalerCrossNamespace, "keda-scaler-allow-cross-namespace", false, "Let ScaledObjects count ScalablePods outside their own namespace with the namespace scaler metadata.")
+	flag.StringVar(&metricsAPIAddr, "metrics-apiserver-bind-address", "", "The address the custom and external metrics API server binds to. Leave empty to disable it.")
+	flag.StringVar(&metricsAPICertDir, "metrics-apiserver-cert-dir", "", "The directory holding tls.crt and tls.key for the metrics API server. A self-signed certificate is used if it is empty.")
+	flag.DurationVar(&usageRetention, "usage-retention", 90*24*time.Hour, "How long ScalablePodUsage records are kept after their usage ends. They are kept forever if it is 0.")
+	flag.StringVar(&allowedImages, "allowed-images", "", "Comma-separated images ScalablePods may be created with, each an image name or a prefix ending in *, e.g. busybox,registry.example.com/team-a/*. Any image is allowed if it is empty.")
+	flag.StringVar(&defaultsFile, "scalablepod-defaults", "", "A YAML file of defaults filled in on new ScalablePods: podImageTag, maxActiveTimeSec, resources, securityContext and labels.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -63,10 +115,31 @@ func main() {
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
+	tracingOpts := tracing.Options{ServiceName: "scalablepod-operator"}
+	tracingOpts.BindFlags(flag.CommandLine)
+	var authOpts auth.Options
+	authOpts.BindFlags(flag.CommandLine)
+	var rateLimitOpts ratelimit.Options
+	rateLimitOpts.BindFlags(flag.CommandLine)
+	var auditOpts audit.Options
+	auditOpts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	auditSink, closeAudit, err := auditOpts.Sink()
+	if err != nil {
+		setupLog.Error(err, "unable to open audit log")
+		os.Exit(1)
+	}
+	audit.SetSink(auditSink)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingOpts)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -81,15 +154,94 @@ func main() {
 	}
 
 	reconciler := &controllers.ScalablePodReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("scalablepod-controller"),
 	}
 	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ScalablePod")
 		os.Exit(1)
 	}
+	forecaster := controllers.NewDemandForecaster(clock.RealClock{})
+	if err = (&controllers.ScalablePodPoolReconciler{
+		Client:     mgr.GetClient(),
+		Scheme:     mgr.GetScheme(),
+		Clock:      clock.RealClock{},
+		Forecaster: forecaster,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ScalablePodPool")
+		os.Exit(1)
+	}
+	if err = (&controllers.ScalablePodQuotaReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+		Clock:  clock.RealClock{},
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ScalablePodQuota")
+		os.Exit(1)
+	}
+	if err = (&controllers.ScalablePodUsageReconciler{
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Clock:     clock.RealClock{},
+		Retention: usageRetention,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ScalablePodUsage")
+		os.Exit(1)
+	}
+	// The webhooks need a serving certificate, so they can be turned off when running outside the cluster
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if allowedImages != "" {
+			scalablev1.SetAllowedImages(strings.Split(allowedImages, ","))
+		}
+		if defaultsFile != "" {
+			data, err := os.ReadFile(defaultsFile)
+			if err != nil {
+				setupLog.Error(err, "unable to read ScalablePod defaults", "file", defaultsFile)
+				os.Exit(1)
+			}
+			var defaults scalablev1.ScalablePodDefaults
+			if err := yaml.UnmarshalStrict(data, &defaults); err != nil {
+				setupLog.Error(err, "unable to parse ScalablePod defaults", "file", defaultsFile)
+				os.Exit(1)
+			}
+			scalablev1.SetDefaults(defaults)
+		}
+		if err = (&scalablev1.ScalablePod{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ScalablePod")
+			os.Exit(1)
+		}
+	} else if allowedImages != "" || defaultsFile != "" {
+		// Only the webhooks enforce them, so running without would silently let through what they are meant to stop
+		setupLog.Error(errors.New("--allowed-images and --scalablepod-defaults are applied by the webhooks"), "unable to apply ScalablePod policy with ENABLE_WEBHOOKS=false")
+		os.Exit(1)
+	}
 	//+kubebuilder:scaffold:builder
 
+	if kedaScalerAddr != "" {
+		if err := mgr.Add(&externalscaler.Server{
+			Client:              mgr.GetClient(),
+			BindAddress:         kedaScalerAddr,
+			CertDir:             kedaScalerCertDir,
+			AllowCrossNamespace: kedaScalerCrossNamespace,
+			PollInterval:        5 * time.Second,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up KEDA external scaler")
+			os.Exit(1)
+		}
+	}
+	if metricsAPIAddr != "" {
+		if err := mgr.Add(&metricsapi.Server{
+			Client:      mgr.GetClient(),
+			APIReader:   mgr.GetAPIReader(),
+			BindAddress: metricsAPIAddr,
+			CertDir:     metricsAPICertDir,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up metrics API server")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -99,39 +251,640 @@ func main() {
 		os.Exit(1)
 	}
 
-	http.HandleFunc("/request", RequestWrapper(reconciler))
-	go http.ListenAndServe(fmt.Sprintf("0.0.0.0:%s", operatorPort), nil)
+	authenticators, err := authOpts.Authenticators(mgr.GetClient())
+	if err != nil {
+		setupLog.Error(err, "unable to set up request authentication")
+		os.Exit(1)
+	}
+	authorizer, err := authOpts.Authorizer(mgr.GetClient())
+	if err != nil {
+		setupLog.Error(err, "unable to set up request authorization")
+		os.Exit(1)
+	}
+	tlsConfig, err := authOpts.TLSConfig()
+	if err != nil {
+		setupLog.Error(err, "unable to set up request server TLS")
+		os.Exit(1)
+	}
+	rateLimit, err := rateLimitOpts.Limit()
+	if err != nil {
+		setupLog.Error(err, "unable to set up request rate limiting")
+		os.Exit(1)
+	}
+	sourceLimit, err := rateLimitOpts.SourceLimit()
+	if err != nil {
+		setupLog.Error(err, "unable to set up request rate limiting")
+		os.Exit(1)
+	}
+	if len(authenticators) == 0 {
+		setupLog.Info("request server doesn't authenticate callers, so anything that can reach it can claim ScalablePods; set --request-auth to require credentials")
+	}
+	// The user-facing server's trace context arrives in the request headers. Each source IP is rate limited before it
+	// is authenticated, so that floods of bad credentials don't each cost a TokenReview; callers are then audited and
+	// rate limited once they are authenticated, so that each is counted on its own.
+	limiter := &ratelimit.Limiter{Clock: clock.RealClock{}}
+	authenticated := func(next http.Handler) http.Handler {
+		return ratelimit.SourceHandler(limiter, sourceLimit, auth.Handler(authenticators, next))
+	}
+	requestHandler := ratelimit.Handler(limiter, rateLimit, RequestWrapper(reconciler, mgr.GetAPIReader(), forecaster,
+		authorizer, &controllers.IdempotencyKeys{Clock: clock.RealClock{}}, &controllers.QuotaLocks{},
+		&ratelimit.PoolLimiter{Limiter: limiter, Client: mgr.GetClient()}))
+	http.Handle("/request", otelhttp.NewHandler(authenticated(audit.Handler(requestHandler)), "request"))
+	http.Handle("/claims/", otelhttp.NewHandler(authenticated(ClaimWrapper(reconciler, mgr.GetAPIReader(), authorizer)), "claim"))
+	http.Handle("/usage", otelhttp.NewHandler(authenticated(UsageWrapper(mgr.GetClient(), authorizer)), "usage"))
+	// Lets the user-facing server's readiness check see that the request server is up
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	requestServer := &http.Server{Addr: fmt.Sprintf("0.0.0.0:%s", operatorPort), TLSConfig: tlsConfig}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = requestServer.ListenAndServeTLS("", "")
+		} else {
+			err = requestServer.ListenAndServe()
+		}
+		setupLog.Error(err, "request server stopped")
+	}()
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	if err := shutdownTracing(context.Background()); err != nil {
+		setupLog.Error(err, "unable to flush traces")
+	}
+	if err := closeAudit(); err != nil {
+		setupLog.Error(err, "unable to close audit log")
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
 
 /* When the reconciler receives an HTTP request to schedule a ScalablePod, this function handles the process of
- * choosing which ScalablePod should be activated.
+ * choosing which ScalablePod should be activated. The optional `namespace` and `pool` query parameters restrict the
+ * choice to one ScalablePodPool, and `selector` to ScalablePods matching a label selector. The caller, if the request
+ * server authenticates them, is recorded on the claimed ScalablePod. With an authorizer, the caller is only given
+ * ScalablePods from pools, or outside pools, that it has the request verb on, and is refused if there are none. The
+ * caller is only given ScalablePods in namespaces whose ScalablePodQuotas it hasn't used up, and gets a 429 if that
+ * leaves none. Requests are checked against quotas and make their claims one at a time in each namespace, so that
+ * concurrent requests can't take more than a quota allows. A request with an Idempotency-Key header is given the claim an earlier request from the same caller with
+ * that key was given, for as long as the claim lasts, so that retrying a request that timed out doesn't claim a second
+ * ScalablePod.
  */
-func RequestWrapper(reconciler *controllers.ScalablePodReconciler) http.HandlerFunc {
+func RequestWrapper(reconciler *controllers.ScalablePodReconciler, apiReader client.Reader, forecaster *controllers.DemandForecaster, authorizer auth.Authorizer, idempotencyKeys *controllers.IdempotencyKeys, quotaLocks *controllers.QuotaLocks, poolLimits *ratelimit.PoolLimiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx, span := tracing.Tracer().Start(r.Context(), "Allocate ScalablePod")
+		defer span.End()
+		caller := auth.Username(r.Context())
+		log := ctrl.Log.WithName("request").WithValues("requestID", requestID, "traceID", span.SpanContext().TraceID(), "caller", caller)
+		idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid %s: longer than %d characters\n", idempotencyKeyHeader, maxIdempotencyKeyLength)))
+			return
+		}
+		if idempotencyKey != "" {
+			done, err := idempotencyKeys.Begin(ctx, caller, idempotencyKey)
+			if err != nil {
+				log.Info("Request ended waiting for an earlier request with its idempotency key", "error", err.Error())
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			defer done()
+			sp, err := idempotencyKeys.Find(ctx, reconciler.Client, apiReader, caller, idempotencyKey)
+			if err != nil {
+				log.Error(err, "Unable to look up idempotency key")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if sp != nil {
+				log.Info("Returning earlier claim for idempotency key", "scalablepod", sp.Name, "namespace", sp.Namespace, "claimID", sp.Status.ClaimID)
+				auditGrant(r, requestID, sp, "earlier claim for idempotency key")
+				writeAllocation(w, sp)
+				return
+			}
+		}
 		scalablePods := &scalablev1.ScalablePodList{}
-		reconciler.Client.List(r.Context(), scalablePods)
-		fmt.Println("Found " + fmt.Sprintf("%d", len(scalablePods.Items)) + " ScalablePods.")
+		var opts []client.ListOption
+		if namespace := r.URL.Query().Get("namespace"); namespace != "" {
+			opts = append(opts, client.InNamespace(namespace))
+		}
+		if pool := r.URL.Query().Get("pool"); pool != "" {
+			opts = append(opts, client.MatchingLabels{scalablev1.PoolLabel: pool})
+		}
+		if value := r.URL.Query().Get("selector"); value != "" {
+			selector, err := labels.Parse(value)
+			if err != nil {
+				log.Info("Invalid label selector", "selector", value, "error", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Invalid selector: %v\n", err)))
+				return
+			}
+			opts = append(opts, client.MatchingLabelsSelector{Selector: selector})
+		}
+		if err := reconciler.Client.List(ctx, scalablePods, opts...); err != nil {
+			log.Error(err, "Unable to list ScalablePods")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.V(1).Info("Found ScalablePods", "count", len(scalablePods.Items))
+		if authorizer != nil && len(scalablePods.Items) > 0 {
+			allowed, reason, err := authorized(ctx, authorizer, scalablePods.Items)
+			if err != nil {
+				log.Error(err, "Unable to authorize request")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if len(allowed) == 0 {
+				log.Info("Caller may not request any of the ScalablePods", "reason", reason)
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(fmt.Sprintf("Forbidden: %s\n", reason)))
+				return
+			}
+			scalablePods.Items = allowed
+		}
+		// Held until the claim is made, with usage read from the API server, so that claims made by concurrent
+		// requests are counted
+		unlock := quotaLocks.Lock(namespacesOf(scalablePods.Items))
+		defer unlock()
+		withinQuota, denial, err := withinQuotas(ctx, apiReader, caller, scalablePods.Items)
+		if err != nil {
+			log.Error(err, "Unable to check quotas")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(withinQuota) == 0 && denial != nil {
+			log.Info("Quota exceeded", "namespace", denial.Namespace, "quota", denial.Quota, "reason", denial.Reason, "retryAfter", denial.RetryAfter)
+			controllers.RecordQuotaRejected(denial)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(denial.RetryAfter.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("Quota exceeded: ScalablePodQuota %s/%s has %s.\n", denial.Namespace, denial.Quota, denial.Reason)))
+			return
+		}
+		scalablePods.Items = withinQuota
+		// ScalablePods whose pool's rate limit the caller has used up are skipped. If that leaves none, the request is
+		// refused until the soonest of those pools lets the caller claim again.
+		clientKey := ratelimit.ClientKey(r)
+		var limitedNamespace, limitedPool string
+		var limitedWait time.Duration
+		withinPoolLimit := func(sp *scalablev1.ScalablePod) (bool, error) {
+			ok, wait, err := poolLimits.Take(ctx, clientKey, sp)
+			if err == nil && !ok {
+				pool := sp.Labels[scalablev1.PoolLabel]
+				log.V(1).Info("Pool rate limit exceeded", "namespace", sp.Namespace, "pool", pool, "retryAfter", wait)
+				if limitedPool == "" || wait < limitedWait {
+					limitedNamespace, limitedPool, limitedWait = sp.Namespace, pool, wait
+				}
+			}
+			return ok, err
+		}
+		claimID := uuid.New().String()
+		// Hand out a ScalablePod its pool has already warmed up, if there is one
+		for _, sp := range scalablePods.Items {
+			if sp.Status.Requested && sp.Status.Warm {
+				if ok, err := withinPoolLimit(&sp); err != nil {
+					log.Error(err, "Unable to get ScalablePodPool", "scalablepod", sp.Name, "namespace", sp.Namespace)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				} else if !ok {
+					continue
+				}
+				log.Info("Claiming warm ScalablePod", "scalablepod", sp.Name, "namespace", sp.Namespace, "claimID", claimID)
+				recordDemand(forecaster, &sp, true)
+				err := claim(ctx, reconciler.Client, &sp, func(status *scalablev1.ScalablePodStatus) {
+					now := metav1.Now()
+					status.ClaimID = claimID
+					status.ClaimedBy = caller
+					status.IdempotencyKey = idempotencyKey
+					status.Warm = false
+					// Its TTL and usage start now, so the time it waited warm isn't recorded or billed
+					status.StartedAt = now
+					status.RequestedAt = &now
+				})
+				if apierrors.IsConflict(err) { // Claimed by another request since it was listed
+					log.V(1).Info("ScalablePod was claimed by another request", "scalablepod", sp.Name, "namespace", sp.Namespace)
+					continue
+				}
+				if err != nil {
+					log.Error(err, "Unable to update ScalablePod status", "scalablepod", sp.Name, "namespace", sp.Namespace)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if idempotencyKey != "" {
+					idempotencyKeys.Remember(caller, idempotencyKey, &sp)
+				}
+				controllers.RecordRequestServed(&sp)
+				auditGrant(r, requestID, &sp, "warm")
+				writeAllocation(w, &sp)
+				return
+			}
+		}
+		active := activeByPool(scalablePods.Items)
 		// Use round-robin scheduling to spin up a new ScalablePod
 		for _, sp := range scalablePods.Items {
-			if sp.Status.Status != nil && *sp.Status.Status == scalablev1.SPInactive {
-				log.Printf("Found suitable Inactive ScalablePod with name: `%s` \n", sp.Name)
-				sp.Status.Requested = true
-				if err := reconciler.Status().Update(context.Background(), &sp); err != nil {
+			if sp.Status.Status != nil && *sp.Status.Status == scalablev1.SPInactive && !sp.Status.Requested {
+				full, err := poolAtCapacity(ctx, reconciler.Client, &sp, active)
+				if err != nil {
+					log.Error(err, "Unable to get ScalablePodPool", "scalablepod", sp.Name, "namespace", sp.Namespace)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				if full {
+					continue
+				}
+				if ok, err := withinPoolLimit(&sp); err != nil {
+					log.Error(err, "Unable to get ScalablePodPool", "scalablepod", sp.Name, "namespace", sp.Namespace)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				} else if !ok {
+					continue
+				}
+				log.Info("Requesting Inactive ScalablePod", "scalablepod", sp.Name, "namespace", sp.Namespace, "claimID", claimID)
+				recordDemand(forecaster, &sp, false)
+				err = claim(ctx, reconciler.Client, &sp, func(status *scalablev1.ScalablePodStatus) {
+					status.ClaimID = claimID
+					status.ClaimedBy = caller
+					status.IdempotencyKey = idempotencyKey
+					status.Requested = true
+					status.RequestedAt = &metav1.Time{Time: time.Now()}
+				})
+				if apierrors.IsConflict(err) { // Claimed by another request since it was listed
+					log.V(1).Info("ScalablePod was claimed by another request", "scalablepod", sp.Name, "namespace", sp.Namespace)
+					continue
+				}
+				if err != nil {
+					log.Error(err, "Unable to update ScalablePod status", "scalablepod", sp.Name, "namespace", sp.Namespace)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
-				w.WriteHeader(http.StatusOK)
+				if idempotencyKey != "" {
+					idempotencyKeys.Remember(caller, idempotencyKey, &sp)
+				}
+				controllers.RecordRequestServed(&sp)
+				auditGrant(r, requestID, &sp, "cold start")
+				writeAllocation(w, &sp)
 				return
 			}
 		}
+		if limitedPool != "" {
+			log.Info("Rate limit exceeded", "limit", ratelimit.ScopePool, "namespace", limitedNamespace, "pool", limitedPool, "retryAfter", limitedWait)
+			ratelimit.TooManyRequests(w, limitedWait, limitedNamespace, limitedPool, ratelimit.ScopePool)
+			return
+		}
 		// If no resources are available, return a 404
+		namespace, pool := r.URL.Query().Get("namespace"), r.URL.Query().Get("pool")
+		if namespace != "" && pool != "" {
+			forecaster.Record(types.NamespacedName{Namespace: namespace, Name: pool}, false)
+		}
+		controllers.RecordRequestRejected(namespace, pool)
+		log.Info("No ScalablePod available", "namespace", namespace, "pool", pool)
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("All resources in use. Try again later.\n"))
 	}
 }
+
+// Allocation is the response to a request that claimed a ScalablePod.
+type Allocation struct {
+	// Identifies the claim, to look it up at /claims/<claimID>
+	ClaimID   string `json:"claimID"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Port the workload serves HTTP on, if it does
+	Port int32 `json:"port,omitempty"`
+}
+
+// Claim is the response from /claims/<claimID>: whether the claimed ScalablePod's pod can take requests yet.
+type Claim struct {
+	ClaimID   string `json:"claimID"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Port the workload serves HTTP on, if it does
+	Port int32 `json:"port,omitempty"`
+	// Whether the bound pod is Ready
+	Ready bool `json:"ready"`
+	// host:port the workload serves HTTP on, once the pod is Ready
+	Address string `json:"address,omitempty"`
+}
+
+// How long a renewed lease is left alone, so that a busy session doesn't write the ScalablePod's status on every request
+const leaseRenewGranularity = 5 * time.Second
+
+// auditGrant records that the request was given a claim on the ScalablePod, and how.
+func auditGrant(r *http.Request, requestID string, sp *scalablev1.ScalablePod, reason string) {
+	event := audit.ForScalablePod(audit.TypeGrant, sp)
+	event.RequestID = requestID
+	event.RemoteAddr = r.RemoteAddr
+	event.Reason = reason
+	audit.Record(event)
+}
+
+func writeAllocation(w http.ResponseWriter, sp *scalablev1.ScalablePod) {
+	allocation := Allocation{ClaimID: sp.Status.ClaimID, Namespace: sp.Namespace, Name: sp.Name}
+	if sp.Spec.Port != nil {
+		allocation.Port = *sp.Spec.Port
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(allocation)
+}
+
+/* ClaimWrapper serves /claims/<claimID>, which the user-facing server polls to find out when the pod of the
+ * ScalablePod it claimed is Ready, and where to proxy requests to. Claims are gone once their ScalablePod is released.
+ * A claim made moments ago may not have reached the cache yet, so the optional `namespace` and `name` query parameters
+ * from the Allocation let it be read from the API server instead.
+ * POSTing to /claims/<claimID>/renew renews the claim's lease, so that its ScalablePod doesn't expire while its
+ * claimant is still using it, and responds with the claim. With an authorizer, only the claimant may do either.
+ */
+func ClaimWrapper(reconciler *controllers.ScalablePodReconciler, apiReader client.Reader, authorizer auth.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claimID := strings.TrimPrefix(r.URL.Path, "/claims/")
+		renew := strings.HasSuffix(claimID, "/renew")
+		claimID = strings.TrimSuffix(claimID, "/renew")
+		log := ctrl.Log.WithName("claim").WithValues("claimID", claimID)
+		if renew && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		sp, err := findClaim(r.Context(), reconciler.Client, apiReader, claimID, r.URL.Query().Get("namespace"), r.URL.Query().Get("name"))
+		if err != nil {
+			log.Error(err, "Unable to find claimed ScalablePod")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		caller := auth.Username(r.Context())
+		if authorizer != nil && sp != nil && sp.Status.ClaimedBy != caller {
+			log.Info("Caller doesn't hold the claim", "caller", caller, "claimedBy", sp.Status.ClaimedBy)
+			if renew {
+				event := audit.ForScalablePod(audit.TypeRejection, sp)
+				event.Caller, event.RemoteAddr = caller, r.RemoteAddr
+				event.Code, event.Reason = http.StatusForbidden, "the claim belongs to "+sp.Status.ClaimedBy
+				audit.Record(event)
+			}
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Forbidden: the claim belongs to another caller\n"))
+			return
+		}
+		if sp != nil && renew {
+			if sp, err = renewLease(r.Context(), reconciler.Client, apiReader, sp, claimID); err != nil {
+				log.Error(err, "Unable to renew lease")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if sp != nil {
+				event := audit.ForScalablePod(audit.TypeRenewal, sp)
+				event.RequestID, event.RemoteAddr = r.Header.Get(requestIDHeader), r.RemoteAddr
+				audit.Record(event)
+			}
+		}
+		if sp == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Claim not found. Its ScalablePod may have been released.\n"))
+			return
+		}
+		claim := Claim{ClaimID: claimID, Namespace: sp.Namespace, Name: sp.Name, Ready: sp.Status.ReadyAt != nil}
+		if sp.Spec.Port != nil {
+			claim.Port = *sp.Spec.Port
+		}
+		if claim.Ready && claim.Port != 0 && sp.Status.BoundPod != nil {
+			var pod corev1.Pod
+			if err := reconciler.Get(r.Context(), types.NamespacedName{Namespace: sp.Status.BoundPod.Namespace, Name: sp.Status.BoundPod.Name}, &pod); err != nil {
+				log.Error(err, "Unable to get bound pod", "scalablepod", sp.Name, "namespace", sp.Namespace)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			claim.Address = net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(int(claim.Port)))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(claim)
+	}
+}
+
+// findClaim returns the ScalablePod holding the claim, or nil if none does. The cache is checked first, then the named
+// ScalablePod is read from the API server in case the claim hasn't been cached yet.
+func findClaim(ctx context.Context, c client.Reader, apiReader client.Reader, claimID, namespace, name string) (*scalablev1.ScalablePod, error) {
+	if claimID == "" {
+		return nil, nil
+	}
+	var scalablePods scalablev1.ScalablePodList
+	if err := c.List(ctx, &scalablePods, client.MatchingFields{controllers.ClaimIDField: claimID}); err != nil {
+		return nil, err
+	}
+	if len(scalablePods.Items) == 0 && namespace != "" && name != "" {
+		var sp scalablev1.ScalablePod
+		if err := apiReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &sp); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		if sp.Status.ClaimID == claimID {
+			scalablePods.Items = append(scalablePods.Items, sp)
+		}
+	}
+	if len(scalablePods.Items) == 0 || !scalablePods.Items[0].Status.Requested {
+		return nil, nil
+	}
+	return &scalablePods.Items[0], nil
+}
+
+/* UsageWrapper serves /usage, the daily rollup of ScalablePodUsage records per tenant, for charging teams for the
+ * ScalablePods they claimed. The `day` query parameter, as YYYY-MM-DD, defaults to today, and the day starts in the
+ * `timeZone` parameter's time zone, UTC by default. The optional `namespace` parameter restricts the rollup to one
+ * namespace. With an authorizer, the caller needs the list verb on scalablepodusages in the namespace, or in all
+ * namespaces if it isn't given.
+ */
+func UsageWrapper(c client.Reader, authorizer auth.Authorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := ctrl.Log.WithName("usage")
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		namespace := query.Get("namespace")
+		location := time.UTC
+		if name := query.Get("timeZone"); name != "" {
+			var err error
+			if location, err = time.LoadLocation(name); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("Invalid timeZone: %v\n", err)))
+				return
+			}
+		}
+		now := time.Now().In(location)
+		dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+		if day := query.Get("day"); day != "" {
+			var err error
+			if dayStart, err = time.ParseInLocation("2006-01-02", day, location); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Invalid day: expected YYYY-MM-DD\n"))
+				return
+			}
+		}
+		if authorizer != nil {
+			identity, _ := auth.FromContext(r.Context())
+			resource := auth.Resource{Namespace: namespace, Resource: "scalablepodusages", Verb: "list"}
+			allowed, reason, err := authorizer.Authorize(r.Context(), identity, resource)
+			if err != nil {
+				log.Error(err, "Unable to authorize request")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				log.Info("Caller may not list usage", "caller", auth.Username(r.Context()), "namespace", namespace, "reason", reason)
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(fmt.Sprintf("Forbidden: %s\n", reason)))
+				return
+			}
+		}
+		rollup, err := controllers.DailyUsage(r.Context(), c, namespace, dayStart)
+		if err != nil {
+			log.Error(err, "Unable to roll up usage", "namespace", namespace)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rollup)
+	}
+}
+
+// renewLease restarts the TTL of the claimed ScalablePod, unless it was renewed in the last leaseRenewGranularity. It
+// returns nil if the claim was released in the meantime.
+func renewLease(ctx context.Context, c client.Client, apiReader client.Reader, sp *scalablev1.ScalablePod, claimID string) (*scalablev1.ScalablePod, error) {
+	if renewedAt := sp.Status.LeaseRenewedAt; renewedAt != nil && time.Since(renewedAt.Time) < leaseRenewGranularity {
+		return sp, nil
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := apiReader.Get(ctx, client.ObjectKeyFromObject(sp), sp); err != nil {
+			return err
+		}
+		if sp.Status.ClaimID != claimID || !sp.Status.Requested {
+			sp = nil
+			return nil
+		}
+		sp.Status.LeaseRenewedAt = &metav1.Time{Time: time.Now()}
+		return c.Status().Update(ctx, sp)
+	})
+	return sp, err
+}
+
+// claim records the request's trace on the ScalablePod and then applies the claim to its status. The annotation is
+// written first, as a status update can't change it, so that the reconcile the claim causes can link back to the
+// request. Both writes fail if the ScalablePod changed since it was listed, so two requests can't claim it.
+func claim(ctx context.Context, c client.Client, sp *scalablev1.ScalablePod, apply func(*scalablev1.ScalablePodStatus)) error {
+	ctx, span := tracing.Tracer().Start(ctx, "Claim ScalablePod",
+		trace.WithAttributes(attribute.String("scalablepod", sp.Name), attribute.String("namespace", sp.Namespace)))
+	err := func() error {
+		if tracing.Annotate(ctx, sp) {
+			if err := c.Update(ctx, sp); err != nil {
+				return err
+			}
+		}
+		apply(&sp.Status)
+		return c.Status().Update(ctx, sp)
+	}()
+	tracing.End(span, err)
+	return err
+}
+
+// authorized returns the ScalablePods the caller in the context may request, and why some of them were refused. Each
+// pool, and each ScalablePod outside a pool, is authorized once.
+func authorized(ctx context.Context, authorizer auth.Authorizer, scalablePods []scalablev1.ScalablePod) ([]scalablev1.ScalablePod, string, error) {
+	identity, _ := auth.FromContext(ctx)
+	decisions := map[auth.Resource]bool{}
+	var allowed []scalablev1.ScalablePod
+	var reason string
+	for _, sp := range scalablePods {
+		resource := auth.RequestResource(&sp)
+		ok, decided := decisions[resource]
+		if !decided {
+			var refusal string
+			var err error
+			if ok, refusal, err = authorizer.Authorize(ctx, identity, resource); err != nil {
+				return nil, "", err
+			}
+			decisions[resource] = ok
+			if !ok && reason == "" {
+				reason = refusal
+			}
+		}
+		if ok {
+			allowed = append(allowed, sp)
+		}
+	}
+	return allowed, reason, nil
+}
+
+// withinQuotas returns the ScalablePods in namespaces where the caller's ScalablePodQuotas have room. If some
+// namespaces are used up, it also returns the denial that will lift soonest.
+func withinQuotas(ctx context.Context, c client.Reader, caller string, scalablePods []scalablev1.ScalablePod) ([]scalablev1.ScalablePod, *controllers.QuotaDenial, error) {
+	now := time.Now()
+	denials := map[string]*controllers.QuotaDenial{}
+	var allowed []scalablev1.ScalablePod
+	var soonest *controllers.QuotaDenial
+	for _, sp := range scalablePods {
+		denial, checked := denials[sp.Namespace]
+		if !checked {
+			var err error
+			if denial, err = controllers.CheckQuotas(ctx, c, sp.Namespace, caller, now); err != nil {
+				return nil, nil, err
+			}
+			denials[sp.Namespace] = denial
+			if denial != nil && (soonest == nil || denial.RetryAfter < soonest.RetryAfter) {
+				soonest = denial
+			}
+		}
+		if denial == nil {
+			allowed = append(allowed, sp)
+		}
+	}
+	return allowed, soonest, nil
+}
+
+// namespacesOf returns the namespaces of the ScalablePods.
+func namespacesOf(scalablePods []scalablev1.ScalablePod) []string {
+	var namespaces []string
+	seen := map[string]bool{}
+	for _, sp := range scalablePods {
+		if !seen[sp.Namespace] {
+			seen[sp.Namespace] = true
+			namespaces = append(namespaces, sp.Namespace)
+		}
+	}
+	return namespaces
+}
+
+// recordDemand tells the forecaster about a request served by a ScalablePod, if that ScalablePod is in a pool.
+func recordDemand(forecaster *controllers.DemandForecaster, sp *scalablev1.ScalablePod, hit bool) {
+	if pool := sp.Labels[scalablev1.PoolLabel]; pool != "" {
+		forecaster.Record(types.NamespacedName{Namespace: sp.Namespace, Name: pool}, hit)
+	}
+}
+
+// activeByPool counts the requested ScalablePods in each pool.
+func activeByPool(scalablePods []scalablev1.ScalablePod) map[types.NamespacedName]int32 {
+	active := map[types.NamespacedName]int32{}
+	for _, sp := range scalablePods {
+		if pool := sp.Labels[scalablev1.PoolLabel]; pool != "" && sp.Status.Requested {
+			active[types.NamespacedName{Namespace: sp.Namespace, Name: pool}]++
+		}
+	}
+	return active
+}
+
+// poolAtCapacity reports whether the ScalablePod's pool already has as many active ScalablePods as its current
+// schedule allows. ScalablePods outside a pool, or in a pool that doesn't exist, are never capped.
+func poolAtCapacity(ctx context.Context, c client.Client, sp *scalablev1.ScalablePod, active map[types.NamespacedName]int32) (bool, error) {
+	name := sp.Labels[scalablev1.PoolLabel]
+	if name == "" {
+		return false, nil
+	}
+	key := types.NamespacedName{Namespace: sp.Namespace, Name: name}
+	var pool scalablev1.ScalablePodPool
+	if err := c.Get(ctx, key, &pool); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return pool.Status.MaxActive != nil && active[key] >= *pool.Status.MaxActive, nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/controllers"
+	"github.com/edwmorgan/k8s-operator-example/ratelimit"
+)
+
+// slowReader is a client.Reader whose lists take a while, as they can from the API server, which leaves concurrent
+// requests time to race.
+type slowReader struct {
+	client.Reader
+}
+
+func (r slowReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	time.Sleep(10 * time.Millisecond)
+	return r.Reader.List(ctx, list, opts...)
+}
+
+func TestRequestsWithinQuotaConcurrently(t *testing.T) {
+	const maxActive = 3
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	limit := int32(maxActive)
+	objs := []client.Object{&scalablev1.ScalablePodQuota{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "everyone"},
+		Spec:       scalablev1.ScalablePodQuotaSpec{MaxActive: &limit},
+	}}
+	// More ScalablePods than the quota allows, so that only the quota refuses a request
+	for i := 0; i < maxActive+2; i++ {
+		inactive := scalablev1.SPInactive
+		objs = append(objs, &scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("sp%d", i)},
+			Spec:       scalablev1.ScalablePodSpec{MaxActiveTimeSec: 600},
+			Status:     scalablev1.ScalablePodStatus{Status: &inactive},
+		})
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	handler := RequestWrapper(&controllers.ScalablePodReconciler{Client: c, Scheme: scheme}, slowReader{c}, nil, nil,
+		&controllers.IdempotencyKeys{Clock: clock.RealClock{}}, &controllers.QuotaLocks{},
+		&ratelimit.PoolLimiter{Limiter: &ratelimit.Limiter{Clock: clock.RealClock{}}, Client: c})
+
+	codes := make(chan int, maxActive+1)
+	var wg sync.WaitGroup
+	for i := 0; i < maxActive+1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(http.MethodGet, "/request", nil))
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != maxActive || counts[http.StatusTooManyRequests] != 1 {
+		t.Errorf("expected %d claims and one 429, got %v", maxActive, counts)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metricsapi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The ConfigMap the API server publishes how the aggregator authenticates to extension API servers in
+var authenticationConfigMap = types.NamespacedName{Namespace: "kube-system", Name: "extension-apiserver-authentication"}
+
+//+kubebuilder:rbac:groups=core,resources=configmaps,resourceNames=extension-apiserver-authentication,verbs=get
+
+// requestHeaderAuth is how the aggregator identifies the callers it proxies: it connects with a client certificate
+// signed by the requestheader CA and passes on the caller's name and groups in headers.
+type requestHeaderAuth struct {
+	ClientCAs *x509.CertPool
+	// Common names the aggregator's certificate may have. Any name signed by the CA is accepted if it is empty.
+	AllowedNames    []string
+	UsernameHeaders []string
+	GroupHeaders    []string
+}
+
+// loadRequestHeaderAuth reads the requestheader settings from the extension-apiserver-authentication ConfigMap.
+func loadRequestHeaderAuth(ctx context.Context, c client.Reader) (*requestHeaderAuth, error) {
+	var configMap corev1.ConfigMap
+	if err := c.Get(ctx, authenticationConfigMap, &configMap); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", authenticationConfigMap, err)
+	}
+	caPEM := configMap.Data["requestheader-client-ca-file"]
+	if caPEM == "" {
+		return nil, fmt.Errorf("%s has no requestheader-client-ca-file, so the aggregator can't be authenticated", authenticationConfigMap)
+	}
+	config := &requestHeaderAuth{ClientCAs: x509.NewCertPool()}
+	if !config.ClientCAs.AppendCertsFromPEM([]byte(caPEM)) {
+		return nil, fmt.Errorf("%s has no certificates in requestheader-client-ca-file", authenticationConfigMap)
+	}
+	for key, into := range map[string]*[]string{
+		"requestheader-allowed-names":    &config.AllowedNames,
+		"requestheader-username-headers": &config.UsernameHeaders,
+		"requestheader-group-headers":    &config.GroupHeaders,
+	} {
+		if value := configMap.Data[key]; value != "" {
+			if err := json.Unmarshal([]byte(value), into); err != nil {
+				return nil, fmt.Errorf("unable to parse %s in %s: %v", key, authenticationConfigMap, err)
+			}
+		}
+	}
+	if len(config.UsernameHeaders) == 0 {
+		return nil, fmt.Errorf("%s has no requestheader-username-headers", authenticationConfigMap)
+	}
+	return config, nil
+}
+
+// caller returns the name and groups of the caller the aggregator proxied the request for. The request must come
+// over a client certificate the TLS handshake verified against the requestheader CA.
+func (a *requestHeaderAuth) caller(r *http.Request) (string, []string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil, errors.New("no verified client certificate")
+	}
+	if len(a.AllowedNames) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		allowed := false
+		for _, allowedName := range a.AllowedNames {
+			allowed = allowed || name == allowedName
+		}
+		if !allowed {
+			return "", nil, fmt.Errorf("client certificate %q isn't the aggregator's", name)
+		}
+	}
+	var username string
+	for _, header := range a.UsernameHeaders {
+		if username = r.Header.Get(header); username != "" {
+			break
+		}
+	}
+	if username == "" {
+		return "", nil, errors.New("no username from the aggregator")
+	}
+	var groups []string
+	for _, header := range a.GroupHeaders {
+		groups = append(groups, r.Header.Values(header)...)
+	}
+	return username, groups, nil
+}
+
+/* authenticated only passes on requests the aggregator proxied for callers with RBAC access to the metric, as
+ * decided by a SubjectAccessReview on the request's path, e.g. get on scalablepodpools.scalable.scalablepod.tutorial.io
+ * in the custom.metrics.k8s.io group. Anyone else who can reach the server is turned away.
+ */
+func (s *Server) authenticated(auth *requestHeaderAuth, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, groups, err := auth.caller(r)
+		if err != nil {
+			log.V(1).Info("Unauthenticated request", "path", r.URL.Path, "reason", err.Error())
+			writeStatus(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		review := &authorizationv1.SubjectAccessReview{Spec: authorizationv1.SubjectAccessReviewSpec{User: username, Groups: groups}}
+		if attributes := resourceAttributes(r); attributes != nil {
+			review.Spec.ResourceAttributes = attributes
+		} else {
+			review.Spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{Path: r.URL.Path, Verb: "get"}
+		}
+		if err := s.Client.Create(r.Context(), review); err != nil {
+			log.Error(err, "Unable to review access", "user", username, "path", r.URL.Path)
+			writeStatus(w, http.StatusInternalServerError, "unable to review access")
+			return
+		}
+		if !review.Status.Allowed {
+			writeStatus(w, http.StatusForbidden, fmt.Sprintf("%s may not read %s", username, r.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* resourceAttributes returns what a request reads, as the API server would see it, or nil for discovery:
+ *   namespaces/<namespace>/metrics/<metric>                     get metrics <metric>
+ *   namespaces/<namespace>/<pool resource>/<pool>/<metric>      get <pool resource> <pool>, subresource <metric>
+ *   namespaces/<namespace>/<metric>                             list <metric>
+ */
+func resourceAttributes(r *http.Request) *authorizationv1.ResourceAttributes {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	var group, rest string
+	switch {
+	case strings.HasPrefix(path, customPrefix+"/"):
+		group, rest = "custom.metrics.k8s.io", strings.TrimPrefix(path, customPrefix+"/")
+	case strings.HasPrefix(path, externalPrefix+"/"):
+		group, rest = "external.metrics.k8s.io", strings.TrimPrefix(path, externalPrefix+"/")
+	default:
+		return nil
+	}
+	attributes := &authorizationv1.ResourceAttributes{Group: group, Version: "v1beta1", Verb: "list"}
+	parts := strings.Split(rest, "/")
+	if len(parts) >= 2 && parts[0] == "namespaces" {
+		attributes.Namespace, parts = parts[1], parts[2:]
+	}
+	if len(parts) > 0 {
+		attributes.Resource = parts[0]
+	}
+	if len(parts) > 1 {
+		attributes.Name, attributes.Verb = parts[1], "get"
+	}
+	if len(parts) > 2 {
+		attributes.Subresource = parts[2]
+	}
+	return attributes
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metricsapi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/cert"
+	custommetrics "k8s.io/metrics/pkg/apis/custom_metrics/v1beta1"
+	externalmetrics "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/controllers"
+)
+
+var log = logf.Log.WithName("metricsapi")
+
+// Metrics served, for a namespace, a ScalablePodPool or the ScalablePods matching a label selector
+const (
+	// ScalablePods claimed by a request
+	ActiveScalablePodsMetric = "active_scalablepods"
+	// Claimed ScalablePods still waiting for their pod to be Ready
+	WaitingRequestsMetric = "waiting_requests"
+	// Mean time claimed ScalablePods took from being requested to having a Ready pod
+	MeanTimeToReadyMetric = "mean_time_to_ready_seconds"
+)
+
+var metricNames = []string{ActiveScalablePodsMetric, WaitingRequestsMetric, MeanTimeToReadyMetric}
+
+const (
+	customPrefix   = "/apis/custom.metrics.k8s.io/v1beta1"
+	externalPrefix = "/apis/external.metrics.k8s.io/v1beta1"
+	poolResource   = "scalablepodpools.scalable.scalablepod.tutorial.io"
+)
+
+// Server serves ScalablePod usage through the custom and external metrics APIs, so HorizontalPodAutoscalers can
+// scale other workloads on ScalablePod load. It runs behind the API aggregator, which the APIServices in
+// config/metrics-apiserver point at it. Custom metrics describe a namespace or a ScalablePodPool:
+//   /apis/custom.metrics.k8s.io/v1beta1/namespaces/<namespace>/metrics/<metric>
+//   /apis/custom.metrics.k8s.io/v1beta1/namespaces/<namespace>/scalablepodpools.scalable.scalablepod.tutorial.io/<pool>/<metric>
+// External metrics describe the ScalablePods in a namespace that match the label selector:
+//   /apis/external.metrics.k8s.io/v1beta1/namespaces/<namespace>/<metric>?labelSelector=<selector>
+// Only the aggregator may connect, with the client certificate the API server's requestheader CA signed, and only
+// for callers RBAC lets read the metric.
+type Server struct {
+	Client client.Client
+	// Reads the extension-apiserver-authentication ConfigMap without caching ConfigMaps. Client is used if it is nil.
+	APIReader client.Reader
+	// Address the HTTPS server listens on
+	BindAddress string
+	// Directory holding tls.crt and tls.key. A self-signed certificate is generated if it is empty.
+	CertDir string
+}
+
+// Start serves the metrics APIs until the context is cancelled.
+// The requestheader CA is read once, so the server must be restarted if it is rotated.
+func (s *Server) Start(ctx context.Context) error {
+	certificate, err := s.certificate()
+	if err != nil {
+		return err
+	}
+	reader := s.APIReader
+	if reader == nil {
+		reader = s.Client
+	}
+	auth, err := loadRequestHeaderAuth(ctx, reader)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:    s.BindAddress,
+		Handler: s.authenticated(auth, s),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    auth.ClientCAs,
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	log.Info("Serving custom and external metrics APIs", "address", s.BindAddress)
+	if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection is false as the metrics are only read, so every replica can serve them.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Server) certificate() (tls.Certificate, error) {
+	if s.CertDir != "" {
+		return tls.LoadX509KeyPair(filepath.Join(s.CertDir, "tls.crt"), filepath.Join(s.CertDir, "tls.key"))
+	}
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey("scalablepod-metrics-apiserver", nil, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatus(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case path == customPrefix:
+		writeJSON(w, customResources())
+	case path == externalPrefix:
+		writeJSON(w, externalResources())
+	case strings.HasPrefix(path, customPrefix+"/"):
+		s.serveCustom(w, r, strings.Split(strings.TrimPrefix(path, customPrefix+"/"), "/"))
+	case strings.HasPrefix(path, externalPrefix+"/"):
+		s.serveExternal(w, r, strings.Split(strings.TrimPrefix(path, externalPrefix+"/"), "/"))
+	default:
+		writeStatus(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serveCustom serves namespaces/<namespace>/metrics/<metric> and namespaces/<namespace>/<pool resource>/<pool>/<metric>.
+func (s *Server) serveCustom(w http.ResponseWriter, r *http.Request, parts []string) {
+	var namespace, pool, metric string
+	switch {
+	case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "metrics":
+		namespace, metric = parts[1], parts[3]
+	case len(parts) == 5 && parts[0] == "namespaces" && parts[2] == poolResource:
+		namespace, pool, metric = parts[1], parts[3], parts[4]
+	default:
+		writeStatus(w, http.StatusNotFound, "not found")
+		return
+	}
+	if !knownMetric(metric) {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("unknown metric %q", metric))
+		return
+	}
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := metav1.Now()
+	list := custommetrics.MetricValueList{TypeMeta: metav1.TypeMeta{Kind: "MetricValueList", APIVersion: "custom.metrics.k8s.io/v1beta1"}}
+	if pool == "" {
+		usage, err := s.usage(r.Context(), namespace, "", labels.Everything())
+		if err != nil {
+			writeStatus(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		list.Items = append(list.Items, custommetrics.MetricValue{
+			DescribedObject: corev1.ObjectReference{APIVersion: "v1", Kind: "Namespace", Name: namespace},
+			MetricName:      metric,
+			Timestamp:       now,
+			Value:           value(usage, metric),
+		})
+		writeJSON(w, list)
+		return
+	}
+
+	pools := []string{pool}
+	if pool == custommetrics.AllObjects {
+		var poolList scalablev1.ScalablePodPoolList
+		if err := s.Client.List(r.Context(), &poolList, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			writeStatus(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		pools = nil
+		for _, pool := range poolList.Items {
+			pools = append(pools, pool.Name)
+		}
+	}
+	for _, pool := range pools {
+		usage, err := s.usage(r.Context(), namespace, pool, labels.Everything())
+		if err != nil {
+			writeStatus(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		list.Items = append(list.Items, custommetrics.MetricValue{
+			DescribedObject: corev1.ObjectReference{APIVersion: scalablev1.GroupVersion.String(), Kind: "ScalablePodPool", Namespace: namespace, Name: pool},
+			MetricName:      metric,
+			Timestamp:       now,
+			Value:           value(usage, metric),
+		})
+	}
+	writeJSON(w, list)
+}
+
+// serveExternal serves namespaces/<namespace>/<metric>.
+func (s *Server) serveExternal(w http.ResponseWriter, r *http.Request, parts []string) {
+	if len(parts) != 3 || parts[0] != "namespaces" {
+		writeStatus(w, http.StatusNotFound, "not found")
+		return
+	}
+	namespace, metric := parts[1], parts[2]
+	if !knownMetric(metric) {
+		writeStatus(w, http.StatusNotFound, fmt.Sprintf("unknown metric %q", metric))
+		return
+	}
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	usage, err := s.usage(r.Context(), namespace, "", selector)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	metricLabels, _ := labels.ConvertSelectorToLabelsMap(selector.String())
+	writeJSON(w, externalmetrics.ExternalMetricValueList{
+		TypeMeta: metav1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: "external.metrics.k8s.io/v1beta1"},
+		Items: []externalmetrics.ExternalMetricValue{{
+			MetricName:   metric,
+			MetricLabels: metricLabels,
+			Timestamp:    metav1.Now(),
+			Value:        value(usage, metric),
+		}},
+	})
+}
+
+// usage counts the ScalablePods in the namespace, optionally only those in a pool or matching a selector.
+func (s *Server) usage(ctx context.Context, namespace, pool string, selector labels.Selector) (controllers.Usage, error) {
+	if pool != "" {
+		requirement, err := labels.NewRequirement(scalablev1.PoolLabel, "=", []string{pool})
+		if err != nil {
+			return controllers.Usage{}, err
+		}
+		selector = selector.Add(*requirement)
+	}
+	var scalablePods scalablev1.ScalablePodList
+	if err := s.Client.List(ctx, &scalablePods, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return controllers.Usage{}, err
+	}
+	return controllers.UsageOf(scalablePods.Items), nil
+}
+
+func value(usage controllers.Usage, metric string) resource.Quantity {
+	switch metric {
+	case WaitingRequestsMetric:
+		return *resource.NewQuantity(usage.Waiting, resource.DecimalSI)
+	case MeanTimeToReadyMetric:
+		return *resource.NewMilliQuantity(usage.MeanTimeToReady.Milliseconds(), resource.DecimalSI)
+	default:
+		return *resource.NewQuantity(usage.Active, resource.DecimalSI)
+	}
+}
+
+func knownMetric(metric string) bool {
+	for _, name := range metricNames {
+		if metric == name {
+			return true
+		}
+	}
+	return false
+}
+
+// customResources lists the custom metrics for API discovery.
+func customResources() metav1.APIResourceList {
+	list := metav1.APIResourceList{TypeMeta: metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"}, GroupVersion: "custom.metrics.k8s.io/v1beta1"}
+	for _, metric := range metricNames {
+		list.APIResources = append(list.APIResources,
+			metav1.APIResource{Name: "namespaces/" + metric, Namespaced: false, Kind: "MetricValueList", Verbs: []string{"get"}},
+			metav1.APIResource{Name: poolResource + "/" + metric, Namespaced: true, Kind: "MetricValueList", Verbs: []string{"get"}},
+		)
+	}
+	return list
+}
+
+// externalResources lists the external metrics for API discovery.
+func externalResources() metav1.APIResourceList {
+	list := metav1.APIResourceList{TypeMeta: metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"}, GroupVersion: "external.metrics.k8s.io/v1beta1"}
+	for _, metric := range metricNames {
+		list.APIResources = append(list.APIResources,
+			metav1.APIResource{Name: metric, Namespaced: true, Kind: "ExternalMetricValueList", Verbs: []string{"get"}},
+		)
+	}
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		log.Error(err, "Unable to write metrics response")
+	}
+}
+
+// writeStatus writes an error the way the Kubernetes API does.
+func writeStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  message,
+		Code:     int32(code),
+	})
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metricsapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/util/cert"
+	custommetrics "k8s.io/metrics/pkg/apis/custom_metrics/v1beta1"
+	externalmetrics "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+func newServer(t *testing.T) *Server {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	active := scalablev1.SPActive
+	requestedAt := metav1.NewTime(time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC))
+	readyAt := metav1.NewTime(requestedAt.Add(3 * time.Second))
+	objs := []runtime.Object{
+		&scalablev1.ScalablePodPool{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}},
+		&scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ready", Labels: map[string]string{scalablev1.PoolLabel: "web"}},
+			Status:     scalablev1.ScalablePodStatus{Status: &active, Requested: true, RequestedAt: &requestedAt, ReadyAt: &readyAt},
+		},
+		&scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "starting", Labels: map[string]string{scalablev1.PoolLabel: "web"}},
+			Status:     scalablev1.ScalablePodStatus{Status: &active, Requested: true, RequestedAt: &requestedAt},
+		},
+		&scalablev1.ScalablePod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unpooled"},
+			Status:     scalablev1.ScalablePodStatus{Status: &active, Requested: true, RequestedAt: &requestedAt, ReadyAt: &readyAt},
+		},
+	}
+	return &Server{Client: fake.NewFakeClientWithScheme(scheme, objs...)}
+}
+
+func get(t *testing.T, s *Server, path string, into interface{}) int {
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), into); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestCustomMetrics(t *testing.T) {
+	s := newServer(t)
+
+	var list custommetrics.MetricValueList
+	if code := get(t, s, "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/metrics/active_scalablepods", &list); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(list.Items) != 1 || list.Items[0].DescribedObject.Kind != "Namespace" || list.Items[0].Value.Value() != 3 {
+		t.Errorf("expected 3 active ScalablePods in the namespace, got %+v", list.Items)
+	}
+
+	list = custommetrics.MetricValueList{}
+	if code := get(t, s, "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/scalablepodpools.scalable.scalablepod.tutorial.io/*/waiting_requests", &list); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(list.Items) != 1 || list.Items[0].DescribedObject.Name != "web" || list.Items[0].Value.Value() != 1 {
+		t.Errorf("expected 1 waiting request in pool web, got %+v", list.Items)
+	}
+
+	list = custommetrics.MetricValueList{}
+	if code := get(t, s, "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/scalablepodpools.scalable.scalablepod.tutorial.io/web/mean_time_to_ready_seconds", &list); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(list.Items) != 1 || list.Items[0].Value.MilliValue() != 3000 {
+		t.Errorf("expected a mean time to ready of 3s, got %+v", list.Items)
+	}
+
+	if code := get(t, s, "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/metrics/cpu", &list); code != http.StatusNotFound {
+		t.Errorf("expected unknown metrics to be not found, got status %d", code)
+	}
+}
+
+func TestExternalMetrics(t *testing.T) {
+	s := newServer(t)
+
+	var list externalmetrics.ExternalMetricValueList
+	if code := get(t, s, "/apis/external.metrics.k8s.io/v1beta1/namespaces/default/active_scalablepods?labelSelector=scalable.scalablepod.tutorial.io%2Fpool%3Dweb", &list); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(list.Items) != 1 || list.Items[0].Value.Value() != 2 {
+		t.Errorf("expected 2 active ScalablePods in pool web, got %+v", list.Items)
+	}
+
+	var resources metav1.APIResourceList
+	if code := get(t, s, "/apis/external.metrics.k8s.io/v1beta1", &resources); code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+	if len(resources.APIResources) != len(metricNames) {
+		t.Errorf("expected every metric to be discoverable, got %+v", resources.APIResources)
+	}
+}
+
+// reviewingClient allows the SubjectAccessReviews of one user.
+type reviewingClient struct {
+	client.Client
+	allowed string
+	reviews []authorizationv1.SubjectAccessReviewSpec
+}
+
+func (c *reviewingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if review, ok := obj.(*authorizationv1.SubjectAccessReview); ok {
+		c.reviews = append(c.reviews, review.Spec)
+		review.Status.Allowed = review.Spec.User == c.allowed
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestLoadRequestHeaderAuth(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	caPEM, _, err := cert.GenerateSelfSignedCertKey("front-proxy-ca", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "extension-apiserver-authentication"},
+		Data: map[string]string{
+			"requestheader-client-ca-file":   string(caPEM),
+			"requestheader-allowed-names":    `["front-proxy-client"]`,
+			"requestheader-username-headers": `["X-Remote-User"]`,
+			"requestheader-group-headers":    `["X-Remote-Group"]`,
+		},
+	}
+	auth, err := loadRequestHeaderAuth(context.Background(), fake.NewFakeClientWithScheme(scheme, configMap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.AllowedNames) != 1 || auth.UsernameHeaders[0] != "X-Remote-User" || auth.GroupHeaders[0] != "X-Remote-Group" {
+		t.Errorf("expected the requestheader settings, got %+v", auth)
+	}
+
+	delete(configMap.Data, "requestheader-client-ca-file")
+	if _, err := loadRequestHeaderAuth(context.Background(), fake.NewFakeClientWithScheme(scheme, configMap)); err == nil {
+		t.Error("expected an error without a requestheader CA")
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	c := &reviewingClient{Client: newServer(t).Client, allowed: "system:serviceaccount:kube-system:horizontal-pod-autoscaler"}
+	s := &Server{Client: c}
+	auth := &requestHeaderAuth{AllowedNames: []string{"front-proxy-client"}, UsernameHeaders: []string{"X-Remote-User"}, GroupHeaders: []string{"X-Remote-Group"}}
+	handler := s.authenticated(auth, s)
+	path := "/apis/custom.metrics.k8s.io/v1beta1/namespaces/default/scalablepodpools.scalable.scalablepod.tutorial.io/web/active_scalablepods"
+
+	for _, test := range []struct {
+		name       string
+		clientName string
+		user       string
+		code       int
+	}{
+		{"no client certificate", "", c.allowed, http.StatusUnauthorized},
+		{"another client certificate", "someone", c.allowed, http.StatusUnauthorized},
+		{"no user", "front-proxy-client", "", http.StatusUnauthorized},
+		{"user without access", "front-proxy-client", "mallory", http.StatusForbidden},
+		{"user with access", "front-proxy-client", c.allowed, http.StatusOK},
+	} {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.TLS = &tls.ConnectionState{}
+		if test.clientName != "" {
+			request.TLS.VerifiedChains = [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: test.clientName}}}}
+		}
+		if test.user != "" {
+			request.Header.Set("X-Remote-User", test.user)
+		}
+		request.Header.Add("X-Remote-Group", "system:serviceaccounts")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.code {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.code, recorder.Code)
+		}
+	}
+
+	review := c.reviews[len(c.reviews)-1]
+	if attributes := review.ResourceAttributes; attributes == nil || attributes.Group != "custom.metrics.k8s.io" || attributes.Namespace != "default" ||
+		attributes.Resource != "scalablepodpools.scalable.scalablepod.tutorial.io" || attributes.Name != "web" || attributes.Verb != "get" ||
+		attributes.Subresource != "active_scalablepods" || len(review.Groups) != 1 {
+		t.Errorf("expected a review of getting the pool's metric, got %+v", review)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/auth"
+	"github.com/edwmorgan/k8s-operator-example/ttlcache"
+)
+
+// Which limit refused a request
+const (
+	// The request server's limit, from its flags
+	ScopeGlobal = "global"
+	// A ScalablePodPool's spec.rateLimit
+	ScopePool = "pool"
+	// The limit on each source IP, checked before callers are authenticated
+	ScopeSource = "source"
+)
+
+// Most buckets kept at once. Buckets expire once they have refilled, as they are the same as new ones then, and the
+// least recently used are dropped to make room for more.
+const maxBuckets = 10000
+
+var (
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scalablepod_rate_limited_total",
+		Help: "Requests turned away because their caller exceeded a rate limit, by the limit that refused them",
+	}, []string{"namespace", "pool", "limit"})
+	trackedClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "scalablepod_rate_limit_clients",
+		Help: "Callers whose request rate is being tracked",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(rateLimited, trackedClients)
+}
+
+// Limit is a token bucket: Burst requests may be made at once, and the bucket refills at Rate requests a second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PoolLimit returns the limit in a ScalablePodPool's spec, and whether it has one.
+func PoolLimit(pool *scalablev1.ScalablePodPool) (Limit, bool) {
+	spec := pool.Spec.RateLimit
+	if spec == nil || spec.RequestsPerMinute <= 0 {
+		return Limit{}, false
+	}
+	limit := Limit{Rate: float64(spec.RequestsPerMinute) / 60, Burst: int(spec.RequestsPerMinute)}
+	if spec.Burst != nil && *spec.Burst > 0 {
+		limit.Burst = int(*spec.Burst)
+	}
+	return limit, true
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/* Limiter keeps a token bucket for each key, such as a caller, and refuses requests once the key's bucket is empty.
+ * A bucket whose limit changes, e.g. because its pool's spec was edited, keeps its tokens, up to the new burst.
+ */
+type Limiter struct {
+	// Clock buckets refill by
+	Clock clock.Clock
+
+	mu      sync.Mutex
+	buckets *ttlcache.Cache
+}
+
+// Take takes a token from the key's bucket. If the bucket is empty, it returns false and how long until it has a
+// token again.
+func (l *Limiter) Take(key string, limit Limit) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	now := l.Clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = ttlcache.New(maxBuckets)
+	}
+	b := &bucket{tokens: float64(limit.Burst), last: now}
+	if cached, ok := l.buckets.Get(key, now); ok {
+		b = cached.(*bucket)
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * limit.Rate
+		b.last = now
+	}
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	// Kept until it has refilled
+	refilled := time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second))
+	l.buckets.Set(key, b, now.Add(refilled))
+	trackedClients.Set(float64(l.buckets.Len()))
+	if allowed {
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// ClientKey returns who a request is counted against: the caller it authenticated as, or else its source IP.
+func ClientKey(r *http.Request) string {
+	if username := auth.Username(r.Context()); username != "" {
+		return "user:" + username
+	}
+	return sourceKey(r)
+}
+
+func sourceKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+/* SourceHandler limits how often each source IP may make requests. It goes in front of authentication, so that a
+ * flood of requests with bad or missing credentials is turned away before each costs a TokenReview. Requests over the
+ * limit get 429 Too Many Requests, with a Retry-After of when the source may try again.
+ */
+func SourceHandler(limiter *Limiter, limit Limit, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := sourceKey(r)
+		if ok, wait := limiter.Take(ScopeSource+"/"+key, limit); !ok {
+			ctrl.Log.WithName("ratelimit").Info("Rate limit exceeded", "path", r.URL.Path, "client", key, "limit", ScopeSource, "retryAfter", wait)
+			TooManyRequests(w, wait, "", "", ScopeSource)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* Handler limits how often each caller may make requests by the global limit. Requests over it get 429 Too Many
+ * Requests, with a Retry-After of when the caller may try again. Pools' limits are checked with a PoolLimiter once
+ * the request has picked the ScalablePod to claim.
+ */
+func Handler(limiter *Limiter, global Limit, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := ClientKey(r)
+		if ok, wait := limiter.Take(ScopeGlobal+"/"+key, global); !ok {
+			ctrl.Log.WithName("ratelimit").Info("Rate limit exceeded", "path", r.URL.Path, "client", key, "limit", ScopeGlobal, "retryAfter", wait)
+			TooManyRequests(w, wait, r.URL.Query().Get("namespace"), r.URL.Query().Get("pool"), ScopeGlobal)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* PoolLimiter limits how often each caller may claim ScalablePods from each pool, by the pool's spec.rateLimit. It is
+ * checked against the pool of the ScalablePod a request is about to claim, so the limit applies however the request
+ * picked it: by naming the pool, by a label selector, or by namespace alone.
+ */
+type PoolLimiter struct {
+	Limiter *Limiter
+	// Client to read ScalablePodPools with
+	Client client.Reader
+}
+
+// Take takes a token from the caller's bucket for the ScalablePod's pool, if it is in one with a limit. If the bucket
+// is empty, it returns false and how long until it has a token again.
+func (p *PoolLimiter) Take(ctx context.Context, clientKey string, sp *scalablev1.ScalablePod) (bool, time.Duration, error) {
+	name := sp.Labels[scalablev1.PoolLabel]
+	if name == "" {
+		return true, 0, nil
+	}
+	var pool scalablev1.ScalablePodPool
+	if err := p.Client.Get(ctx, types.NamespacedName{Namespace: sp.Namespace, Name: name}, &pool); client.IgnoreNotFound(err) != nil {
+		return false, 0, err
+	}
+	// A pool that doesn't exist has no limit
+	limit, ok := PoolLimit(&pool)
+	if !ok {
+		return true, 0, nil
+	}
+	ok, wait := p.Limiter.Take(fmt.Sprintf("%s/%s/%s/%s", ScopePool, sp.Namespace, name, clientKey), limit)
+	return ok, wait, nil
+}
+
+// TooManyRequests counts a request refused by a limit and answers it with 429 Too Many Requests and a Retry-After.
+func TooManyRequests(w http.ResponseWriter, wait time.Duration, namespace, pool, scope string) {
+	rateLimited.WithLabelValues(namespace, pool, scope).Inc()
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(fmt.Sprintf("Rate limit exceeded. Try again in %ds.\n", seconds)))
+}
+
+// Options configure the request server's global and source IP rate limits.
+type Options struct {
+	// Requests each caller may make a second, on average. Callers aren't limited if it is 0.
+	Rate float64
+	// Requests each caller may make at once after being idle. Defaults to Rate, rounded up.
+	Burst int
+	// Requests each source IP may make a second, on average, authenticated or not. Sources aren't limited if it is 0.
+	SourceRate float64
+	// Requests each source IP may make at once after being idle. Defaults to SourceRate, rounded up.
+	SourceBurst int
+}
+
+// BindFlags adds flags for the options to the flag set.
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.Float64Var(&o.Rate, "request-rate-limit", 0, "Requests a second each caller of the HTTP request server may make to /request, on average. Callers aren't limited if it is 0.")
+	fs.IntVar(&o.Burst, "request-rate-burst", 0, "Requests each caller of the HTTP request server may make to /request at once after being idle. Defaults to --request-rate-limit, rounded up.")
+	fs.Float64Var(&o.SourceRate, "request-source-rate-limit", 0, "Requests a second each source IP may make to the HTTP request server, on average, counted before callers are authenticated. Sources aren't limited if it is 0.")
+	fs.IntVar(&o.SourceBurst, "request-source-rate-burst", 0, "Requests each source IP may make to the HTTP request server at once after being idle. Defaults to --request-source-rate-limit, rounded up.")
+}
+
+// Limit returns the global limit the options describe.
+func (o *Options) Limit() (Limit, error) {
+	if o.Rate < 0 || o.Burst < 0 {
+		return Limit{}, errors.New("--request-rate-limit and --request-rate-burst can't be negative")
+	}
+	limit := Limit{Rate: o.Rate, Burst: o.Burst}
+	if limit.Burst == 0 {
+		limit.Burst = int(math.Ceil(o.Rate))
+	}
+	return limit, nil
+}
+
+// SourceLimit returns the source IP limit the options describe.
+func (o *Options) SourceLimit() (Limit, error) {
+	if o.SourceRate < 0 || o.SourceBurst < 0 {
+		return Limit{}, errors.New("--request-source-rate-limit and --request-source-rate-burst can't be negative")
+	}
+	limit := Limit{Rate: o.SourceRate, Burst: o.SourceBurst}
+	if limit.Burst == 0 {
+		limit.Burst = int(math.Ceil(o.SourceRate))
+	}
+	return limit, nil
+}
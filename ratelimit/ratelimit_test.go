@@ -0,0 +1,208 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+	"github.com/edwmorgan/k8s-operator-example/auth"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	limiter := &Limiter{Clock: fakeClock}
+	limit := Limit{Rate: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Take("a", limit); !ok {
+			t.Fatalf("expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	if ok, wait := limiter.Take("a", limit); ok || wait != 500*time.Millisecond {
+		t.Errorf("expected the empty bucket to refuse until it refills, got %t, %s", ok, wait)
+	}
+	if ok, _ := limiter.Take("b", limit); !ok {
+		t.Error("expected another key to have its own bucket")
+	}
+
+	now = now.Add(250 * time.Millisecond)
+	fakeClock.SetTime(now)
+	if ok, wait := limiter.Take("a", limit); ok || wait != 250*time.Millisecond {
+		t.Errorf("expected half a token to have refilled, got %t, %s", ok, wait)
+	}
+	now = now.Add(time.Hour)
+	fakeClock.SetTime(now)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Take("a", limit); !ok {
+			t.Fatalf("expected the bucket to refill no further than its burst, but request %d was refused", i+1)
+		}
+	}
+	if ok, _ := limiter.Take("a", limit); ok {
+		t.Error("expected the bucket to refill no further than its burst")
+	}
+
+	// A lowered burst caps the tokens left
+	now = now.Add(time.Hour)
+	fakeClock.SetTime(now)
+	if ok, _ := limiter.Take("a", Limit{Rate: 2, Burst: 1}); !ok {
+		t.Error("expected the first request to be allowed")
+	}
+	if ok, _ := limiter.Take("a", Limit{Rate: 2, Burst: 1}); ok {
+		t.Error("expected the lowered burst to apply")
+	}
+	if ok, _ := limiter.Take("a", Limit{}); !ok {
+		t.Error("expected no limit to allow everything")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	handler := Handler(&Limiter{Clock: fakeClock}, Limit{Rate: 1, Burst: 1},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(remoteAddr, caller string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/request", nil)
+		req.RemoteAddr = remoteAddr
+		if caller != "" {
+			req = req.WithContext(auth.NewContext(req.Context(), &auth.Identity{Username: caller}))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	if code := serve("10.0.0.1:1234", "").Code; code != http.StatusOK {
+		t.Errorf("expected the first request to pass, got %d", code)
+	}
+	response := serve("10.0.0.1:5678", "")
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected the global limit to refuse the IP for 1s, got %d, %q", response.Code, response.Header().Get("Retry-After"))
+	}
+
+	// Authenticated callers are counted by name, wherever they connect from
+	if code := serve("10.0.0.1:1234", "alice").Code; code != http.StatusOK {
+		t.Errorf("expected an authenticated caller to have its own bucket, got %d", code)
+	}
+	if code := serve("10.0.0.2:1234", "alice").Code; code != http.StatusTooManyRequests {
+		t.Errorf("expected the caller to be limited from another IP, got %d", code)
+	}
+}
+
+func TestPoolLimiter(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := scalablev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	burst := int32(1)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&scalablev1.ScalablePodPool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       scalablev1.ScalablePodPoolSpec{RateLimit: &scalablev1.RateLimitSpec{RequestsPerMinute: 6, Burst: &burst}},
+	}).Build()
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	limiter := &PoolLimiter{Limiter: &Limiter{Clock: fakeClock}, Client: c}
+	inPool := func(pool string) *scalablev1.ScalablePod {
+		sp := &scalablev1.ScalablePod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "sp"}}
+		if pool != "" {
+			sp.Labels = map[string]string{scalablev1.PoolLabel: pool}
+		}
+		return sp
+	}
+	take := func(clientKey, pool string) (bool, time.Duration) {
+		ok, wait, err := limiter.Take(context.Background(), clientKey, inPool(pool))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok, wait
+	}
+
+	if ok, _ := take("user:alice", "web"); !ok {
+		t.Error("expected the first claim from the pool to be allowed")
+	}
+	if ok, wait := take("user:alice", "web"); ok || wait != 10*time.Second {
+		t.Errorf("expected the pool's limit to refuse the caller for 10s, got %v, %v", ok, wait)
+	}
+	if ok, _ := take("user:bob", "web"); !ok {
+		t.Error("expected another caller to have its own bucket")
+	}
+	if ok, _ := take("user:alice", "missing"); !ok {
+		t.Error("expected a pool that doesn't exist not to limit")
+	}
+	if ok, _ := take("user:alice", ""); !ok {
+		t.Error("expected a ScalablePod outside any pool not to be limited")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	limit, err := (&Options{Rate: 0.5}).Limit()
+	if err != nil || limit.Rate != 0.5 || limit.Burst != 1 {
+		t.Errorf("expected the burst to default to the rate rounded up, got %+v, %v", limit, err)
+	}
+	if limit, err := (&Options{Rate: 5, Burst: 20}).Limit(); err != nil || limit.Burst != 20 {
+		t.Errorf("expected the burst to be kept, got %+v, %v", limit, err)
+	}
+	if _, err := (&Options{Rate: -1}).Limit(); err == nil {
+		t.Error("expected a negative rate to be refused")
+	}
+	if limit, err := (&Options{SourceRate: 2.5}).SourceLimit(); err != nil || limit.Rate != 2.5 || limit.Burst != 3 {
+		t.Errorf("expected the source burst to default to the source rate rounded up, got %+v, %v", limit, err)
+	}
+	if _, err := (&Options{SourceBurst: -1}).SourceLimit(); err == nil {
+		t.Error("expected a negative source burst to be refused")
+	}
+}
+
+func TestSourceHandler(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	fakeClock := clock.NewFakeClock(now)
+	reached := 0
+	handler := SourceHandler(&Limiter{Clock: fakeClock}, Limit{Rate: 1, Burst: 2},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached++ }))
+	serve := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/request", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := serve("10.0.0.1:1234"); code != http.StatusOK {
+			t.Fatalf("expected request %d of the burst to be allowed, got %d", i+1, code)
+		}
+	}
+	if code := serve("10.0.0.1:5678"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the source to be limited from another port, got %d", code)
+	}
+	if code := serve("10.0.0.2:1234"); code != http.StatusOK {
+		t.Errorf("expected another source to have its own bucket, got %d", code)
+	}
+	if reached != 3 {
+		t.Errorf("expected limited requests not to reach the next handler, got %d", reached)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing sets up OpenTelemetry tracing for the operator and carries trace context between a request and the
+// reconciles it causes.
+package tracing
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+// Exporters spans can be sent to
+const (
+	// Send spans to an OpenTelemetry collector over OTLP/gRPC
+	ExporterOTLP = "otlp"
+	// Print spans to stdout, for debugging and tests
+	ExporterStdout = "stdout"
+	// Don't record spans. Trace context is still passed on.
+	ExporterNone = "none"
+)
+
+// Options configure how spans are exported.
+type Options struct {
+	// One of the Exporter constants
+	Exporter string
+	// host:port of the OTLP collector
+	Endpoint string
+	// Send spans to the collector without TLS
+	Insecure bool
+	// Fraction of new traces to sample. Traces started upstream keep their sampling decision.
+	SampleRatio float64
+	// Name this process is known by in traces
+	ServiceName string
+}
+
+// BindFlags adds flags for the options to the flag set.
+func (o *Options) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Exporter, "tracing-exporter", ExporterNone, "Where to send trace spans: otlp, stdout or none.")
+	fs.StringVar(&o.Endpoint, "otlp-endpoint", "localhost:4317", "The host:port of the OTLP collector traces are sent to.")
+	fs.BoolVar(&o.Insecure, "otlp-insecure", false, "Send traces to the OTLP collector without TLS.")
+	fs.Float64Var(&o.SampleRatio, "tracing-sample-ratio", 1, "The fraction of new traces to sample.")
+}
+
+// Setup installs a global tracer provider that exports spans as configured, and the W3C trace context propagator.
+// The returned function flushes any buffered spans and stops the exporter.
+func Setup(ctx context.Context, o Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch o.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(o.Endpoint)}
+		if o.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", o.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(o.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the operator's tracer from the global tracer provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer("github.com/edwmorgan/k8s-operator-example")
+}
+
+// End ends the span, marking it failed if err isn't nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Annotate records the span in the context on the object, for Link to find. It reports whether the object changed.
+func Annotate(ctx context.Context, obj metav1.Object) bool {
+	carrier := propagation.HeaderCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	traceParent := carrier.Get("traceparent")
+	if traceParent == "" || obj.GetAnnotations()[scalablev1.TraceParentAnnotation] == traceParent {
+		return false
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[scalablev1.TraceParentAnnotation] = traceParent
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// Link returns links to the span Annotate recorded on the object, if any.
+func Link(obj metav1.Object) []trace.Link {
+	traceParent := obj.GetAnnotations()[scalablev1.TraceParentAnnotation]
+	if traceParent == "" {
+		return nil
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier{"Traceparent": []string{traceParent}})
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return nil
+	}
+	return []trace.Link{{SpanContext: spanContext}}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	scalablev1 "github.com/edwmorgan/k8s-operator-example/api/v1"
+)
+
+func TestAnnotateAndLink(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	ctx, span := provider.Tracer("test").Start(context.Background(), "claim")
+	defer span.End()
+	sp := &scalablev1.ScalablePod{ObjectMeta: metav1.ObjectMeta{Name: "sp1"}}
+
+	if Link(sp) != nil {
+		t.Error("expected no link before the ScalablePod is annotated")
+	}
+	if !Annotate(ctx, sp) {
+		t.Fatal("expected the ScalablePod to be annotated")
+	}
+	if Annotate(ctx, sp) {
+		t.Error("expected annotating with the same span to change nothing")
+	}
+	links := Link(sp)
+	if len(links) != 1 || links[0].SpanContext.TraceID() != span.SpanContext().TraceID() || links[0].SpanContext.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("expected a link to the claim span, got %+v", links)
+	}
+
+	if Annotate(context.Background(), &scalablev1.ScalablePod{}) {
+		t.Error("expected no annotation without a span")
+	}
+}
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Options{Exporter: ExporterStdout, SampleRatio: 1, ServiceName: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Tracer().Start(context.Background(), "test")
+	if !span.SpanContext().IsSampled() {
+		t.Error("expected spans to be sampled")
+	}
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Setup(context.Background(), Options{Exporter: "zipkin"}); err == nil {
+		t.Error("expected unknown exporters to be rejected")
+	}
+}
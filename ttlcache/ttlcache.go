@@ -0,0 +1,107 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ttlcache keeps short-lived results, such as API server reviews, in memory with a bound on how many.
+package ttlcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+/* Cache maps keys to values that expire. It holds at most MaxEntries: once full, storing another value drops the
+ * least recently used one, so that a burst of new keys can't push the cache past its bound or wipe out the keys that
+ * are in use. Expired values are dropped when they are next read. It is safe for concurrent use; the zero value is an
+ * empty, unbounded cache.
+ */
+type Cache struct {
+	// Most values kept at once, or no limit if 0
+	MaxEntries int
+
+	mu sync.Mutex
+	// Entries by key, and in order of use, most recent first
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// New returns an empty cache holding at most maxEntries values.
+func New(maxEntries int) *Cache {
+	return &Cache{MaxEntries: maxEntries}
+}
+
+// Get returns the key's value, and whether it has one that hasn't expired by `now`.
+func (c *Cache) Get(key string, now time.Time) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if e := element.Value.(*entry); now.Before(e.expires) {
+		c.order.MoveToFront(element)
+		return e.value, true
+	}
+	c.remove(element)
+	return nil, false
+}
+
+// Set stores the key's value until it expires, dropping the least recently used value if the cache is full.
+func (c *Cache) Set(key string, value interface{}, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		e := element.Value.(*entry)
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[string]*list.Element{}
+		c.order = list.New()
+	}
+	for c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expires: expires})
+}
+
+// Delete drops the key's value, if it has one.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// Len returns how many values are kept, including expired ones that haven't been dropped yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *Cache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*entry).key)
+}
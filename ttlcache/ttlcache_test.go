@@ -0,0 +1,79 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ttlcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	cache := &Cache{}
+	cache.Set("a", 1, now.Add(time.Minute))
+
+	if value, ok := cache.Get("a", now); !ok || value != 1 {
+		t.Fatalf("expected a to be cached, got %v, %v", value, ok)
+	}
+	now = now.Add(time.Minute)
+	if _, ok := cache.Get("a", now); ok {
+		t.Fatal("expected a to have expired")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected the expired value to be dropped, but %d are kept", cache.Len())
+	}
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	cache := &Cache{MaxEntries: 3}
+	for i := 0; i < 3; i++ {
+		cache.Set(fmt.Sprint(i), i, now.Add(time.Hour))
+	}
+	// 0 is used again, so 1 is now the least recently used
+	cache.Get("0", now)
+	cache.Set("3", 3, now.Add(time.Hour))
+
+	if cache.Len() != 3 {
+		t.Errorf("expected 3 values, got %d", cache.Len())
+	}
+	if _, ok := cache.Get("1", now); ok {
+		t.Error("expected 1 to have been evicted")
+	}
+	for _, key := range []string{"0", "2", "3"} {
+		if _, ok := cache.Get(key, now); !ok {
+			t.Errorf("expected %s to be kept", key)
+		}
+	}
+}
+
+func TestSetReplaces(t *testing.T) {
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	cache := &Cache{MaxEntries: 1}
+	cache.Set("a", 1, now.Add(time.Minute))
+	cache.Set("a", 2, now.Add(time.Hour))
+	now = now.Add(30 * time.Minute)
+
+	if value, ok := cache.Get("a", now); !ok || value != 2 {
+		t.Errorf("expected the replaced value, got %v, %v", value, ok)
+	}
+	cache.Delete("a")
+	if _, ok := cache.Get("a", now); ok {
+		t.Error("expected a to have been deleted")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Header carrying the session token of the ScalablePod serving a client. The activator sets it on responses, and
+// requests that send it back are proxied to the same ScalablePod without claiming another.
+const claimHeader = "X-ScalablePod-Claim"
+
+/* Activator claims a ScalablePod for each new client, holds the request until the ScalablePod's pod is Ready, and then
+ * reverse-proxies it to the pod. Responses are streamed back as they arrive, and upgraded connections such as
+ * websockets are passed through. ScalablePods without a port keep the old behaviour of answering as soon as one is
+ * claimed, as there is nothing to proxy to.
+ * Clients are given a session for their claim, and requests that carry it go to the same ScalablePod and renew its
+ * lease. Once that ScalablePod has been released, the client is given a new one.
+ * Requests that no route matches are not found.
+ */
+type Activator struct {
+	Operator *OperatorClient
+	Sessions *Sessions
+	// Which ScalablePods serve each request
+	Routes *RoutingTable
+	// How long to hold a request while its ScalablePod starts
+	ActivationTimeout time.Duration
+	// How often to ask the operator whether the pod is Ready
+	PollInterval time.Duration
+}
+
+func (a *Activator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+	var route *Route
+	var outcome string
+	metrics := httpsnoop.CaptureMetrics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route, outcome = a.serve(w, req)
+	}), w, req)
+	recordRequest(route, outcome, metrics.Code, metrics.Duration)
+}
+
+// serve serves the request, and returns the route it took, if any, and its outcome.
+func (a *Activator) serve(w http.ResponseWriter, req *http.Request) (*Route, string) {
+	log := logr.FromContextOrDiscard(req.Context())
+	route, ok := a.Routes.Match(req)
+	if !ok {
+		log.V(1).Info("No route for request", "host", req.Host)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Nothing is served here.\n"))
+		return nil, outcomeNoRoute
+	}
+	log = log.WithValues("route", route.key())
+	if claimID, ok := a.Sessions.ClaimID(req, route); ok {
+		claim, err := a.Operator.Renew(req.Context(), claimID)
+		switch {
+		case errors.Is(err, errClaimGone):
+			log.Info("Session's ScalablePod has been released, claiming another", "claimID", claimID)
+		case err != nil:
+			log.Error(err, "Unable to renew ScalablePod claim", "claimID", claimID)
+			writeOperatorError(w, err)
+			return route, outcomeOperatorError
+		default:
+			log = log.WithValues("claimID", claimID, "scalablepod", claim.Name, "namespace", claim.Namespace)
+			log.V(1).Info("Renewed session's ScalablePod claim")
+			a.Sessions.Set(w, req, route, claimID)
+			if claim.Port == 0 {
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("ScalablePod is running.\n"))
+				return route, outcomeRunning
+			}
+			return route, a.proxyWhenReady(w, req, route, claim, nil, log)
+		}
+	} else if req.Header.Get(claimHeader) != "" {
+		log.Info("Ignoring session with an invalid signature")
+	}
+
+	allocation, err := a.Operator.Allocate(req.Context(), route)
+	switch {
+	case errors.Is(err, errNoCapacity):
+		log.Info("No resources available to schedule")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No resources currently available. Try again later.\n"))
+		return route, outcomeNoCapacity
+	case err != nil:
+		log.Error(err, "Operator failed to schedule a ScalablePod")
+		writeOperatorError(w, err)
+		return route, outcomeOperatorError
+	}
+	log = log.WithValues("claimID", allocation.ClaimID, "scalablepod", allocation.Name, "namespace", allocation.Namespace)
+	log.Info("Operator scheduled a ScalablePod")
+	a.Sessions.Set(w, req, route, allocation.ClaimID)
+	if allocation.Port == 0 {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Spinning up ScalablePod...\n"))
+		return route, outcomeStarted
+	}
+	return route, a.proxyWhenReady(w, req, route, &Claim{ClaimID: allocation.ClaimID}, allocation, log)
+}
+
+// proxyWhenReady holds the request until the claim's pod is Ready and then proxies it there, returning the outcome.
+func (a *Activator) proxyWhenReady(w http.ResponseWriter, req *http.Request, route *Route, claim *Claim, allocation *Allocation, log logr.Logger) string {
+	if !claim.Ready {
+		start := time.Now()
+		var err error
+		claim, err = a.waitUntilReady(req.Context(), claim.ClaimID, allocation)
+		switch {
+		case errors.Is(err, errClaimGone):
+			log.Info("ScalablePod was released before it was Ready")
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte("This ScalablePod has been released. Try again to be given another.\n"))
+			return outcomeReleased
+		case errors.Is(err, context.DeadlineExceeded):
+			log.Info("ScalablePod did not become Ready in time", "timeout", a.ActivationTimeout)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte("ScalablePod did not start in time. Try again later.\n"))
+			return outcomeTimeout
+		case errors.Is(err, context.Canceled):
+			log.V(1).Info("Client went away while its ScalablePod started")
+			return outcomeCancelled
+		case err != nil:
+			log.Error(err, "Unable to get ScalablePod claim")
+			writeOperatorError(w, err)
+			return outcomeOperatorError
+		}
+		activationWait.WithLabelValues(route.key()).Observe(time.Since(start).Seconds())
+	}
+	if claim.Address == "" {
+		log.Info("ScalablePod has no address to proxy to")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("This ScalablePod doesn't serve HTTP.\n"))
+		return outcomeNoAddress
+	}
+	log.V(1).Info("Proxying request", "address", claim.Address)
+	a.proxy(claim.Address, route, log).ServeHTTP(w, req)
+	return outcomeProxied
+}
+
+// waitUntilReady polls the claim until its pod is Ready, the claim is released, or the activation timeout passes.
+func (a *Activator) waitUntilReady(ctx context.Context, claimID string, allocation *Allocation) (*Claim, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.ActivationTimeout)
+	defer cancel()
+	ticker := time.NewTicker(a.PollInterval)
+	defer ticker.Stop()
+	for {
+		claim, err := a.Operator.Claim(ctx, claimID, allocation)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if claim.Ready {
+			return claim, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// proxy returns a reverse proxy to the pod at address, which strips the route's session from requests.
+func (a *Activator) proxy(address string, route *Route, log logr.Logger) *httputil.ReverseProxy {
+	start := time.Now()
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = address
+			req.Header.Del(claimHeader)
+			removeCookie(req, cookieName(route))
+			otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			upstreamLatency.WithLabelValues(route.key(), strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+			return nil
+		},
+		// Flush immediately so streamed responses arrive as they're written
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Error(err, "Unable to proxy request", "address", address)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// removeCookie drops the named cookie from the request, leaving any others.
+func removeCookie(req *http.Request, name string) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// writeOperatorError tells the client that the operator couldn't handle its request, passing on the operator's own
+// response if there was one.
+func writeOperatorError(w http.ResponseWriter, err error) {
+	var operatorErr *OperatorError
+	var circuitErr *CircuitOpenError
+	switch {
+	case errors.As(err, &operatorErr):
+		for _, header := range []string{"Content-Type", "Retry-After"} {
+			if value := operatorErr.Header.Get(header); value != "" {
+				w.Header().Set(header, value)
+			}
+		}
+		w.WriteHeader(operatorErr.StatusCode)
+		w.Write(operatorErr.Body)
+	case errors.As(err, &circuitErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(circuitErr.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Operator is unavailable. Try again later.\n"))
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Could not contact operator.\n"))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOperator serves the operator's API. Each allocation makes a new claim, whose pod is Ready after readyAfter polls.
+type fakeOperator struct {
+	mu         sync.Mutex
+	full       bool
+	readyAfter int
+	address    string
+	port       int32
+	claims     int
+	// Polls of the current claim
+	polls    int
+	renewals int
+	// Whether the current claim's ScalablePod has been released
+	released bool
+	// Query of the last allocation
+	query url.Values
+}
+
+func (o *fakeOperator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	current := fmt.Sprintf("claim-%d", o.claims)
+	claimID := strings.TrimPrefix(req.URL.Path, "/claims/")
+	renew := strings.HasSuffix(claimID, "/renew")
+	claimID = strings.TrimSuffix(claimID, "/renew")
+	switch {
+	case req.URL.Path == "/request" && !o.full:
+		o.query = req.URL.Query()
+		o.claims++
+		o.polls, o.released = 0, false
+		json.NewEncoder(w).Encode(Allocation{ClaimID: fmt.Sprintf("claim-%d", o.claims), Namespace: "default", Name: "sp1", Port: o.port})
+	case strings.HasPrefix(req.URL.Path, "/claims/") && claimID == current && !o.released:
+		if renew {
+			o.renewals++
+		} else {
+			o.polls++
+		}
+		claim := Claim{ClaimID: claimID, Namespace: "default", Name: "sp1", Port: o.port, Ready: o.polls > o.readyAfter}
+		if claim.Ready && o.port != 0 {
+			claim.Address = o.address
+		}
+		json.NewEncoder(w).Encode(claim)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// newActivator returns an activator in front of the operator, and a pod that echoes the request path.
+func newActivator(t *testing.T, operator *fakeOperator) *Activator {
+	pod := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(claimHeader) != "" {
+			t.Error("expected the session header to be removed before proxying")
+		}
+		if _, err := req.Cookie(cookieName(&defaultRoutes.Routes[0])); err == nil {
+			t.Error("expected the session cookie to be removed before proxying")
+		}
+		w.Write([]byte("pod saw " + req.URL.Path))
+	}))
+	t.Cleanup(pod.Close)
+	operator.address = strings.TrimPrefix(pod.URL, "http://")
+	server := httptest.NewServer(operator)
+	t.Cleanup(server.Close)
+	return &Activator{
+		Operator:          &OperatorClient{Endpoints: []string{server.URL}, RequestPath: "/request", Client: server.Client()},
+		Sessions:          &Sessions{Key: []byte("secret")},
+		Routes:            defaultRoutes,
+		ActivationTimeout: time.Second,
+		PollInterval:      time.Millisecond,
+	}
+}
+
+// serve sends a request to the activator, with the session token if there is one.
+func serve(activator *Activator, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	if token != "" {
+		req.Header.Set(claimHeader, token)
+	}
+	recorder := httptest.NewRecorder()
+	activator.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestActivatorProxiesOnceReady(t *testing.T) {
+	operator := &fakeOperator{port: 8080, readyAfter: 3}
+	activator := newActivator(t, operator)
+
+	resp := serve(activator, "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Code != http.StatusOK || string(body) != "pod saw /hello" {
+		t.Fatalf("expected the request to reach the pod, got %d %q", resp.Code, body)
+	}
+	if token := resp.Header().Get(claimHeader); token != activator.Sessions.Token(&defaultRoutes.Routes[0], "claim-1") {
+		t.Errorf("expected a session for the claim in the response, got %q", token)
+	}
+	if operator.polls != 4 {
+		t.Errorf("expected the request to be held until the pod was Ready, got %d polls", operator.polls)
+	}
+}
+
+func TestActivatorSessions(t *testing.T) {
+	operator := &fakeOperator{port: 8080}
+	activator := newActivator(t, operator)
+	token := serve(activator, "").Header().Get(claimHeader)
+
+	// Returning with the session reaches the same pod and renews its lease, without another allocation
+	if resp := serve(activator, token); resp.Code != http.StatusOK || operator.claims != 1 || operator.renewals != 1 {
+		t.Errorf("expected the session to be reused, got %d after %d claims and %d renewals", resp.Code, operator.claims, operator.renewals)
+	}
+
+	// As does the cookie
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	req.AddCookie(&http.Cookie{Name: cookieName(&defaultRoutes.Routes[0]), Value: token})
+	req.AddCookie(&http.Cookie{Name: "other", Value: "kept"})
+	activator.ServeHTTP(httptest.NewRecorder(), req)
+	if operator.claims != 1 || operator.renewals != 2 {
+		t.Errorf("expected the session cookie to be reused, got %d claims and %d renewals", operator.claims, operator.renewals)
+	}
+
+	// A forged session is ignored
+	if resp := serve(activator, "claim-1.forged"); resp.Header().Get(claimHeader) != activator.Sessions.Token(&defaultRoutes.Routes[0], "claim-2") {
+		t.Errorf("expected a forged session to get a new claim, got %q", resp.Header().Get(claimHeader))
+	}
+
+	// Once the ScalablePod is released the client gets another
+	token = activator.Sessions.Token(&defaultRoutes.Routes[0], "claim-2")
+	operator.released = true
+	resp := serve(activator, token)
+	if resp.Code != http.StatusOK || resp.Header().Get(claimHeader) != activator.Sessions.Token(&defaultRoutes.Routes[0], "claim-3") {
+		t.Errorf("expected a released session to get a new claim, got %d %q", resp.Code, resp.Header().Get(claimHeader))
+	}
+}
+
+func TestActivatorRoutes(t *testing.T) {
+	operator := &fakeOperator{}
+	activator := newActivator(t, operator)
+	activator.Routes = &RoutingTable{Routes: []Route{
+		{Host: "docs.example.com", PathPrefix: "/", Namespace: "apps", Pool: "docs"},
+		{Host: "api.example.com", PathPrefix: "/v1", Selector: "app=api"},
+	}}
+
+	activator.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://docs.example.com/hello", nil))
+	if operator.query.Encode() != "namespace=apps&pool=docs" {
+		t.Errorf("expected a ScalablePod from the docs pool, got %q", operator.query.Encode())
+	}
+	activator.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://api.example.com/v1/users", nil))
+	if operator.query.Encode() != "selector=app%3Dapi" {
+		t.Errorf("expected a ScalablePod matching the selector, got %q", operator.query.Encode())
+	}
+
+	// A session for one route isn't accepted on another
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/v1/users", nil)
+	req.Header.Set(claimHeader, activator.Sessions.Token(&activator.Routes.Routes[0], "claim-2"))
+	activator.ServeHTTP(httptest.NewRecorder(), req)
+	if operator.claims != 3 {
+		t.Errorf("expected a session from another route to be ignored, got %d claims", operator.claims)
+	}
+
+	resp := httptest.NewRecorder()
+	activator.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "http://api.example.com/v2/users", nil))
+	if resp.Code != http.StatusNotFound || operator.claims != 3 {
+		t.Errorf("expected requests without a route to be not found, got %d", resp.Code)
+	}
+}
+
+func TestActivatorErrors(t *testing.T) {
+	if resp := serve(newActivator(t, &fakeOperator{full: true}), ""); resp.Code != http.StatusNotFound {
+		t.Errorf("expected no capacity to be not found, got %d", resp.Code)
+	}
+
+	activator := newActivator(t, &fakeOperator{port: 8080, readyAfter: 1 << 30})
+	activator.ActivationTimeout = 20 * time.Millisecond
+	if resp := serve(activator, ""); resp.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected a pod that never becomes Ready to time out, got %d", resp.Code)
+	}
+
+	// Without a port there is nothing to proxy to
+	resp := serve(newActivator(t, &fakeOperator{}), "")
+	if resp.Code != http.StatusOK || !strings.HasPrefix(resp.Body.String(), "Spinning up ScalablePod") {
+		t.Errorf("expected the old response for ScalablePods without a port, got %d %q", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/* CircuitBreaker stops requests to the operator while it is down, so that clients are told straight away instead of
+ * each waiting out the retries. After Threshold consecutive failures the circuit opens, and requests fail until
+ * Cooldown has passed. Then one trial request is let through: the circuit closes if it succeeds, and opens again if
+ * it fails.
+ */
+type CircuitBreaker struct {
+	// Consecutive failures that open the circuit
+	Threshold int
+	// How long the circuit stays open before a trial request is let through
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	// Whether a trial request is in flight
+	trial bool
+	// Returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// Allow reports whether a request may be sent, and if not, how long until one may.
+func (b *CircuitBreaker) Allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.Threshold {
+		return 0, true
+	}
+	if wait := b.Cooldown - b.clock().Sub(b.openedAt); wait > 0 || b.trial {
+		if wait <= 0 {
+			wait = b.Cooldown
+		}
+		return wait, false
+	}
+	b.trial = true
+	return 0, true
+}
+
+// Record records the outcome of a request that was allowed.
+func (b *CircuitBreaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if success {
+		b.failures = 0
+		operatorCircuitOpen.Set(0)
+		return
+	}
+	b.failures++
+	if b.failures >= b.Threshold {
+		b.openedAt = b.clock()
+		operatorCircuitOpen.Set(1)
+	}
+}
+
+// Release gives up a request that was allowed without learning anything, such as one the client cancelled.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Duration is a time.Duration written as a string such as "2m" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	duration, err := time.ParseDuration(value)
+	d.Duration = duration
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// OperatorConfig says how to reach the operator.
+type OperatorConfig struct {
+	// Base URLs of the operator's request server, e.g. http://controller-manager-service:19090. Requests go to the
+	// first that answers.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Path that allocates a ScalablePod
+	RequestPath string `json:"requestPath,omitempty"`
+	// How long to wait for each response from the operator
+	Timeout Duration `json:"timeout,omitempty"`
+	// How many times to retry a request that failed for a transient reason
+	Retries int `json:"retries,omitempty"`
+	// Retries wait a random time up to this, doubling with each retry
+	RetryBackoff Duration `json:"retryBackoff,omitempty"`
+	// Consecutive failures after which the operator is treated as down
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+	// How long the operator is treated as down before it is tried again
+	Cooldown Duration `json:"cooldown,omitempty"`
+	// Credentials to present to the operator, if its request server requires them
+	Auth OperatorAuthConfig `json:"auth,omitempty"`
+}
+
+// OperatorAuthConfig holds the credentials the server authenticates to the operator with. Any that are set are sent.
+type OperatorAuthConfig struct {
+	// File holding a bearer token, such as a projected service account token. It is read again as it rotates.
+	TokenFile string `json:"tokenFile,omitempty"`
+	// ID of the shared secret requests are signed with, and the file holding it
+	HMACKeyID   string `json:"hmacKeyID,omitempty"`
+	HMACKeyFile string `json:"hmacKeyFile,omitempty"`
+	// Client certificate and key to present to an operator serving HTTPS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// CA certificates that verify the operator's certificate, instead of the system's
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// TimeoutConfig limits how long clients and ScalablePods have.
+type TimeoutConfig struct {
+	// How long to hold a request while its ScalablePod starts
+	Activation Duration `json:"activation,omitempty"`
+	// How often to ask the operator whether a starting pod is Ready
+	PollInterval Duration `json:"pollInterval,omitempty"`
+	// How long clients have to send request headers
+	ReadHeader Duration `json:"readHeader,omitempty"`
+	// How long clients have to send a whole request, or zero for no limit
+	Read Duration `json:"read,omitempty"`
+	// How long a response may take, or zero for no limit. Any limit applies to streamed responses and websockets too.
+	Write Duration `json:"write,omitempty"`
+	// How long to keep idle connections open
+	Idle Duration `json:"idle,omitempty"`
+	// How long to keep accepting requests after SIGTERM, while Kubernetes stops sending them
+	DrainDelay Duration `json:"drainDelay,omitempty"`
+	// How long to wait for requests being served to finish after SIGTERM, including the drain delay
+	Shutdown Duration `json:"shutdown,omitempty"`
+}
+
+// TLSConfig serves HTTPS when a certificate is given.
+type TLSConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// LogConfig controls logging.
+type LogConfig struct {
+	// "json" for JSON logs, or "console" (the default) for human-readable ones
+	Format string `json:"format,omitempty"`
+	// Debug logs up to this level are written
+	Verbosity int `json:"verbosity,omitempty"`
+}
+
+/* Config is the user-facing server's configuration. Each setting comes from, in increasing precedence, its default,
+ * the YAML config file, an environment variable, and a command line flag. See BindFlags and applyEnv for the names.
+ * The routing table is given inline as `routes`, or in a separate routes file.
+ */
+type Config struct {
+	// host:port to listen on
+	ListenAddress string `json:"listenAddress,omitempty"`
+	// host:port to serve health checks and metrics on
+	AdminAddress string         `json:"adminAddress,omitempty"`
+	Operator     OperatorConfig `json:"operator,omitempty"`
+	Timeouts     TimeoutConfig  `json:"timeouts,omitempty"`
+	TLS          TLSConfig      `json:"tls,omitempty"`
+	Log          LogConfig      `json:"log,omitempty"`
+	// File holding the routing table, instead of Routes
+	RoutesFile string  `json:"routesFile,omitempty"`
+	Routes     []Route `json:"routes,omitempty"`
+
+	// Routing table loaded from Routes or RoutesFile
+	routingTable *RoutingTable
+}
+
+// DefaultConfig returns the configuration used when nothing is set.
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddress: ":8080",
+		AdminAddress:  ":8081",
+		Operator: OperatorConfig{
+			RequestPath:      "/request",
+			Timeout:          Duration{10 * time.Second},
+			Retries:          2,
+			RetryBackoff:     Duration{100 * time.Millisecond},
+			FailureThreshold: 5,
+			Cooldown:         Duration{10 * time.Second},
+		},
+		Timeouts: TimeoutConfig{
+			Activation:   Duration{2 * time.Minute},
+			PollInterval: Duration{250 * time.Millisecond},
+			ReadHeader:   Duration{10 * time.Second},
+			Idle:         Duration{2 * time.Minute},
+			DrainDelay:   Duration{5 * time.Second},
+			Shutdown:     Duration{30 * time.Second},
+		},
+	}
+}
+
+// Flags holds the command line flags, so that only those that were set override the config.
+type Flags struct {
+	set               map[string]bool
+	configFile        string
+	listenAddress     string
+	adminAddress      string
+	operatorEndpoints string
+	operatorPath      string
+	operatorTimeout   time.Duration
+	activationTimeout time.Duration
+	tlsCertFile       string
+	tlsKeyFile        string
+	routesFile        string
+	logFormat         string
+	logVerbosity      int
+}
+
+// BindFlags defines the command line flags on the flag set.
+func (f *Flags) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.configFile, "config", "", "YAML config file. Env: CONFIG_FILE")
+	fs.StringVar(&f.listenAddress, "listen-address", "", "host:port to listen on (default :8080). Env: PORT, for the port alone")
+	fs.StringVar(&f.adminAddress, "admin-address", "", "host:port to serve health checks and metrics on (default :8081). Env: ADMIN_PORT, for the port alone")
+	fs.StringVar(&f.operatorEndpoints, "operator-endpoints", "", "Comma-separated base URLs of the operator. Env: OPERATOR_ENDPOINTS, or OPERATOR_DNS_NAME and OPERATOR_PORT")
+	fs.StringVar(&f.operatorPath, "operator-path", "", "Path that allocates a ScalablePod (default /request). Env: OPERATOR_PATH")
+	fs.DurationVar(&f.operatorTimeout, "operator-timeout", 0, "How long to wait for each response from the operator (default 10s). Env: OPERATOR_TIMEOUT")
+	fs.DurationVar(&f.activationTimeout, "activation-timeout", 0, "How long to hold a request while its ScalablePod starts (default 2m). Env: ACTIVATION_TIMEOUT")
+	fs.StringVar(&f.tlsCertFile, "tls-cert-file", "", "Certificate to serve HTTPS with. Env: TLS_CERT_FILE")
+	fs.StringVar(&f.tlsKeyFile, "tls-key-file", "", "Key of the HTTPS certificate. Env: TLS_KEY_FILE")
+	fs.StringVar(&f.routesFile, "routes-file", "", "YAML routing table. Env: ROUTES_FILE")
+	fs.StringVar(&f.logFormat, "log-format", "", "json or console. Env: LOG_FORMAT")
+	fs.IntVar(&f.logVerbosity, "log-verbosity", 0, "Write debug logs up to this level. Env: LOG_VERBOSITY")
+}
+
+// apply overrides the config with the flags that were set.
+func (f *Flags) apply(c *Config) {
+	for name := range f.set {
+		switch name {
+		case "listen-address":
+			c.ListenAddress = f.listenAddress
+		case "admin-address":
+			c.AdminAddress = f.adminAddress
+		case "operator-endpoints":
+			c.Operator.Endpoints = splitList(f.operatorEndpoints)
+		case "operator-path":
+			c.Operator.RequestPath = f.operatorPath
+		case "operator-timeout":
+			c.Operator.Timeout.Duration = f.operatorTimeout
+		case "activation-timeout":
+			c.Timeouts.Activation.Duration = f.activationTimeout
+		case "tls-cert-file":
+			c.TLS.CertFile = f.tlsCertFile
+		case "tls-key-file":
+			c.TLS.KeyFile = f.tlsKeyFile
+		case "routes-file":
+			c.RoutesFile = f.routesFile
+		case "log-format":
+			c.Log.Format = f.logFormat
+		case "log-verbosity":
+			c.Log.Verbosity = f.logVerbosity
+		}
+	}
+}
+
+// ParseFlags parses the command line.
+func ParseFlags(args []string) (*Flags, error) {
+	f := &Flags{set: map[string]bool{}}
+	fs := flag.NewFlagSet("user-facing-server", flag.ContinueOnError)
+	f.BindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(fl *flag.Flag) { f.set[fl.Name] = true })
+	return f, nil
+}
+
+// LoadConfig builds the configuration from the defaults, config file, environment and flags, and validates it. It is
+// called again to reload the configuration.
+func LoadConfig(f *Flags, getenv func(string) string) (*Config, error) {
+	c := DefaultConfig()
+	configFile := f.configFile
+	if configFile == "" {
+		configFile = getenv("CONFIG_FILE")
+	}
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %v", configFile, err)
+		}
+	}
+	if err := applyEnv(c, getenv); err != nil {
+		return nil, err
+	}
+	f.apply(c)
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	if c.routingTable, err = c.loadRoutingTable(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides the config with the environment variables that are set.
+func applyEnv(c *Config, getenv func(string) string) error {
+	if port := getenv("PORT"); port != "" {
+		c.ListenAddress = ":" + port
+	}
+	if port := getenv("ADMIN_PORT"); port != "" {
+		c.AdminAddress = ":" + port
+	}
+	if endpoints := getenv("OPERATOR_ENDPOINTS"); endpoints != "" {
+		c.Operator.Endpoints = splitList(endpoints)
+	} else if host := getenv("OPERATOR_DNS_NAME"); host != "" {
+		port := getenv("OPERATOR_PORT")
+		if port == "" {
+			return errors.New("OPERATOR_PORT must be set with OPERATOR_DNS_NAME")
+		}
+		c.Operator.Endpoints = []string{"http://" + net.JoinHostPort(host, port)}
+	}
+	stringSettings := map[string]*string{
+		"OPERATOR_PATH":          &c.Operator.RequestPath,
+		"OPERATOR_TOKEN_FILE":    &c.Operator.Auth.TokenFile,
+		"OPERATOR_HMAC_KEY_ID":   &c.Operator.Auth.HMACKeyID,
+		"OPERATOR_HMAC_KEY_FILE": &c.Operator.Auth.HMACKeyFile,
+		"OPERATOR_CERT_FILE":     &c.Operator.Auth.CertFile,
+		"OPERATOR_KEY_FILE":      &c.Operator.Auth.KeyFile,
+		"OPERATOR_CA_FILE":       &c.Operator.Auth.CAFile,
+		"TLS_CERT_FILE":          &c.TLS.CertFile,
+		"TLS_KEY_FILE":           &c.TLS.KeyFile,
+		"ROUTES_FILE":            &c.RoutesFile,
+		"LOG_FORMAT":             &c.Log.Format,
+	}
+	for name, setting := range stringSettings {
+		if value := getenv(name); value != "" {
+			*setting = value
+		}
+	}
+	durations := map[string]*Duration{
+		"OPERATOR_TIMEOUT":   &c.Operator.Timeout,
+		"ACTIVATION_TIMEOUT": &c.Timeouts.Activation,
+	}
+	for name, setting := range durations {
+		if value := getenv(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+			setting.Duration = duration
+		}
+	}
+	if value := getenv("LOG_VERBOSITY"); value != "" {
+		verbosity, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_VERBOSITY: %v", err)
+		}
+		c.Log.Verbosity = verbosity
+	}
+	return nil
+}
+
+// Validate checks the configuration, and reports every problem with it.
+func (c *Config) Validate() error {
+	var problems []string
+	for name, address := range map[string]string{"listenAddress": c.ListenAddress, "adminAddress": c.AdminAddress} {
+		if _, port, err := net.SplitHostPort(address); err != nil || port == "" || port == "0" {
+			problems = append(problems, fmt.Sprintf("%s %q must be host:port with a fixed port", name, address))
+		}
+	}
+	if c.ListenAddress == c.AdminAddress {
+		problems = append(problems, "listenAddress and adminAddress must differ")
+	}
+	if len(c.Operator.Endpoints) == 0 {
+		problems = append(problems, "at least one operator endpoint is required")
+	}
+	for _, endpoint := range c.Operator.Endpoints {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("operator endpoint %q must be an http or https URL", endpoint))
+		}
+	}
+	if !strings.HasPrefix(c.Operator.RequestPath, "/") {
+		problems = append(problems, fmt.Sprintf("operator requestPath %q must start with /", c.Operator.RequestPath))
+	}
+	for name, duration := range map[string]Duration{
+		"operator timeout":      c.Operator.Timeout,
+		"operator retryBackoff": c.Operator.RetryBackoff,
+		"operator cooldown":     c.Operator.Cooldown,
+		"activation timeout":    c.Timeouts.Activation,
+		"poll interval":         c.Timeouts.PollInterval,
+		"read header timeout":   c.Timeouts.ReadHeader,
+		"idle timeout":          c.Timeouts.Idle,
+		"shutdown timeout":      c.Timeouts.Shutdown,
+	} {
+		if duration.Duration <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", name))
+		}
+	}
+	if c.Operator.Retries < 0 {
+		problems = append(problems, "operator retries can't be negative")
+	}
+	if c.Operator.FailureThreshold < 1 {
+		problems = append(problems, "operator failureThreshold must be at least 1")
+	}
+	if c.Timeouts.Read.Duration < 0 || c.Timeouts.Write.Duration < 0 || c.Timeouts.DrainDelay.Duration < 0 {
+		problems = append(problems, "read and write timeouts and the drain delay can't be negative")
+	}
+	if c.Timeouts.DrainDelay.Duration >= c.Timeouts.Shutdown.Duration {
+		problems = append(problems, "the drain delay must be shorter than the shutdown timeout")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls certFile and keyFile must be set together")
+	}
+	if (c.Operator.Auth.HMACKeyID == "") != (c.Operator.Auth.HMACKeyFile == "") {
+		problems = append(problems, "operator auth hmacKeyID and hmacKeyFile must be set together")
+	}
+	if (c.Operator.Auth.CertFile == "") != (c.Operator.Auth.KeyFile == "") {
+		problems = append(problems, "operator auth certFile and keyFile must be set together")
+	}
+	if c.Log.Format != "" && c.Log.Format != "json" && c.Log.Format != "console" {
+		problems = append(problems, fmt.Sprintf("log format %q must be json or console", c.Log.Format))
+	}
+	if c.Log.Verbosity < 0 {
+		problems = append(problems, "log verbosity can't be negative")
+	}
+	if c.RoutesFile != "" && len(c.Routes) > 0 {
+		problems = append(problems, "routes can't be given both inline and in a routes file")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// credentials returns the credentials to authenticate to the operator with, or nil if none are configured.
+func (c *OperatorAuthConfig) credentials() (*OperatorCredentials, error) {
+	if c.TokenFile == "" && c.HMACKeyFile == "" {
+		return nil, nil
+	}
+	credentials := &OperatorCredentials{TokenFile: c.TokenFile, KeyID: c.HMACKeyID}
+	if c.HMACKeyFile != "" {
+		key, err := ioutil.ReadFile(c.HMACKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if credentials.Key = bytes.TrimSpace(key); len(credentials.Key) == 0 {
+			return nil, fmt.Errorf("operator signing key file %s is empty", c.HMACKeyFile)
+		}
+	}
+	return credentials, nil
+}
+
+// tlsConfig returns the TLS configuration for connections to the operator, or nil if the defaults will do.
+func (c *OperatorAuthConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" && c.CAFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+	}
+	return config, nil
+}
+
+// loadRoutingTable returns the configured routing table, reading the routes file if there is one.
+func (c *Config) loadRoutingTable() (*RoutingTable, error) {
+	if c.RoutesFile != "" {
+		return LoadRoutes(c.RoutesFile)
+	}
+	if len(c.Routes) == 0 {
+		return defaultRoutes, nil
+	}
+	table := &RoutingTable{Routes: append([]Route(nil), c.Routes...)}
+	if err := table.normalize(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string { return vars[name] }
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	configFile := writeFile(t, t.TempDir(), "config.yaml", `
+listenAddress: ":9000"
+operator:
+  endpoints: ["http://file:19090"]
+  timeout: 5s
+timeouts:
+  activation: 30s
+routes:
+- host: docs.example.com
+  pool: docs
+`)
+	flags, err := ParseFlags([]string{"--config", configFile, "--activation-timeout=45s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(flags, env(map[string]string{
+		"OPERATOR_DNS_NAME":  "operator",
+		"OPERATOR_PORT":      "19090",
+		"ACTIVATION_TIMEOUT": "1m",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != ":9000" || config.Operator.Timeout.Duration != 5*time.Second {
+		t.Errorf("expected settings from the file, got %+v", config)
+	}
+	if len(config.Operator.Endpoints) != 1 || config.Operator.Endpoints[0] != "http://operator:19090" {
+		t.Errorf("expected the environment to override the file, got %v", config.Operator.Endpoints)
+	}
+	if config.Timeouts.Activation.Duration != 45*time.Second {
+		t.Errorf("expected flags to override the environment, got %v", config.Timeouts.Activation)
+	}
+	if config.Operator.RequestPath != "/request" || config.Timeouts.ReadHeader.Duration != 10*time.Second {
+		t.Errorf("expected defaults for settings that weren't given, got %+v", config)
+	}
+	if len(config.routingTable.Routes) != 1 || config.routingTable.Routes[0].PathPrefix != "/" {
+		t.Errorf("expected the inline routes to be loaded, got %+v", config.routingTable)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	flags, _ := ParseFlags(nil)
+	for _, test := range []struct {
+		env     map[string]string
+		problem string
+	}{
+		{map[string]string{}, "operator endpoint is required"},
+		{map[string]string{"OPERATOR_DNS_NAME": "operator"}, "OPERATOR_PORT"},
+		{map[string]string{"OPERATOR_ENDPOINTS": "operator:19090"}, "must be an http or https URL"},
+		{map[string]string{"OPERATOR_ENDPOINTS": "http://operator", "PORT": "0"}, "fixed port"},
+		{map[string]string{"OPERATOR_ENDPOINTS": "http://operator", "ACTIVATION_TIMEOUT": "soon"}, "invalid ACTIVATION_TIMEOUT"},
+		{map[string]string{"OPERATOR_ENDPOINTS": "http://operator", "TLS_CERT_FILE": "tls.crt"}, "set together"},
+		{map[string]string{"OPERATOR_ENDPOINTS": "http://operator", "LOG_FORMAT": "xml"}, "json or console"},
+		{map[string]string{"OPERATOR_ENDPOINTS": "http://operator", "OPERATOR_HMAC_KEY_ID": "k1"}, "hmacKeyID and hmacKeyFile"},
+		{map[string]string{"OPERATOR_ENDPOINTS": "http://operator", "OPERATOR_CERT_FILE": "client.crt"}, "certFile and keyFile"},
+	} {
+		if _, err := LoadConfig(flags, env(test.env)); err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("expected %v to fail with %q, got %v", test.env, test.problem, err)
+		}
+	}
+
+	config, err := LoadConfig(flags, env(map[string]string{"OPERATOR_ENDPOINTS": "http://a:1, http://b:2"}))
+	if err != nil || len(config.Operator.Endpoints) != 2 || config.routingTable != defaultRoutes {
+		t.Errorf("expected two endpoints and the default routes, got %+v, %v", config, err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	routesFile := writeFile(t, dir, "routes.yaml", "routes:\n- host: docs.example.com\n")
+	flags, _ := ParseFlags([]string{"--operator-endpoints=http://operator:19090", "--routes-file", routesFile})
+	config, err := LoadConfig(flags, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{flags: flags, sessions: &Sessions{}, transport: http.DefaultTransport, logLevel: zap.NewAtomicLevel()}
+	if err := s.apply(config); err != nil {
+		t.Fatal(err)
+	}
+	routed := func(host string) bool {
+		_, ok := s.activator.Load().(*Activator).Routes.Match(httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		return ok
+	}
+	if !routed("docs.example.com") || routed("blog.example.com") {
+		t.Fatal("expected only the docs host to be routed")
+	}
+
+	writeFile(t, dir, "routes.yaml", "routes:\n- host: blog.example.com\n")
+	s.reload()
+	if routed("docs.example.com") || !routed("blog.example.com") {
+		t.Error("expected the reloaded routes to be used")
+	}
+
+	writeFile(t, dir, "routes.yaml", "routes:\n- pathPrefix: invalid\n")
+	s.reload()
+	if !routed("blog.example.com") {
+		t.Error("expected an invalid reload to keep the current routes")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header carrying the signature of a request signed with a shared secret, in the form the operator checks:
+// keyId=<key ID>,timestamp=<Unix seconds>,signature=<HMAC-SHA256 of the method, request URI, timestamp and body hash>
+const signatureHeader = "X-ScalablePod-Signature"
+
+// How long a bearer token read from a file is used before the file is read again. Kubernetes rotates projected
+// service account tokens well before they expire.
+const tokenRereadInterval = time.Minute
+
+/* OperatorCredentials authenticates requests to the operator, whose request server may require a Kubernetes bearer
+ * token, a signature under a shared secret, or a client certificate. Whichever of the first two are configured are
+ * sent with every request; client certificates are presented by the transport.
+ */
+type OperatorCredentials struct {
+	// File holding a bearer token, such as a projected service account token
+	TokenFile string
+	// Shared secret requests are signed with, and the ID the operator knows it by
+	KeyID string
+	Key   []byte
+
+	mu          sync.Mutex
+	token       string
+	tokenReadAt time.Time
+	// Returns the current time, replaced by tests
+	now func() time.Time
+}
+
+// authenticate adds the credentials to a request with the given body.
+func (c *OperatorCredentials) authenticate(req *http.Request, body string) error {
+	if c.TokenFile != "" {
+		token, err := c.bearerToken()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if len(c.Key) > 0 {
+		timestamp := c.clock().Unix()
+		bodySum := sha256.Sum256([]byte(body))
+		mac := hmac.New(sha256.New, c.Key)
+		fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n", req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:]))
+		req.Header.Set(signatureHeader, fmt.Sprintf("keyId=%s,timestamp=%d,signature=%s",
+			c.KeyID, timestamp, base64.RawURLEncoding.EncodeToString(mac.Sum(nil))))
+	}
+	return nil
+}
+
+// bearerToken returns the token in TokenFile, reading it again every tokenRereadInterval.
+func (c *OperatorCredentials) bearerToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && c.clock().Sub(c.tokenReadAt) < tokenRereadInterval {
+		return c.token, nil
+	}
+	data, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to read operator token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("operator token file %s is empty", c.TokenFile)
+	}
+	c.token, c.tokenReadAt = token, c.clock()
+	return token, nil
+}
+
+func (c *OperatorCredentials) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
@@ -1,3 +1,18 @@
 module user-facing-server
 
 go 1.16
+
+require (
+	github.com/felixge/httpsnoop v1.0.2
+	github.com/go-logr/logr v0.3.0
+	github.com/go-logr/zapr v0.2.0
+	github.com/prometheus/client_golang v1.7.1
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.25.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	go.uber.org/zap v1.15.0
+	sigs.k8s.io/yaml v1.2.0
+)
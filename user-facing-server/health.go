@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// How long the readiness check waits for each operator endpoint
+const readinessTimeout = 2 * time.Second
+
+// adminHandler serves the liveness and readiness checks and metrics, away from the routed traffic.
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// readyz reports whether requests can be served: the server isn't draining, and the operator can be reached.
+func (s *server) readyz(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining\n"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+	if err := s.activator.Load().(*Activator).Operator.Ping(ctx); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("operator unreachable: %v\n", err)))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// How often drain checks whether requests have finished
+const drainPollInterval = 50 * time.Millisecond
+
+// drain marks the server as not ready, and waits until the requests being served finish or the context is done.
+// Proxied websockets count as requests until they close.
+func (s *server) drain(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.inFlight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
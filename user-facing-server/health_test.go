@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newServer returns a server whose activator calls the given operator.
+func newServer(t *testing.T, operator http.Handler) *server {
+	endpoint := httptest.NewServer(operator)
+	t.Cleanup(endpoint.Close)
+	s := &server{}
+	s.activator.Store(&Activator{
+		Operator: &OperatorClient{Endpoints: []string{endpoint.URL}, RequestPath: "/request", Client: endpoint.Client()},
+		Sessions: &Sessions{},
+		Routes:   defaultRoutes,
+	})
+	return s
+}
+
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder
+}
+
+func TestReadiness(t *testing.T) {
+	up := true
+	s := newServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !up || req.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	admin := s.adminHandler()
+
+	if resp := get(admin, "/healthz"); resp.Code != http.StatusOK {
+		t.Errorf("expected to be live, got %d", resp.Code)
+	}
+	if resp := get(admin, "/readyz"); resp.Code != http.StatusOK {
+		t.Errorf("expected to be ready while the operator is up, got %d %q", resp.Code, resp.Body.String())
+	}
+	up = false
+	if resp := get(admin, "/readyz"); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not to be ready while the operator is down, got %d", resp.Code)
+	}
+	up = true
+	s.drain(context.Background())
+	if resp := get(admin, "/readyz"); resp.Code != http.StatusServiceUnavailable || resp.Body.String() != "draining\n" {
+		t.Errorf("expected not to be ready while draining, got %d %q", resp.Code, resp.Body.String())
+	}
+}
+
+func TestDrainWaitsForRequests(t *testing.T) {
+	release := make(chan struct{})
+	s := newServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte(`{"claimID": "claim-1"}`))
+	}))
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(s, "/") }()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected draining to wait for the request, got %v", err)
+	}
+	close(release)
+	if resp := <-done; resp.Code != http.StatusOK {
+		t.Errorf("expected the request to finish, got %d", resp.Code)
+	}
+	if err := s.drain(context.Background()); err != nil {
+		t.Errorf("expected draining to finish, got %v", err)
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	s := newServer(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	noCapacity := requests.WithLabelValues("/", outcomeNoCapacity, "404")
+	before := testutil.ToFloat64(noCapacity)
+	get(s, "/")
+	if after := testutil.ToFloat64(noCapacity); after != before+1 {
+		t.Errorf("expected the request to be counted as no capacity, went from %v to %v", before, after)
+	}
+	if resp := get(s.adminHandler(), "/metrics"); !strings.Contains(resp.Body.String(), "user_facing_server_operator_request_duration_seconds_count") {
+		t.Error("expected operator latency to be exported")
+	}
+}
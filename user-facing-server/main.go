@@ -1,51 +1,309 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-var operatorDnsName string
-var operatorPort string
-var operatorPath string
-var listenerPort string
+// Replaced in main once the log configuration is known
+var logger = logr.Discard()
+
+// Header carrying the ID that ties together the logs of a request here and in the operator
+const requestIDHeader = "X-Request-ID"
 
-/* Start up an HTTP server on <PORT> that, when a external request is received, POSTS to OPERATOR_DNS_NAME:OPERATOR_PORT to start a ScalablePod.
+// Context key of the request ID
+type requestIDKey struct{}
+
+/* Start up an HTTP server that, when a external request is received, asks the operator to start a ScalablePod for it,
+ * and proxies the request to it once it is Ready. The configuration comes from flags, environment variables and an
+ * optional YAML file, as described by Config, and is reloaded on SIGHUP. Health checks and metrics are served on a
+ * separate admin address. On SIGTERM the server stops being ready and drains the requests it is serving.
+ * Clients are kept on the same ScalablePod by session tokens signed with SESSION_SECRET, which every replica must share.
+ * SECURE_COOKIES=true keeps session cookies to HTTPS when TLS is terminated in front of the server.
+ * OTEL_TRACES_EXPORTER=otlp sends traces to the collector at OTEL_EXPORTER_OTLP_ENDPOINT, and =stdout prints them.
  */
 func main() {
-	operatorDnsName = os.Getenv("OPERATOR_DNS_NAME")
-	operatorPort = os.Getenv("OPERATOR_PORT")
-	operatorPath = os.Getenv("OPERATOR_PATH")
-	listenerPort = os.Getenv("PORT")
-	log.Printf("Starting server on localhost:%s.\n", listenerPort)
-	http.HandleFunc("/", Handler)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%s", listenerPort), nil))
-}
-
-func Handler(w http.ResponseWriter, req *http.Request) {
-	log.Println("Received request for ScalablePod.")
-	resp, err := http.Post(fmt.Sprintf("http://%s:%s%s", operatorDnsName, operatorPort, operatorPath), "application/text", strings.NewReader("Request"))
+	flags, err := ParseFlags(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+	config, err := LoadConfig(flags, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var logLevel zap.AtomicLevel
+	logger, logLevel = newLogger(config.Log)
+	shutdownTracing, err := setupTracing(os.Getenv("OTEL_TRACES_EXPORTER"))
+	if err != nil {
+		logger.Error(err, "Unable to set up tracing")
+		os.Exit(1)
+	}
+	sessionKey := []byte(os.Getenv("SESSION_SECRET"))
+	if len(sessionKey) == 0 {
+		logger.Info("SESSION_SECRET is not set, so sessions won't survive a restart or work across replicas")
+		sessionKey = make([]byte, 32)
+		rand.Read(sessionKey)
+	}
+	s := &server{
+		flags:    flags,
+		sessions: &Sessions{Key: sessionKey, Secure: os.Getenv("SECURE_COOKIES") == "true"},
+		// Passes on the trace context of each request
+		transport: otelhttp.NewTransport(http.DefaultTransport),
+		logLevel:  logLevel,
+	}
+	if err := s.apply(config); err != nil {
+		logger.Error(err, "Unable to load configuration")
+		os.Exit(1)
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			s.reload()
+		}
+	}()
+	terminations := make(chan os.Signal, 1)
+	signal.Notify(terminations, syscall.SIGTERM, os.Interrupt)
+
+	adminServer := &http.Server{Addr: config.AdminAddress, Handler: s.adminHandler(), ReadHeaderTimeout: config.Timeouts.ReadHeader.Duration}
+	go func() {
+		logger.Info("Serving health checks and metrics", "address", config.AdminAddress)
+		if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+			logger.Error(err, "Admin server stopped")
+			os.Exit(1)
+		}
+	}()
+
+	httpServer := &http.Server{
+		Addr:              config.ListenAddress,
+		Handler:           otelhttp.NewHandler(withRequestLogger(s), "request"),
+		ReadHeaderTimeout: config.Timeouts.ReadHeader.Duration,
+		ReadTimeout:       config.Timeouts.Read.Duration,
+		WriteTimeout:      config.Timeouts.Write.Duration,
+		IdleTimeout:       config.Timeouts.Idle.Duration,
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		logger.Info("Starting server", "address", config.ListenAddress, "tls", config.TLS.CertFile != "")
+		if config.TLS.CertFile != "" {
+			httpServer.TLSConfig = &tls.Config{GetCertificate: s.getCertificate}
+			stopped <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			stopped <- httpServer.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err = <-stopped:
+		logger.Error(err, "Server stopped")
+		shutdownTracing(context.Background())
+		os.Exit(1)
+	case sig := <-terminations:
+		s.mu.Lock()
+		config = s.config
+		s.mu.Unlock()
+		logger.Info("Draining requests", "signal", sig.String(), "drainDelay", config.Timeouts.DrainDelay, "timeout", config.Timeouts.Shutdown)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeouts.Shutdown.Duration)
+	defer cancel()
+	atomic.StoreInt32(&s.draining, 1)
+	// Give Kubernetes time to see the server isn't ready and stop sending it requests before no longer accepting them
+	time.Sleep(config.Timeouts.DrainDelay.Duration)
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Error(err, "Requests were still being served at shutdown")
+	}
+	// Shutdown doesn't wait for proxied websockets
+	if err := s.drain(ctx); err != nil {
+		logger.Error(err, "Requests were still being served at shutdown")
+	}
+	adminServer.Close()
+	shutdownTracing(context.Background())
+	logger.Info("Server stopped")
+}
+
+// server serves requests with an Activator built from the current configuration, which is swapped on reload.
+type server struct {
+	// Requests being served, first for 64-bit alignment
+	inFlight int64
+
+	flags     *Flags
+	sessions  *Sessions
+	transport http.RoundTripper
+	logLevel  zap.AtomicLevel
+
+	mu     sync.Mutex
+	config *Config
+	// Kept across reloads unless its settings change, so that a reload doesn't forget the operator is down
+	breaker *CircuitBreaker
+	// *Activator
+	activator atomic.Value
+	// *tls.Certificate
+	certificate atomic.Value
+
+	// 1 once the server is shutting down
+	draining int32
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	s.activator.Load().(*Activator).ServeHTTP(w, req)
+}
+
+func (s *server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.certificate.Load().(*tls.Certificate), nil
+}
+
+// apply switches to a new configuration, loading the certificates and keys it names.
+func (s *server) apply(config *Config) error {
+	if config.TLS.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+		s.certificate.Store(&certificate)
+	}
+	credentials, err := config.Operator.Auth.credentials()
+	if err != nil {
+		return err
+	}
+	transport := s.transport
+	if tlsConfig, err := config.Operator.Auth.tlsConfig(); err != nil {
+		return err
+	} else if tlsConfig != nil {
+		base := http.DefaultTransport.(*http.Transport).Clone()
+		base.TLSClientConfig = tlsConfig
+		transport = otelhttp.NewTransport(base)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.breaker == nil || s.breaker.Threshold != config.Operator.FailureThreshold || s.breaker.Cooldown != config.Operator.Cooldown.Duration {
+		s.breaker = &CircuitBreaker{Threshold: config.Operator.FailureThreshold, Cooldown: config.Operator.Cooldown.Duration}
+	}
+	s.activator.Store(&Activator{
+		Operator: &OperatorClient{
+			Endpoints:    config.Operator.Endpoints,
+			RequestPath:  config.Operator.RequestPath,
+			Client:       &http.Client{Transport: transport, Timeout: config.Operator.Timeout.Duration},
+			Retries:      config.Operator.Retries,
+			RetryBackoff: config.Operator.RetryBackoff.Duration,
+			Breaker:      s.breaker,
+			Credentials:  credentials,
+		},
+		Sessions:          s.sessions,
+		Routes:            config.routingTable,
+		ActivationTimeout: config.Timeouts.Activation.Duration,
+		PollInterval:      config.Timeouts.PollInterval.Duration,
+	})
+	s.logLevel.SetLevel(zapcore.Level(-config.Log.Verbosity))
+	s.config = config
+	return nil
+}
+
+// reload loads the configuration again, keeping the current one if the new one is invalid. The listen and admin
+// addresses, server timeouts, log format, and whether TLS is used only change on restart.
+func (s *server) reload() {
+	s.mu.Lock()
+	current := s.config
+	s.mu.Unlock()
+	config, err := LoadConfig(s.flags, os.Getenv)
+	if err == nil {
+		err = s.apply(config)
+	}
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Could not contact operator.\n"))
+		logger.Error(err, "Unable to reload configuration, keeping the current one")
 		return
 	}
-	switch resp.StatusCode {
-	case http.StatusOK:
-		log.Println("Received 200 from operator.")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Spinning up ScalablePod...\n"))
-	case http.StatusInternalServerError:
-		log.Println("Server failed to schedule.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Spinning up ScalablePod...\n"))
-	case http.StatusNotFound:
-		log.Println("No resources available to schedule.")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No resources currently available. Try again later.\n"))
+	logger.Info("Reloaded configuration", "routes", len(config.routingTable.Routes), "operatorEndpoints", config.Operator.Endpoints)
+	if config.ListenAddress != current.ListenAddress || config.AdminAddress != current.AdminAddress || config.Log.Format != current.Log.Format ||
+		(config.TLS.CertFile == "") != (current.TLS.CertFile == "") || config.Timeouts.ReadHeader != current.Timeouts.ReadHeader ||
+		config.Timeouts.Read != current.Timeouts.Read || config.Timeouts.Write != current.Timeouts.Write ||
+		config.Timeouts.Idle != current.Timeouts.Idle {
+		logger.Info("The listen and admin addresses, server timeouts, log format and whether TLS is used only change on restart")
 	}
 }
+
+// setupTracing installs a tracer provider sending spans to the given exporter, "otlp" or "stdout", and the W3C trace
+// context propagator. Spans aren't recorded for any other exporter, but trace context is still passed on. The
+// returned function flushes any buffered spans.
+func setupTracing(exporterName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "otlp":
+		// The endpoint and TLS settings come from the standard OTEL_EXPORTER_OTLP_* variables
+		exporter, err = otlptracegrpc.New(context.Background())
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("user-facing-server"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// newLogger returns a zap logger writing JSON if the format is "json" and human-readable lines otherwise, with V(n)
+// logs enabled up to the given verbosity, and the level that controls that.
+func newLogger(config LogConfig) (logr.Logger, zap.AtomicLevel) {
+	zapConfig := zap.NewDevelopmentConfig()
+	if config.Format == "json" {
+		zapConfig = zap.NewProductionConfig()
+	}
+	zapConfig.Level = zap.NewAtomicLevelAt(zapcore.Level(-config.Verbosity))
+	zapLogger, err := zapConfig.Build()
+	if err != nil {
+		panic(err)
+	}
+	return zapr.NewLogger(zapLogger), zapConfig.Level
+}
+
+// withRequestLogger gives each request a logger carrying its request ID, taken from the X-Request-ID header or
+// generated, and sets the header so the ID is passed on to the operator.
+func withRequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get(requestIDHeader)
+		if requestID == "" {
+			id := make([]byte, 16)
+			rand.Read(id)
+			requestID = hex.EncodeToString(id)
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		log := logger.WithValues("requestID", requestID, "traceID", trace.SpanContextFromContext(req.Context()).TraceID(), "path", req.URL.Path)
+		ctx := logr.NewContext(context.WithValue(req.Context(), requestIDKey{}, requestID), log)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of a request, for the requests metric
+const (
+	outcomeNoRoute       = "no_route"
+	outcomeNoCapacity    = "no_capacity"
+	outcomeStarted       = "started"
+	outcomeRunning       = "running"
+	outcomeProxied       = "proxied"
+	outcomeReleased      = "released"
+	outcomeTimeout       = "timeout"
+	outcomeCancelled     = "cancelled"
+	outcomeNoAddress     = "no_address"
+	outcomeOperatorError = "operator_error"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_facing_server_requests_total",
+		Help: "Requests by route, outcome and response code",
+	}, []string{"route", "outcome", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "user_facing_server_request_duration_seconds",
+		Help:    "Time to serve a request, including any wait for its ScalablePod to start",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 16),
+	}, []string{"route", "outcome"})
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "user_facing_server_requests_in_flight",
+		Help: "Requests being served, including those waiting for their ScalablePod to start",
+	})
+	activationWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "user_facing_server_activation_wait_seconds",
+		Help:    "Time requests were held until their ScalablePod's pod was Ready",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	}, []string{"route"})
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "user_facing_server_upstream_latency_seconds",
+		Help:    "Time until a ScalablePod's pod responded to a proxied request, by route and response code",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+	operatorLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "user_facing_server_operator_request_duration_seconds",
+		Help:    "Time each attempt to call the operator took, by operation and response code, or error",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+	operatorCircuitOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "user_facing_server_operator_circuit_open",
+		Help: "1 while the operator is treated as down after repeated failures",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration, requestsInFlight, activationWait, upstreamLatency, operatorLatency, operatorCircuitOpen)
+}
+
+// recordRequest records a served request. The route is nil if none matched.
+func recordRequest(route *Route, outcome string, code int, duration time.Duration) {
+	var key string
+	if route != nil {
+		key = route.key()
+	}
+	requests.WithLabelValues(key, outcome, strconv.Itoa(code)).Inc()
+	requestDuration.WithLabelValues(key, outcome).Observe(duration.Seconds())
+}
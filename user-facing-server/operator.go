@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+var (
+	// No ScalablePod is free to take the request
+	errNoCapacity = errors.New("no ScalablePod available")
+	// The claim's ScalablePod has been released
+	errClaimGone = errors.New("claim not found")
+)
+
+// Allocation is the operator's response to a request that claimed a ScalablePod.
+type Allocation struct {
+	ClaimID   string `json:"claimID"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Port the workload serves HTTP on, or zero if it doesn't
+	Port int32 `json:"port,omitempty"`
+}
+
+// Claim is the operator's view of a claimed ScalablePod.
+type Claim struct {
+	ClaimID   string `json:"claimID"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Port the workload serves HTTP on, or zero if it doesn't
+	Port int32 `json:"port,omitempty"`
+	// Whether the bound pod is Ready
+	Ready bool `json:"ready"`
+	// host:port the workload serves HTTP on, once the pod is Ready
+	Address string `json:"address,omitempty"`
+}
+
+// OperatorError is a response from the operator other than those the activator understands. It is passed on to the
+// client as it is.
+type OperatorError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Header that makes the operator give every attempt at an allocation the same claim
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Largest response body from the operator that is passed on
+const maxOperatorErrorBody = 64 * 1024
+
+func newOperatorError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxOperatorErrorBody))
+	return &OperatorError{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+}
+
+func (e *OperatorError) Error() string {
+	return fmt.Sprintf("operator responded %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// CircuitOpenError is returned without contacting the operator while the circuit breaker is open.
+type CircuitOpenError struct {
+	// How long until the operator will be tried again
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("operator unavailable, retrying in %s", e.RetryAfter.Round(time.Second))
+}
+
+/* OperatorClient talks to the operator's HTTP API. Each request goes to the first of the operator's endpoints that can
+ * be reached, and transient failures are retried on any connection error or gateway error response. Each allocation
+ * sends an Idempotency-Key with all of its attempts, so that an attempt that timed out after claiming a ScalablePod
+ * isn't followed by another claim.
+ */
+type OperatorClient struct {
+	// Base URLs of the operator, e.g. http://controller-manager-service:19090
+	Endpoints []string
+	// Path that allocates a ScalablePod
+	RequestPath string
+	// Client to send requests with, whose timeout limits each attempt
+	Client *http.Client
+	// How many times to retry a failed request
+	Retries int
+	// Retries wait a random time up to RetryBackoff, doubling with each retry
+	RetryBackoff time.Duration
+	// Stops requests while the operator is down, if set
+	Breaker *CircuitBreaker
+	// Authenticates requests to the operator, if set
+	Credentials *OperatorCredentials
+}
+
+// Allocate claims a ScalablePod for a request on the route.
+func (c *OperatorClient) Allocate(ctx context.Context, route *Route) (*Allocation, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"namespace": route.Namespace, "pool": route.Pool, "selector": route.Selector} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	path := c.RequestPath
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	header := http.Header{idempotencyKeyHeader: {hex.EncodeToString(key)}}
+	resp, err := c.do(ctx, "allocate", http.MethodPost, path, "Request", header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var allocation Allocation
+		if err := json.NewDecoder(resp.Body).Decode(&allocation); err != nil {
+			return nil, fmt.Errorf("unable to decode allocation: %v", err)
+		}
+		return &allocation, nil
+	case http.StatusNotFound:
+		return nil, errNoCapacity
+	default:
+		return nil, newOperatorError(resp)
+	}
+}
+
+// Claim looks up a claim. The allocation, if known, lets the operator find a claim it hasn't cached yet.
+func (c *OperatorClient) Claim(ctx context.Context, claimID string, allocation *Allocation) (*Claim, error) {
+	path := "/claims/" + url.PathEscape(claimID)
+	if allocation != nil {
+		path += "?" + url.Values{"namespace": {allocation.Namespace}, "name": {allocation.Name}}.Encode()
+	}
+	resp, err := c.do(ctx, "claim", http.MethodGet, path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeClaim(resp)
+}
+
+// Renew renews the lease on a claim, so that its ScalablePod isn't expired while it is in use, and returns the claim.
+func (c *OperatorClient) Renew(ctx context.Context, claimID string) (*Claim, error) {
+	resp, err := c.do(ctx, "renew", http.MethodPost, "/claims/"+url.PathEscape(claimID)+"/renew", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeClaim(resp)
+}
+
+// Ping checks that one of the operator's endpoints is up, without retrying or going through the circuit breaker.
+func (c *OperatorClient) Ping(ctx context.Context) error {
+	resp, err := c.send(ctx, http.MethodGet, "/healthz", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("operator responded %s", resp.Status)
+	}
+	return nil
+}
+
+func decodeClaim(resp *http.Response) (*Claim, error) {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var claim Claim
+		if err := json.NewDecoder(resp.Body).Decode(&claim); err != nil {
+			return nil, fmt.Errorf("unable to decode claim: %v", err)
+		}
+		return &claim, nil
+	case http.StatusNotFound:
+		return nil, errClaimGone
+	default:
+		return nil, newOperatorError(resp)
+	}
+}
+
+// do sends a request to the operator for an operation, retrying transient failures with jittered exponential backoff.
+// Responses other than server errors, which are the operator's to return, are never retried.
+func (c *OperatorClient) do(ctx context.Context, operation, method, path, body string, header http.Header) (*http.Response, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	for attempt := 0; ; attempt++ {
+		if c.Breaker != nil {
+			if wait, ok := c.Breaker.Allow(); !ok {
+				return nil, &CircuitOpenError{RetryAfter: wait}
+			}
+		}
+		start := time.Now()
+		resp, err := c.send(ctx, method, path, body, header)
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		operatorLatency.WithLabelValues(operation, code).Observe(time.Since(start).Seconds())
+		if c.Breaker != nil {
+			if ctx.Err() != nil {
+				c.Breaker.Release()
+			} else {
+				c.Breaker.Record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+			}
+		}
+		if attempt >= c.Retries || ctx.Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+		if err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxOperatorErrorBody))
+			resp.Body.Close()
+			err = fmt.Errorf("operator responded %s", resp.Status)
+		}
+		backoff := time.Duration(mathrand.Int63n(int64(c.RetryBackoff)<<attempt + 1))
+		log.V(1).Info("Retrying operator request", "path", path, "attempt", attempt+1, "backoff", backoff, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// send sends a request, with the header as well as the usual ones, to each endpoint in turn until one of them responds.
+func (c *OperatorClient) send(ctx context.Context, method, path, body string, header http.Header) (*http.Response, error) {
+	var err error
+	for _, endpoint := range c.Endpoints {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, endpoint+path, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("Content-Type", "application/text")
+		if c.Credentials != nil {
+			if err := c.Credentials.authenticate(req, body); err != nil {
+				return nil, err
+			}
+		}
+		if requestID, ok := ctx.Value(requestIDKey{}).(string); ok {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		var resp *http.Response
+		if resp, err = c.Client.Do(req); err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		logr.FromContextOrDiscard(ctx).V(1).Info("Operator endpoint unreachable", "endpoint", endpoint, "error", err.Error())
+	}
+	if err == nil {
+		err = errors.New("no operator endpoints")
+	}
+	return nil, err
+}
+
+// retryable is whether a failed request can be sent again: it couldn't be sent, or something between here and the
+// operator failed.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
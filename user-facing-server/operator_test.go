@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// standInOperator answers each request with the next of its responses, repeating the last.
+type standInOperator struct {
+	responses []func(http.ResponseWriter)
+	requests  int32
+}
+
+func (o *standInOperator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	n := int(atomic.AddInt32(&o.requests, 1))
+	if n > len(o.responses) {
+		n = len(o.responses)
+	}
+	o.responses[n-1](w)
+}
+
+func status(code int) func(http.ResponseWriter) {
+	return func(w http.ResponseWriter) { w.WriteHeader(code) }
+}
+
+func claimResponse(w http.ResponseWriter) {
+	w.Write([]byte(`{"claimID": "claim-1", "ready": true}`))
+}
+
+// closeTracker counts the response bodies that were closed.
+type closeTracker struct {
+	opened, closed int32
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	tracker *closeTracker
+}
+
+func (b trackedBody) Close() error {
+	atomic.AddInt32(&b.tracker.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+func (t *closeTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		atomic.AddInt32(&t.opened, 1)
+		resp.Body = trackedBody{resp.Body, t}
+	}
+	return resp, err
+}
+
+func newOperatorClient(t *testing.T, operator http.Handler) (*OperatorClient, *closeTracker) {
+	server := httptest.NewServer(operator)
+	t.Cleanup(server.Close)
+	tracker := &closeTracker{}
+	return &OperatorClient{
+		Endpoints:    []string{server.URL},
+		RequestPath:  "/request",
+		Client:       &http.Client{Transport: tracker, Timeout: time.Second},
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+	}, tracker
+}
+
+func TestOperatorClientRetries(t *testing.T) {
+	operator := &standInOperator{responses: []func(http.ResponseWriter){status(http.StatusServiceUnavailable), status(http.StatusBadGateway), claimResponse}}
+	c, tracker := newOperatorClient(t, operator)
+	if claim, err := c.Claim(context.Background(), "claim-1", nil); err != nil || !claim.Ready {
+		t.Fatalf("expected the claim after retrying, got %v, %v", claim, err)
+	}
+	if atomic.LoadInt32(&operator.requests) != 3 {
+		t.Errorf("expected 3 attempts, got %d", operator.requests)
+	}
+	if atomic.LoadInt32(&tracker.opened) != atomic.LoadInt32(&tracker.closed) {
+		t.Errorf("expected every response body to be closed, %d of %d were", tracker.closed, tracker.opened)
+	}
+
+	// Allocations are retried with the same idempotency key, so the operator gives every attempt the same claim
+	var keys []string
+	var mu sync.Mutex
+	operator = &standInOperator{responses: []func(http.ResponseWriter){status(http.StatusBadGateway), claimResponse}}
+	c, _ = newOperatorClient(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		keys = append(keys, req.Header.Get(idempotencyKeyHeader))
+		mu.Unlock()
+		operator.ServeHTTP(w, req)
+	}))
+	if _, err := c.Allocate(context.Background(), &Route{}); err != nil {
+		t.Errorf("expected the allocation after retrying, got %v", err)
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("expected both attempts to carry the same idempotency key, got %q", keys)
+	}
+	if _, err := c.Allocate(context.Background(), &Route{}); err != nil || len(keys) != 3 || keys[2] == keys[0] {
+		t.Errorf("expected another allocation to have its own key, got %q, %v", keys, err)
+	}
+
+	// Including when they couldn't have reached the operator
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	operator = &standInOperator{responses: []func(http.ResponseWriter){status(http.StatusServiceUnavailable), func(w http.ResponseWriter) {
+		w.Write([]byte(`{"claimID": "claim-2"}`))
+	}}}
+	c, _ = newOperatorClient(t, operator)
+	c.Endpoints = append([]string{unreachable.URL}, c.Endpoints...)
+	if allocation, err := c.Allocate(context.Background(), &Route{}); err != nil || allocation.ClaimID != "claim-2" {
+		t.Errorf("expected the allocation after failing over and retrying, got %v, %v", allocation, err)
+	}
+}
+
+func TestOperatorClientPassesOnResponses(t *testing.T) {
+	operator := &standInOperator{responses: []func(http.ResponseWriter){func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Slow down.\n"))
+	}}}
+	c, tracker := newOperatorClient(t, operator)
+	activator := &Activator{Operator: c, Sessions: &Sessions{}, Routes: defaultRoutes}
+	resp := httptest.NewRecorder()
+	activator.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") != "7" || resp.Body.String() != "Slow down.\n" {
+		t.Errorf("expected the operator's response to be passed on, got %d %v %q", resp.Code, resp.Header(), resp.Body.String())
+	}
+	if tracker.opened != 1 || tracker.closed != 1 {
+		t.Errorf("expected the response body to be closed, %d of %d were", tracker.closed, tracker.opened)
+	}
+}
+
+func TestOperatorClientTimeout(t *testing.T) {
+	operator := &standInOperator{responses: []func(http.ResponseWriter){func(w http.ResponseWriter) {
+		time.Sleep(100 * time.Millisecond)
+		claimResponse(w)
+	}}}
+	c, _ := newOperatorClient(t, operator)
+	c.Client.Timeout = 10 * time.Millisecond
+	if _, err := c.Claim(context.Background(), "claim-1", nil); err == nil {
+		t.Fatal("expected a slow operator to time out")
+	}
+	if atomic.LoadInt32(&operator.requests) != 3 {
+		t.Errorf("expected timeouts to be retried, got %d attempts", operator.requests)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := &CircuitBreaker{Threshold: 2, Cooldown: 10 * time.Second, now: func() time.Time { return now }}
+	operator := &standInOperator{responses: []func(http.ResponseWriter){status(http.StatusInternalServerError), status(http.StatusInternalServerError), claimResponse}}
+	c, _ := newOperatorClient(t, operator)
+	c.Retries = 0
+	c.Breaker = breaker
+
+	c.Claim(context.Background(), "claim-1", nil)
+	c.Claim(context.Background(), "claim-1", nil)
+	var circuitErr *CircuitOpenError
+	if _, err := c.Claim(context.Background(), "claim-1", nil); !errors.As(err, &circuitErr) || circuitErr.RetryAfter != 10*time.Second {
+		t.Errorf("expected the circuit to open, got %v", err)
+	}
+	if atomic.LoadInt32(&operator.requests) != 2 {
+		t.Errorf("expected no request while the circuit is open, got %d", operator.requests)
+	}
+
+	resp := httptest.NewRecorder()
+	writeOperatorError(resp, circuitErr)
+	if resp.Code != http.StatusServiceUnavailable || resp.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected clients to be told when to retry, got %d %v", resp.Code, resp.Header())
+	}
+
+	now = now.Add(10 * time.Second)
+	if _, err := c.Claim(context.Background(), "claim-1", nil); err != nil {
+		t.Errorf("expected a trial request after the cooldown, got %v", err)
+	}
+	if _, err := c.Claim(context.Background(), "claim-1", nil); err != nil {
+		t.Errorf("expected the circuit to close after the trial succeeded, got %v", err)
+	}
+}
+
+func TestOperatorCredentials(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := writeFile(t, dir, "token", "token-1\n")
+	now := time.Date(2021, 9, 6, 9, 0, 0, 0, time.UTC)
+	var authorization, signature []string
+	operator := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authorization = append(authorization, req.Header.Get("Authorization"))
+		signature = append(signature, req.Header.Get(signatureHeader))
+		claimResponse(w)
+	})
+	c, _ := newOperatorClient(t, operator)
+	c.Credentials = &OperatorCredentials{TokenFile: tokenFile, KeyID: "k1", Key: []byte("secret"), now: func() time.Time { return now }}
+
+	c.Claim(context.Background(), "claim-1", nil)
+	writeFile(t, dir, "token", "token-2")
+	c.Claim(context.Background(), "claim-1", nil)
+	now = now.Add(2 * tokenRereadInterval)
+	c.Claim(context.Background(), "claim-1", nil)
+	if len(authorization) != 3 || authorization[0] != "Bearer token-1" || authorization[1] != "Bearer token-1" || authorization[2] != "Bearer token-2" {
+		t.Errorf("expected the token to be sent, and read again once a minute, got %q", authorization)
+	}
+
+	bodySum := sha256.Sum256(nil)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("GET\n/claims/claim-1\n1630918800\n" + hex.EncodeToString(bodySum[:]) + "\n"))
+	expected := "keyId=k1,timestamp=1630918800,signature=" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if signature[0] != expected {
+		t.Errorf("expected the request to be signed as %q, got %q", expected, signature[0])
+	}
+
+	os.Remove(tokenFile)
+	now = now.Add(2 * tokenRereadInterval)
+	if _, err := c.Claim(context.Background(), "claim-1", nil); err == nil {
+		t.Error("expected requests to fail once the token can't be read")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Route sends requests for a host and path prefix to the ScalablePods in a pool, or matching a label selector.
+type Route struct {
+	// Host to match, ignoring any port. "*.example.com" matches its subdomains, and empty matches any host.
+	Host string `json:"host,omitempty"`
+	// Path prefix to match, on a path segment boundary. Defaults to /.
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// Namespace of the ScalablePods, or any namespace if empty
+	Namespace string `json:"namespace,omitempty"`
+	// ScalablePodPool to claim ScalablePods from
+	Pool string `json:"pool,omitempty"`
+	// Label selector of the ScalablePods to claim, e.g. "app=web,tier!=batch"
+	Selector string `json:"selector,omitempty"`
+}
+
+// key identifies the route, so that sessions for one route aren't used for another.
+func (r *Route) key() string {
+	return r.Host + r.PathPrefix
+}
+
+// matches is whether the route serves the request.
+func (r *Route) matches(host, path string) bool {
+	switch {
+	case strings.HasPrefix(r.Host, "*."):
+		if !strings.HasSuffix(host, r.Host[1:]) {
+			return false
+		}
+	case r.Host != "" && r.Host != host:
+		return false
+	}
+	prefix := strings.TrimSuffix(r.PathPrefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+/* RoutingTable maps hostnames and path prefixes to the ScalablePods that serve them, so that one user-facing server can
+ * front many workloads. It is loaded from a YAML file:
+ *   routes:
+ *   - host: docs.example.com
+ *     pool: docs
+ *   - host: "*.example.com"
+ *     pathPrefix: /api
+ *     namespace: apps
+ *     selector: app=api
+ * A request goes to the most specific route that matches it: exact hosts before wildcards before any host, and then
+ * the longest path prefix.
+ */
+type RoutingTable struct {
+	Routes []Route `json:"routes"`
+}
+
+// defaultRoutes sends every request to any ScalablePod, for when there is no routing table.
+var defaultRoutes = &RoutingTable{Routes: []Route{{PathPrefix: "/"}}}
+
+// LoadRoutes reads a routing table from a YAML file.
+func LoadRoutes(path string) (*RoutingTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var table RoutingTable
+	if err := yaml.UnmarshalStrict(data, &table); err != nil {
+		return nil, fmt.Errorf("unable to parse routes: %v", err)
+	}
+	if err := table.normalize(); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// normalize fills in defaults, checks the routes, and sorts them from the most to the least specific.
+func (t *RoutingTable) normalize() error {
+	for i := range t.Routes {
+		route := &t.Routes[i]
+		route.Host = strings.ToLower(route.Host)
+		if route.PathPrefix == "" {
+			route.PathPrefix = "/"
+		}
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("route %d: pathPrefix %q must start with /", i, route.PathPrefix)
+		}
+		if strings.Contains(strings.TrimPrefix(route.Host, "*."), "*") {
+			return fmt.Errorf("route %d: host %q may only have a wildcard as its first label", i, route.Host)
+		}
+	}
+	sort.SliceStable(t.Routes, func(i, j int) bool {
+		a, b := &t.Routes[i], &t.Routes[j]
+		if hostRank(a.Host) != hostRank(b.Host) {
+			return hostRank(a.Host) < hostRank(b.Host)
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+	return nil
+}
+
+// hostRank orders hosts from the most to the least specific.
+func hostRank(host string) int {
+	switch {
+	case host == "":
+		return 2
+	case strings.HasPrefix(host, "*."):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Match returns the route serving the request, if any.
+func (t *RoutingTable) Match(req *http.Request) (*Route, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for i := range t.Routes {
+		if t.Routes[i].matches(host, req.URL.Path) {
+			return &t.Routes[i], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func loadRoutes(t *testing.T, routes string) (*RoutingTable, error) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := ioutil.WriteFile(path, []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadRoutes(path)
+}
+
+func TestRoutingTable(t *testing.T) {
+	table, err := loadRoutes(t, `
+routes:
+- pool: fallback
+- host: "*.example.com"
+  pool: wildcard
+- host: Docs.Example.com
+  pool: docs
+- host: docs.example.com
+  pathPrefix: /api/
+  namespace: apps
+  selector: app=api
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		url  string
+		pool string
+	}{
+		{"http://docs.example.com/", "docs"},
+		{"http://docs.example.com:8080/api", ""},
+		{"http://docs.example.com/api/v1", ""},
+		{"http://docs.example.com/apis", "docs"},
+		{"http://blog.example.com/api", "wildcard"},
+		{"http://example.com/", "fallback"},
+		{"http://elsewhere.io/", "fallback"},
+	} {
+		route, ok := table.Match(httptest.NewRequest(http.MethodGet, test.url, nil))
+		if !ok || route.Pool != test.pool {
+			t.Errorf("expected %s to go to pool %q, got %+v", test.url, test.pool, route)
+		}
+	}
+
+	table, _ = loadRoutes(t, "routes:\n- host: docs.example.com\n")
+	if route, ok := table.Match(httptest.NewRequest(http.MethodGet, "http://blog.example.com/", nil)); ok {
+		t.Errorf("expected no route for an unknown host, got %+v", route)
+	}
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	for _, routes := range []string{
+		"routes:\n- pathPrefix: api\n",
+		"routes:\n- host: docs.*.com\n",
+		"routes:\n- pool: docs\n  unknown: field\n",
+	} {
+		if _, err := loadRoutes(t, routes); err == nil {
+			t.Errorf("expected %q to be rejected", routes)
+		}
+	}
+}
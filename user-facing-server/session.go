@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Prefix of the cookies carrying the signed claim ID of the ScalablePod serving a browser, the counterpart of
+// claimHeader. Each route has its own cookie, so a browser can hold sessions for several routes on one host.
+const sessionCookie = "scalablepod-session"
+
+/* Sessions ties clients to the ScalablePod they claimed for a route. Each client is given a session token,
+ * "<claim ID>.<signature>", in both the claimHeader response header and the route's session cookie, and sends it back
+ * with either. The signature, an HMAC-SHA256 of the route and claim ID, stops clients from using claims they weren't
+ * given, or using a claim for one route on another.
+ */
+type Sessions struct {
+	// Key signing session tokens. Every replica must share it for sessions to work across replicas.
+	Key []byte
+	// Whether session cookies are only sent over HTTPS even when requests arrive over plain HTTP, as they do when TLS is
+	// terminated in front of the server. Cookies set on requests that arrive over TLS always are.
+	Secure bool
+}
+
+// Token returns the session token for a claim on the route.
+func (s *Sessions) Token(route *Route, claimID string) string {
+	return claimID + "." + s.sign(route, claimID)
+}
+
+// ClaimID returns the claim ID of the request's session for the route, if it has one with a valid signature.
+func (s *Sessions) ClaimID(req *http.Request, route *Route) (string, bool) {
+	token := req.Header.Get(claimHeader)
+	if token == "" {
+		cookie, err := req.Cookie(cookieName(route))
+		if err != nil {
+			return "", false
+		}
+		token = cookie.Value
+	}
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", false
+	}
+	claimID, signature := token[:i], token[i+1:]
+	return claimID, claimID != "" && hmac.Equal([]byte(signature), []byte(s.sign(route, claimID)))
+}
+
+// Set gives the client of the request a session for the claim on the route.
+func (s *Sessions) Set(w http.ResponseWriter, req *http.Request, route *Route, claimID string) {
+	token := s.Token(route, claimID)
+	w.Header().Set(claimHeader, token)
+	http.SetCookie(w, &http.Cookie{Name: cookieName(route), Value: token, Path: route.PathPrefix, HttpOnly: true,
+		Secure: s.Secure || req.TLS != nil, SameSite: http.SameSiteLaxMode})
+}
+
+func (s *Sessions) sign(route *Route, claimID string) string {
+	mac := hmac.New(sha256.New, s.Key)
+	mac.Write([]byte(route.key() + "\x00" + claimID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookieName returns the name of the route's session cookie.
+func cookieName(route *Route) string {
+	sum := sha256.Sum256([]byte(route.key()))
+	return sessionCookie + "-" + hex.EncodeToString(sum[:4])
+}
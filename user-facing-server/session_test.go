@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSessionCookieSecure(t *testing.T) {
+	route := &Route{PathPrefix: "/"}
+	cookie := func(sessions *Sessions, req *http.Request) *http.Cookie {
+		w := httptest.NewRecorder()
+		sessions.Set(w, req, route, "claim-1")
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected a session cookie, got %v", cookies)
+		}
+		return cookies[0]
+	}
+	plain := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	overTLS := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	overTLS.TLS = &tls.ConnectionState{}
+
+	sessions := &Sessions{Key: []byte("secret")}
+	if c := cookie(sessions, plain); c.Secure {
+		t.Error("expected a plain HTTP request's cookie not to be Secure")
+	}
+	if c := cookie(sessions, overTLS); !c.Secure || !c.HttpOnly {
+		t.Errorf("expected a TLS request's cookie to be Secure and HttpOnly, got %+v", c)
+	}
+	sessions.Secure = true
+	if c := cookie(sessions, plain); !c.Secure {
+		t.Error("expected the cookie to be Secure when TLS is terminated in front of the server")
+	}
+}